@@ -33,6 +33,7 @@ module.exports = function(grunt) {
                 files: {
                     'tmp/js/main.js': './assets/javascripts/main.coffee',
                     'tmp/js/video.js': './assets/javascripts/video.coffee',
+                    'tmp/js/push.js': './assets/javascripts/push.coffee',
                 }
             },
         },
@@ -45,6 +46,10 @@ module.exports = function(grunt) {
             video: {
                 src: 'tmp/js/video.js',
                 dest: 'public/assets/js/video.js'
+            },
+            push: {
+                src: 'tmp/js/push.js',
+                dest: 'public/assets/js/push.js'
             }
         },
 
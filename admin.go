@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	macaron "gopkg.in/macaron.v1"
+)
+
+// adminUser строка в списке пользователей
+type adminUser struct {
+	models.User
+	Videos  int
+	Twitch  string
+	YouTube string
+	Admin   bool
+}
+
+// tokenStatus состояние токенов площадок для администратора
+func tokenStatus(user models.User) (twitch string, youtube string) {
+	switch {
+	case user.TWChannelID == "":
+		twitch = "не привязан"
+	case user.TWOAuth == "":
+		twitch = "нет токена"
+	default:
+		twitch = "привязан"
+	}
+	switch {
+	case user.YTChannelID == "":
+		youtube = "не привязан"
+	case user.YTRefreshToken == "":
+		youtube = "нет refresh token"
+	case user.YTExpiry.Before(time.Now()):
+		youtube = "обновится при синхронизации"
+	default:
+		youtube = "до " + user.YTExpiry.Format("02-01-06 15:04")
+	}
+	return twitch, youtube
+}
+
+// adminCheck текущий пользователь, если он администратор. Остальным
+// отдается 404, как и для /debug/status
+func adminCheck(ctx *macaron.Context) (models.User, bool) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if !isAdmin(user) {
+		renderError(ctx, user, models.ErrNotFound)
+		return user, false
+	}
+	return user, true
+}
+
+func adminHandler(ctx *macaron.Context) {
+	user, ok := adminCheck(ctx)
+	if !ok {
+		return
+	}
+
+	users, err := models.Users.SelectUsers()
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+	counts, err := models.Videos.CountVideosByUser()
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+	stats, err := models.SelectStats()
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+
+	var rows []adminUser
+	for _, u := range users {
+		row := adminUser{User: u, Videos: counts[u.Id], Admin: isAdmin(u)}
+		row.Twitch, row.YouTube = tokenStatus(u)
+		rows = append(rows, row)
+	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: "Администрирование", URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Users"] = rows
+	ctx.Data["Stats"] = stats
+	ctx.Data["Failures"] = status.recentFailures()
+	ctx.Data["Error"] = ctx.Query("error")
+	ctx.HTML(200, "admin")
+}
+
+// adminTarget пользователь из адреса /admin/users/:id
+func adminTarget(ctx *macaron.Context, admin models.User) (models.User, bool) {
+	user, err := models.Users.SelectUserForID(ctx.ParamsInt64(":id"))
+	if err != nil {
+		renderError(ctx, admin, err)
+		return user, false
+	}
+	return user, true
+}
+
+func adminSyncHandler(ctx *macaron.Context) {
+	admin, ok := adminCheck(ctx)
+	if !ok {
+		return
+	}
+	user, ok := adminTarget(ctx, admin)
+	if !ok {
+		return
+	}
+	slog.InfoContext(ctx.Req.Context(), "admin sync requested", "admin", admin.UserName, "target", user.UserName)
+	go runUser(user)
+	ctx.Redirect(config().Server.BasePath + "/admin")
+}
+
+func adminDisableHandler(ctx *macaron.Context) {
+	admin, ok := adminCheck(ctx)
+	if !ok {
+		return
+	}
+	user, ok := adminTarget(ctx, admin)
+	if !ok {
+		return
+	}
+	if user.Id == admin.Id {
+		ctx.Redirect(config().Server.BasePath + "/admin?error=self")
+		return
+	}
+	err := user.SetDisabled(!user.Disabled)
+	if err != nil {
+		renderError(ctx, admin, err)
+		return
+	}
+	slog.InfoContext(ctx.Req.Context(), "admin user disabled", "admin", admin.UserName, "target", user.UserName, "disabled", !user.Disabled)
+	ctx.Redirect(config().Server.BasePath + "/admin")
+}
+
+func adminDeleteHandler(ctx *macaron.Context) {
+	admin, ok := adminCheck(ctx)
+	if !ok {
+		return
+	}
+	user, ok := adminTarget(ctx, admin)
+	if !ok {
+		return
+	}
+	if user.Id == admin.Id {
+		ctx.Redirect(config().Server.BasePath + "/admin?error=self")
+		return
+	}
+	err := models.Users.DeleteUser(user.Id)
+	if err != nil {
+		renderError(ctx, admin, err)
+		return
+	}
+	slog.InfoContext(ctx.Req.Context(), "admin user deleted", "admin", admin.UserName, "target", user.UserName)
+	ctx.Redirect(config().Server.BasePath + "/admin")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
+)
+
+type apiVideo struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Title       string    `json:"title"`
+	Channel     string    `json:"channel"`
+	ChannelID   string    `json:"channel_id"`
+	VideoID     string    `json:"video_id"`
+	Game        string    `json:"game,omitempty"`
+	Description string    `json:"description"`
+	URL         string    `json:"url"`
+	ThumbURL    string    `json:"thumb_url"`
+	Length      int       `json:"length"`
+	Date        time.Time `json:"date"`
+}
+
+type apiVideos struct {
+	Page   int        `json:"page"`
+	Count  int        `json:"count"`
+	Videos []apiVideo `json:"videos"`
+}
+
+type apiGroup struct {
+	ID       int64                 `json:"id"`
+	Name     string                `json:"name"`
+	Channels []models.GroupChannel `json:"channels"`
+}
+
+func toAPIVideos(page, count int, subVideos []models.Subvideo) apiVideos {
+	videos := apiVideos{Page: page, Count: count, Videos: []apiVideo{}}
+	for _, video := range subVideos {
+		videos.Videos = append(videos.Videos, apiVideo{
+			ID:          video.Id,
+			Type:        video.TypeSub,
+			Title:       video.Title,
+			Channel:     video.Channel,
+			ChannelID:   video.ChannelID,
+			VideoID:     video.VideoID,
+			Game:        video.Game,
+			Description: video.Description,
+			URL:         video.URL,
+			ThumbURL:    video.ThumbURL,
+			Length:      video.Length,
+			Date:        video.Date.UTC(),
+		})
+	}
+	return videos
+}
+
+func apiPage(ctx *macaron.Context) int {
+	page, err := strconv.Atoi(ctx.Query("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func apiVideosHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	page := apiPage(ctx)
+	subVideos, count, err := clientVideo().SortVideo(user, config().Server.PageSize, ctx.Query("channelID"), page)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "api failed", "err", err)
+		ctx.JSON(500, map[string]string{"error": "internal error"})
+		return
+	}
+	ctx.JSON(200, toAPIVideos(page, count, subVideos))
+}
+
+func apiGroupsHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	groups, err := models.SelectGroups(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "api failed", "err", err)
+		ctx.JSON(500, map[string]string{"error": "internal error"})
+		return
+	}
+	apiGroups := []apiGroup{}
+	for _, group := range groups {
+		channels, err := models.SelectGroupChannels(group.Id)
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "api failed", "err", err)
+			ctx.JSON(500, map[string]string{"error": "internal error"})
+			return
+		}
+		apiGroups = append(apiGroups, apiGroup{ID: group.Id, Name: group.Name, Channels: channels})
+	}
+	ctx.JSON(200, apiGroups)
+}
+
+func apiGroupVideosHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	group, err := models.SelectGroup(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		ctx.JSON(404, map[string]string{"error": "group not found"})
+		return
+	}
+	page := apiPage(ctx)
+	subVideos, count, err := clientVideo().GroupVideo(user, config().Server.PageSize, group.Id, page)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "api failed", "err", err)
+		ctx.JSON(500, map[string]string{"error": "internal error"})
+		return
+	}
+	ctx.JSON(200, toAPIVideos(page, count, subVideos))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DeKoniX/subvideo/logging"
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/video"
+)
+
+// backfillInterval как часто проверять задачи, которые ждут квоту или
+// площадку после ошибки
+const backfillInterval = 10 * time.Minute
+
+// backfillWake будит загрузку истории, когда появилась новая задача
+var backfillWake = make(chan struct{}, 1)
+
+// startBackfill ставит загрузку истории после первой привязки площадки
+func startBackfill(ctx context.Context, user models.User, provider string) {
+	started, err := models.StartBackfill(user.Id, provider)
+	if err != nil {
+		slog.ErrorContext(ctx, "backfill start failed", "provider", provider, "err", err)
+		return
+	}
+	if !started {
+		return
+	}
+	slog.InfoContext(ctx, "backfill queued", "user", user.UserName, "provider", provider)
+	select {
+	case backfillWake <- struct{}{}:
+	default:
+	}
+}
+
+// youtubeQuota единицы квоты YouTube, потраченные загрузкой истории за
+// текущие сутки по UTC. Обычная синхронизация сюда не входит, поэтому
+// backfill.youtube_quota берется с запасом. Счетчик живет в памяти
+type youtubeQuota struct {
+	mu   sync.Mutex
+	day  string
+	used int
+}
+
+var backfillQuota = &youtubeQuota{}
+
+func (q *youtubeQuota) rollover() {
+	day := time.Now().UTC().Format("2006-01-02")
+	if q.day != day {
+		q.day, q.used = day, 0
+	}
+}
+
+// left сколько единиц из limit еще можно потратить сегодня
+func (q *youtubeQuota) left(limit int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return limit - q.used
+}
+
+func (q *youtubeQuota) spend(units int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	q.used += units
+}
+
+// exhaust YouTube сам ответил, что квоты нет: до конца суток не тратим
+func (q *youtubeQuota) exhaust(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	q.used = max(q.used, limit)
+}
+
+// channelUnits сколько квоты нужно на один канал: страницы плейлиста
+// загрузок и описаний видео по 50 штук
+func channelUnits(videos int) int {
+	return 2 * ((videos + 49) / 50)
+}
+
+// runBackfill загружает историю тем, кто только что привязал площадку.
+// Задачи лежат в базе, поэтому после перезапуска продолжаются с того
+// места, где остановились
+func runBackfill() {
+	for {
+		status.beat("backfill", "checking")
+		backfills, err := models.SelectRunningBackfills()
+		if err != nil {
+			slog.Error("backfills failed", "err", err)
+		}
+		for _, backfill := range backfills {
+			if app.stopped() {
+				return
+			}
+			runBackfillJob(backfill)
+		}
+
+		status.beat("backfill", "waiting")
+		timer := time.NewTimer(backfillInterval)
+		select {
+		case <-app.stop.Done():
+			timer.Stop()
+			return
+		case <-backfillWake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// runBackfillJob продвигает одну задачу, сколько позволяют квота и
+// площадка. Недоступная площадка не роняет задачу, она продолжится позже
+func runBackfillJob(backfill models.Backfill) {
+	user, err := models.Users.SelectUserForID(backfill.UserID)
+	if err != nil {
+		slog.Error("backfill user failed", "user_id", backfill.UserID, "err", err)
+		return
+	}
+	if user.Disabled {
+		return
+	}
+	ctx := logging.WithProvider(logging.WithUser(app.work, user.UserName), backfill.Provider)
+	status.beat("backfill", backfill.Provider+" "+user.UserName)
+
+	switch backfill.Provider {
+	case "youtube":
+		err = backfillYouTube(ctx, user, &backfill)
+	case "twitch":
+		err = backfillTwitch(ctx, user, &backfill)
+	default:
+		err = errors.New("unknown provider " + backfill.Provider)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, video.ErrUpstreamUnavailable), ctx.Err() != nil:
+		slog.WarnContext(ctx, "backfill interrupted, will retry", "done", backfill.Done, "total", backfill.Total, "err", err)
+	default:
+		slog.ErrorContext(ctx, "backfill failed", "err", err)
+		backfill.Status = models.BackfillFailed
+		backfill.Error = err.Error()
+		err = backfill.Save()
+		if err != nil {
+			slog.ErrorContext(ctx, "backfill save failed", "err", err)
+		}
+	}
+}
+
+// insertBackfill сохраняет старые видео без уведомлений
+func insertBackfill(ctx context.Context, user models.User, videos []models.Subvideo) (added int, err error) {
+	for _, video := range videos {
+		video.UserID = user.Id
+		video.Backfilled = true
+		inserted, err := video.Insert(ctx)
+		if err != nil {
+			return added, err
+		}
+		if inserted {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// backfillYouTube проходит подписки по одному каналу, после каждого
+// сохраняет прогресс
+func backfillYouTube(ctx context.Context, user models.User, backfill *models.Backfill) error {
+	conf := config().Backfill
+	if backfill.Channels == "" && backfill.Total == 0 {
+		if backfillQuota.left(conf.YouTubeQuota) < 1 {
+			return nil
+		}
+		channels, units, err := clientVideo().YTClient.Subscriptions(ctx, user)
+		backfillQuota.spend(units)
+		if err != nil {
+			return err
+		}
+		backfill.Channels = strings.Join(channels, ",")
+		backfill.Total = len(channels)
+		err = backfill.Save()
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "backfill started", "channels", backfill.Total, "days", conf.Days, "videos", conf.Videos)
+	}
+
+	channels := strings.Split(backfill.Channels, ",")
+	since := backfill.CreatedAt.AddDate(0, 0, -conf.Days)
+	for backfill.Done < backfill.Total {
+		if backfillQuota.left(conf.YouTubeQuota) < channelUnits(conf.Videos) {
+			slog.InfoContext(ctx, "backfill paused until quota resets", "done", backfill.Done, "total", backfill.Total)
+			return nil
+		}
+		if !app.begin() {
+			return nil
+		}
+		channelID := channels[backfill.Done]
+		videos, units, err := clientVideo().YTClient.BackfillChannel(ctx, user, channelID, since, conf.Videos)
+		backfillQuota.spend(units)
+		switch {
+		case errors.Is(err, video.ErrQuotaExceeded):
+			app.end()
+			backfillQuota.exhaust(conf.YouTubeQuota)
+			slog.WarnContext(ctx, "backfill paused, youtube quota exceeded", "done", backfill.Done, "total", backfill.Total)
+			return nil
+		case errors.Is(err, models.ErrNotFound):
+			// канал удален, пропускаем
+			slog.WarnContext(ctx, "backfill channel skipped", "channel_id", channelID, "err", err)
+			err = nil
+		}
+		added := 0
+		if err == nil {
+			added, err = insertBackfill(ctx, user, videos)
+		}
+		if err == nil {
+			backfill.Done++
+			backfill.Videos += added
+			err = backfill.Save()
+		}
+		app.end()
+		if err != nil {
+			return err
+		}
+		slog.DebugContext(ctx, "backfill channel done", "channel_id", channelID, "fetched", len(videos), "new", added,
+			"done", backfill.Done, "total", backfill.Total)
+	}
+
+	backfill.Status = models.BackfillDone
+	slog.InfoContext(ctx, "backfill finished", "videos", backfill.Videos)
+	return backfill.Save()
+}
+
+// backfillTwitch листает общую ленту videos/followed назад до
+// backfill.days. Счетчики видео по каналам живут только в памяти, после
+// перезапуска канал может получить чуть больше backfill.videos
+func backfillTwitch(ctx context.Context, user models.User, backfill *models.Backfill) error {
+	conf := config().Backfill
+	since := backfill.CreatedAt.AddDate(0, 0, -conf.Days)
+	backfill.Total = conf.Days * 24
+	counts := map[string]int{}
+	for {
+		if !app.begin() {
+			return nil
+		}
+		videos, oldest, next, err := clientVideo().TWClient.BackfillPage(ctx, user.TWOAuth, backfill.Offset)
+		if err != nil {
+			app.end()
+			return err
+		}
+		var keep []models.Subvideo
+		for _, video := range videos {
+			if video.Date.Before(since) || counts[video.ChannelID] >= conf.Videos {
+				continue
+			}
+			counts[video.ChannelID]++
+			keep = append(keep, video)
+		}
+		added, err := insertBackfill(ctx, user, keep)
+		if err == nil {
+			backfill.Videos += added
+			backfill.Offset = next
+			if !oldest.IsZero() {
+				backfill.Done = min(backfill.Total, int(backfill.CreatedAt.Sub(oldest).Hours()))
+			}
+			if next == 0 || oldest.Before(since) {
+				backfill.Done = backfill.Total
+				backfill.Status = models.BackfillDone
+			}
+			err = backfill.Save()
+		}
+		app.end()
+		if err != nil {
+			return err
+		}
+		if backfill.Status == models.BackfillDone {
+			slog.InfoContext(ctx, "backfill finished", "videos", backfill.Videos)
+			return nil
+		}
+		// история не срочная, не занимаем лимит запросов Twitch
+		if !app.sleep(time.Second) {
+			return nil
+		}
+	}
+}
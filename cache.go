@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/upstream"
+)
+
+// httpCacheAge ответы, которые не запрашивались дольше, удаляет cleanup
+const httpCacheAge = 7 * 24 * time.Hour
+
+// httpCache кэш ответов площадок, общий для клиентов. Создается при
+// запуске и переживает перезагрузку конфигурации, nil - upstream.cache: off
+var httpCache *upstream.Cache
+
+// dbCacheStore хранит ответы в таблице http_cache основной базы
+type dbCacheStore struct{}
+
+func (dbCacheStore) Get(key string) ([]byte, error) {
+	value, err := models.GetHTTPCache(key)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, upstream.ErrCacheMiss
+	}
+	return value, err
+}
+
+func (dbCacheStore) Set(key string, value []byte) error {
+	return models.SetHTTPCache(key, value)
+}
+
+func (dbCacheStore) Prune(before time.Time) (int64, error) {
+	return models.DeleteHTTPCacheBefore(before)
+}
+
+func newHTTPCache(conf *configYML) (*upstream.Cache, error) {
+	switch conf.Upstream.Cache {
+	case "off":
+		return nil, nil
+	case "disk":
+		store, err := upstream.NewDiskStore(conf.Upstream.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return upstream.NewCache(conf.Upstream.CacheEntries, store), nil
+	case "db":
+		return upstream.NewCache(conf.Upstream.CacheEntries, dbCacheStore{}), nil
+	}
+	return upstream.NewCache(conf.Upstream.CacheEntries, nil), nil
+}
+
+// logCacheStats пишет, сколько ответов обошлось без скачивания
+func logCacheStats() {
+	if httpCache == nil {
+		return
+	}
+	stats := httpCache.Stats()
+	slog.Info("upstream cache", "hits", stats.Hits, "revalidated", stats.Revalidated, "misses", stats.Misses,
+		"ratio", int(stats.Ratio()*100))
+}
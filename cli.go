@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DeKoniX/subvideo/fakeupstream"
+	"github.com/DeKoniX/subvideo/logging"
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/video"
+)
+
+// syncNotifyWait сколько subvideo sync ждет отправки уведомлений
+const syncNotifyWait = time.Minute
+
+// Коды выхода подкоманд, чтобы cron и скрипты могли их различать
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitConfig   = 3
+	exitNotFound = 4
+	exitUpstream = 5
+)
+
+const usageText = `Использование: subvideo [-config subvideo.yml] <команда> [флаги]
+
+Команды:
+  serve                              запустить веб-сервер (по умолчанию)
+  config check                       проверить конфигурацию
+  sync --user <имя> [--provider yt|tw]  синхронизировать пользователя один раз
+  users list                         список пользователей
+  users delete <имя>                 удалить пользователя со всеми данными
+  cleanup                            удалить старые видео и неактивных пользователей
+  export --user <имя> [--out файл] [--videos]  выгрузить пользователя в JSON
+  import [--in файл] [--replace]     загрузить пользователя из JSON
+  migrate                            создать и обновить таблицы базы
+  fakeupstream [--listen адрес]      поддельные Twitch и YouTube для разработки без сети
+
+Коды выхода: 0 - успех, 1 - ошибка, 2 - неверные аргументы,
+3 - ошибка конфигурации, 4 - не найдено, 5 - площадка недоступна
+`
+
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), usageText)
+	fmt.Fprintln(flag.CommandLine.Output(), "\nФлаги:")
+	flag.PrintDefaults()
+}
+
+// runCommand выполняет подкоманду и возвращает код выхода
+func runCommand(configPath string, args []string) int {
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "", "serve":
+		return serve(configPath)
+	case "config":
+		if len(args) == 1 && args[0] == "check" {
+			return configCheck(configPath)
+		}
+	case "sync":
+		return syncCommand(configPath, args)
+	case "users":
+		return usersCommand(configPath, args)
+	case "cleanup":
+		return cleanupCommand(configPath, args)
+	case "export":
+		return exportCommand(configPath, args)
+	case "import":
+		return importCommand(configPath, args)
+	case "migrate":
+		return migrateCommand(configPath, args)
+	case "fakeupstream":
+		return fakeUpstreamCommand(args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s %v\n\n", command, args)
+	usage()
+	return exitUsage
+}
+
+// setup читает конфигурацию и подключается к базе, общее для всех команд.
+// Таблицы обновляют только migrate и serve, остальным нужна готовая база
+func setup(configPath string, migrate bool) int {
+	err := getConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid config:\n%v\n", configPath, err)
+		return exitConfig
+	}
+	err = logging.Setup(os.Stderr, config().Log.Format, config().Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+	httpCache, err = newHTTPCache(config())
+	if err != nil {
+		slog.Error("upstream cache init failed", "err", err)
+		return exitConfig
+	}
+	currentVideo.Store(newVideoClient(config()))
+
+	err = models.Init(config().DataBase.Driver, config().databaseSource())
+	if err != nil {
+		slog.Error("database init failed", "err", err)
+		return exitFailure
+	}
+	if migrate {
+		err = models.Migrate()
+		if err != nil {
+			slog.Error("database migration failed", "err", err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	err = models.Ready(app.stop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "database is not ready, run subvideo migrate: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// parseFlags разбирает флаги подкоманды, лишние аргументы считаются ошибкой
+func parseFlags(flags *flag.FlagSet, args []string) bool {
+	flags.SetOutput(os.Stderr)
+	err := flags.Parse(args)
+	if err == nil && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected arguments: %v", flags.Args())
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return err == nil
+}
+
+// errorCode код выхода для ошибки
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, video.ErrUpstreamUnavailable), errors.Is(err, video.ErrAuthExpired):
+		return exitUpstream
+	default:
+		return exitFailure
+	}
+}
+
+func syncCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	userName := flags.String("user", "", "Имя пользователя")
+	provider := flags.String("provider", "", "Только одна площадка: yt или tw")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *userName == "" || (*provider != "" && *provider != "yt" && *provider != "tw") {
+		fmt.Fprintln(os.Stderr, "usage: subvideo sync --user <name> [--provider yt|tw]")
+		return exitUsage
+	}
+	if code := setup(configPath, false); code != exitOK {
+		return code
+	}
+	// подробный журнал включается после подключения к базе, чтобы не выводить SQL миграций
+	err := logging.Setup(os.Stderr, config().Log.Format, "debug")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+
+	user, err := models.Users.SelectUserForUserName(*userName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %s: %v\n", *userName, err)
+		return errorCode(err)
+	}
+	if user.Disabled {
+		slog.Warn("user is disabled, syncing anyway", "user", user.UserName)
+	}
+
+	// новые видео уходят в сохраненные поиски и уведомления так же, как
+	// при синхронизации сервером
+	telegramBot = initTelegram()
+	notifier = initNotify()
+	notifier.Poll = 0
+	notifier.Start(app.stop, config().Notify.Workers)
+
+	ctx := logging.WithSyncID(logging.WithUser(app.stop, user.UserName), logging.NewID())
+	err = syncPipeline(ctx, user, *provider, func(p syncProvider, result video.SyncResult, err error) {
+		for _, v := range result.NewVideos {
+			fmt.Printf("%s\tnew\t%s\t%s\t%s\n", p.name, v.Channel, v.Title, v.URL)
+		}
+		for _, v := range result.WentLive {
+			fmt.Printf("%s\tlive\t%s\t%s\t%s\n", p.name, v.Channel, v.Title, v.URL)
+		}
+		for _, c := range result.Channels {
+			if c.Err != nil {
+				fmt.Printf("%s\tchannel\t%s\tfailed\t%v\n", p.name, c.ChannelID, c.Err)
+				continue
+			}
+			fmt.Printf("%s\tchannel\t%s\tfetched %d\tnew %d\n", p.name, c.Channel, c.Fetched, c.New)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: sync failed: %v\n", p.name, err)
+		}
+	})
+
+	// недоставленное за это время остается в базе, его отправит сервер
+	waitCtx, cancel := context.WithTimeout(app.stop, syncNotifyWait)
+	defer cancel()
+	if notifier.Wait(waitCtx) != nil {
+		fmt.Fprintln(os.Stderr, "some notifications are still pending, the server will send them")
+	}
+	if err != nil {
+		return errorCode(err)
+	}
+	return exitOK
+}
+
+func usersCommand(configPath string, args []string) int {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		if code := setup(configPath, false); code != exitOK {
+			return code
+		}
+		return usersList(os.Stdout)
+	case len(args) == 2 && args[0] == "delete":
+		if code := setup(configPath, false); code != exitOK {
+			return code
+		}
+		user, err := models.Users.SelectUserForUserName(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "user %s: %v\n", args[1], err)
+			return errorCode(err)
+		}
+		err = models.Users.DeleteUser(user.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "delete user %s: %v\n", user.UserName, err)
+			return exitFailure
+		}
+		fmt.Printf("user %s deleted\n", user.UserName)
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, "usage: subvideo users list | subvideo users delete <name>")
+	return exitUsage
+}
+
+func usersList(out io.Writer) int {
+	users, err := models.Users.SelectUsers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list users: %v\n", err)
+		return exitFailure
+	}
+	counts, err := models.Videos.CountVideosByUser()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list users: %v\n", err)
+		return exitFailure
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTWITCH\tYOUTUBE\tVIDEOS\tDISABLED\tLAST SEEN")
+	for _, user := range users {
+		twitch, youtube := tokenStatus(user)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%t\t%s\n", user.Id, user.UserName, twitch, youtube,
+			counts[user.Id], user.Disabled, user.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+	return exitOK
+}
+
+func cleanupCommand(configPath string, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: subvideo cleanup")
+		return exitUsage
+	}
+	if code := setup(configPath, false); code != exitOK {
+		return code
+	}
+	videos, users, err := cleanup()
+	fmt.Printf("deleted %d videos, %d users\n", videos, users)
+	if err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
+
+func exportCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	userName := flags.String("user", "", "Имя пользователя")
+	out := flags.String("out", "", "Файл для выгрузки, по умолчанию stdout")
+	videos := flags.Bool("videos", false, "Выгрузить и видео")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *userName == "" {
+		fmt.Fprintln(os.Stderr, "usage: subvideo export --user <name> [--out file] [--videos]")
+		return exitUsage
+	}
+	if code := setup(configPath, false); code != exitOK {
+		return code
+	}
+
+	user, err := models.Users.SelectUserForUserName(*userName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %s: %v\n", *userName, err)
+		return errorCode(err)
+	}
+	dump, err := models.DumpUser(user, *videos)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export %s: %v\n", user.UserName, err)
+		return exitFailure
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		// в выгрузке токены площадок, файл только для владельца
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(dump)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export %s: %v\n", user.UserName, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func importCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := flags.String("in", "", "Файл с выгрузкой, по умолчанию stdin")
+	replace := flags.Bool("replace", false, "Заменить существующего пользователя с тем же именем")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		defer file.Close()
+		r = file
+	}
+	var dump models.UserDump
+	err := json.NewDecoder(r).Decode(&dump)
+	if err != nil || dump.User.UserName == "" {
+		fmt.Fprintf(os.Stderr, "import: invalid dump: %v\n", err)
+		return exitUsage
+	}
+	if code := setup(configPath, false); code != exitOK {
+		return code
+	}
+
+	user, err := models.RestoreUser(dump, *replace)
+	if errors.Is(err, models.ErrUserExists) {
+		fmt.Fprintf(os.Stderr, "user %s already exists, use --replace\n", dump.User.UserName)
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import %s: %v\n", dump.User.UserName, err)
+		return exitFailure
+	}
+	fmt.Printf("user %s imported with id %d\n", user.UserName, user.Id)
+	return exitOK
+}
+
+func migrateCommand(configPath string, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: subvideo migrate")
+		return exitUsage
+	}
+	if code := setup(configPath, true); code != exitOK {
+		return code
+	}
+	err := models.Ready(app.stop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "database is not ready: %v\n", err)
+		return exitFailure
+	}
+	fmt.Println("database is up to date")
+	return exitOK
+}
+
+// fakeUpstreamCommand запускает поддельные площадки. Конфигурация subvideo
+// не нужна, адреса для нее выводятся при запуске
+func fakeUpstreamCommand(args []string) int {
+	flags := flag.NewFlagSet("fakeupstream", flag.ContinueOnError)
+	addr := flags.String("listen", "127.0.0.1:8282", "Адрес, на котором слушать")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	err := logging.Setup(os.Stderr, "text", "info")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		slog.Error("listen failed", "err", err)
+		return exitFailure
+	}
+	base := "http://" + listener.Addr().String()
+	fmt.Printf("Добавьте в subvideo.yml:\n\n"+
+		"twitch:\n  api_url: %s\nyoutube:\n  api_url: %s\n  oauth_url: %s\n\n",
+		base+fakeupstream.TwitchPath, base+fakeupstream.YouTubePath, base+fakeupstream.YouTubeOAuthPath)
+
+	server := &http.Server{Handler: fakeupstream.Handler()}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+	slog.Info("fake upstream is running", "addr", listener.Addr().String())
+
+	select {
+	case err = <-serverErr:
+		slog.Error("fake upstream stopped", "err", err)
+		return exitFailure
+	case <-app.stop.Done():
+		server.Close()
+	}
+	return exitOK
+}
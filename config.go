@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type configYML struct {
+	Server struct {
+		Listen      string `yaml:"listen"`
+		Socket      string `yaml:"socket"`
+		BasePath    string `yaml:"base_path"`
+		PageSize    int    `yaml:"page_size"`
+		Public      string `yaml:"public"`
+		Templates   string `yaml:"templates"`
+		TimeZones   string `yaml:"timezones"`
+		WatchConfig bool   `yaml:"watch_config"`
+	}
+	YouTube struct {
+		ClientID     string `yaml:"clientid"`
+		ClientSecret string `yaml:"clientsecret"`
+		RedirectURI  string `yaml:"redirecturi"`
+		DeveloperKey string `yaml:"developerkey"`
+		APIURL       string `yaml:"api_url"`
+		OAuthURL     string `yaml:"oauth_url"`
+	}
+	Twitch struct {
+		ClientID     string `yaml:"clientid"`
+		ClientSecret string `yaml:"clientsecret"`
+		RedirectURI  string `yaml:"redirecturi"`
+		APIURL       string `yaml:"api_url"`
+	}
+	DataBase struct {
+		Driver   string `yaml:"driver"`
+		Path     string `yaml:"path"`
+		Host     string `yaml:"host"`
+		Port     string `yaml:"port"`
+		DBname   string `yaml:"dbname"`
+		UserName string `yaml:"username"`
+		Password string `yaml:"password"`
+	}
+	Secret              string   `yaml:"secret"`
+	Admins              []string `yaml:"admins"`
+	HeadURL             string   `yaml:"headurl"`
+	DeleteVideoInterval int      `yaml:"delete_video_interval"`
+	DeleteUserInterval  int      `yaml:"delete_user_interval"`
+	Metrics             struct {
+		Yandex int    `yaml:"yandex"`
+		Google string `yaml:"google"`
+	}
+	SMTP struct {
+		Host     string `yaml:"host"`
+		Port     string `yaml:"port"`
+		UserName string `yaml:"username"`
+		Password string `yaml:"password"`
+		From     string `yaml:"from"`
+	}
+	Notify struct {
+		Workers       int    `yaml:"workers"`
+		Retries       int    `yaml:"retries"`
+		Backoff       int    `yaml:"backoff"`
+		LiveInterval  int    `yaml:"live_interval"`
+		WebhookSecret string `yaml:"webhook_secret"`
+	}
+	Sync struct {
+		ChannelLimit int `yaml:"channel_limit"`
+		Workers      int `yaml:"workers"`
+	}
+	Upstream struct {
+		Timeout  int     `yaml:"timeout"`
+		Retries  int     `yaml:"retries"`
+		Rate     float64 `yaml:"rate"`
+		Failures int     `yaml:"failures"`
+		Cooldown int     `yaml:"cooldown"`
+
+		Cache        string `yaml:"cache"`
+		CacheEntries int    `yaml:"cache_entries"`
+		CacheDir     string `yaml:"cache_dir"`
+	}
+	Backfill struct {
+		Days         int `yaml:"days"`
+		Videos       int `yaml:"videos"`
+		YouTubeQuota int `yaml:"youtube_quota"`
+	}
+	Log struct {
+		Format string `yaml:"format"`
+		Level  string `yaml:"level"`
+	}
+	Monitoring struct {
+		Token string `yaml:"token"`
+	}
+	WebPush struct {
+		PublicKey  string `yaml:"public_key"`
+		PrivateKey string `yaml:"private_key"`
+		Subject    string `yaml:"subject"`
+	}
+	Telegram struct {
+		Token   string `yaml:"token"`
+		APIURL  string `yaml:"api_url"`
+		BotName string `yaml:"bot_name"`
+		Webhook bool   `yaml:"webhook"`
+		Secret  string `yaml:"secret"`
+	}
+}
+
+// currentConfig действующая конфигурация. Перезагрузка подменяет ее
+// целиком, поэтому читать ее нужно через config(), а не хранить поля
+var currentConfig atomic.Pointer[configYML]
+
+func config() *configYML {
+	return currentConfig.Load()
+}
+
+// envPrefix префикс переменных окружения: twitch.clientsecret задается
+// через SUBVIDEO_TWITCH_CLIENTSECRET, а server.page_size через
+// SUBVIDEO_SERVER_PAGE_SIZE
+const envPrefix = "SUBVIDEO"
+
+func getConfig(configPath string) (err error) {
+	conf, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	currentConfig.Store(conf)
+	return nil
+}
+
+// loadConfig читает YAML, накладывает переменные окружения, заполняет
+// значения по умолчанию и проверяет результат
+func loadConfig(configPath string) (conf *configYML, err error) {
+	conf = &configYML{}
+	dat, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(dat, conf)
+	if err != nil {
+		return nil, err
+	}
+	err = applyEnv(reflect.ValueOf(conf).Elem(), envPrefix)
+	if err != nil {
+		return nil, err
+	}
+	conf.setDefaults()
+	err = conf.validate()
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *configYML) setDefaults() {
+	if c.Server.Listen == "" && c.Server.Socket == "" {
+		c.Server.Listen = ":8181"
+	}
+	if c.Server.PageSize == 0 {
+		c.Server.PageSize = 42
+	}
+	if c.Server.Public == "" {
+		c.Server.Public = "public"
+	}
+	if c.Server.Templates == "" {
+		c.Server.Templates = "templates"
+	}
+	if c.Server.TimeZones == "" {
+		c.Server.TimeZones = "timezones.json"
+	}
+	if c.DataBase.Driver == "" {
+		c.DataBase.Driver = "postgres"
+	}
+	if c.Sync.ChannelLimit == 0 {
+		c.Sync.ChannelLimit = 50
+	}
+	if c.Sync.Workers == 0 {
+		c.Sync.Workers = 4
+	}
+	if c.Upstream.Cache == "" {
+		c.Upstream.Cache = "memory"
+	}
+	if c.Upstream.CacheEntries == 0 {
+		c.Upstream.CacheEntries = 2000
+	}
+	if c.Backfill.Days == 0 {
+		c.Backfill.Days = 30
+	}
+	if c.Backfill.Videos == 0 {
+		c.Backfill.Videos = 50
+	}
+	if c.Backfill.YouTubeQuota == 0 {
+		c.Backfill.YouTubeQuota = 2000
+	}
+	// base_path хранится как "/subvideo": с ведущим и без завершающего слеша
+	c.Server.BasePath = strings.TrimRight(c.Server.BasePath, "/")
+	if c.Server.BasePath != "" && !strings.HasPrefix(c.Server.BasePath, "/") {
+		c.Server.BasePath = "/" + c.Server.BasePath
+	}
+	if c.HeadURL != "" && !strings.HasSuffix(c.HeadURL, "/") {
+		c.HeadURL += "/"
+	}
+}
+
+// databaseSource строка подключения для models.Init: путь к файлу SQLite
+// или адрес Postgres
+func (c *configYML) databaseSource() string {
+	if c.DataBase.Driver == "sqlite" {
+		return c.DataBase.Path
+	}
+	source := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.DataBase.UserName, c.DataBase.Password),
+		Host:     net.JoinHostPort(c.DataBase.Host, c.DataBase.Port),
+		Path:     "/" + c.DataBase.DBname,
+		RawQuery: "sslmode=disable",
+	}
+	return source.String()
+}
+
+// validate собирает все ошибки конфигурации сразу, чтобы их можно было
+// исправить за один раз
+func (c *configYML) validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Server.Listen != "" && c.Server.Socket != "" {
+		fail("server.listen and server.socket are mutually exclusive")
+	}
+	if c.Server.PageSize < 1 || c.Server.PageSize > 500 {
+		fail("server.page_size must be between 1 and 500, got %d", c.Server.PageSize)
+	}
+	if c.Sync.ChannelLimit < 1 || c.Sync.ChannelLimit > 500 {
+		fail("sync.channel_limit must be between 1 and 500, got %d", c.Sync.ChannelLimit)
+	}
+	if c.Sync.Workers < 1 || c.Sync.Workers > 32 {
+		fail("sync.workers must be between 1 and 32, got %d", c.Sync.Workers)
+	}
+	if c.Upstream.Timeout < 0 || c.Upstream.Retries < 0 || c.Upstream.Rate < 0 ||
+		c.Upstream.Failures < 0 || c.Upstream.Cooldown < 0 {
+		fail("upstream: timeout, retries, rate, failures and cooldown must not be negative")
+	}
+	switch c.Upstream.Cache {
+	case "memory", "db", "off":
+	case "disk":
+		if c.Upstream.CacheDir == "" {
+			fail("upstream.cache_dir is required for upstream.cache: disk")
+		}
+	default:
+		fail("upstream.cache must be memory, disk, db or off, got %q", c.Upstream.Cache)
+	}
+	if c.Upstream.CacheEntries < 1 {
+		fail("upstream.cache_entries must be positive, got %d", c.Upstream.CacheEntries)
+	}
+	if c.Backfill.Days < 1 || c.Backfill.Days > 3650 {
+		fail("backfill.days must be between 1 and 3650, got %d", c.Backfill.Days)
+	}
+	if c.Backfill.Videos < 1 || c.Backfill.Videos > 1000 {
+		fail("backfill.videos must be between 1 and 1000, got %d", c.Backfill.Videos)
+	}
+	if c.Backfill.YouTubeQuota < 1 {
+		fail("backfill.youtube_quota must be positive, got %d", c.Backfill.YouTubeQuota)
+	}
+	if info, err := os.Stat(c.Server.Public); err != nil || !info.IsDir() {
+		fail("server.public: directory %q not found", c.Server.Public)
+	}
+	if info, err := os.Stat(c.Server.Templates); err != nil || !info.IsDir() {
+		fail("server.templates: directory %q not found", c.Server.Templates)
+	}
+	if _, err := os.Stat(c.Server.TimeZones); err != nil {
+		fail("server.timezones: %v", err)
+	}
+
+	if c.Secret == "" {
+		fail("secret is required")
+	}
+	if c.HeadURL == "" {
+		fail("headurl is required")
+	} else if head, err := url.Parse(c.HeadURL); err != nil || head.Scheme == "" || head.Host == "" {
+		fail("headurl must be an absolute URL like https://example.com/, got %q", c.HeadURL)
+	} else if head.Path != c.Server.BasePath+"/" {
+		fail("headurl path %q must match server.base_path %q", head.Path, c.Server.BasePath+"/")
+	}
+
+	switch c.DataBase.Driver {
+	case "postgres":
+		if c.DataBase.Host == "" || c.DataBase.DBname == "" || c.DataBase.UserName == "" {
+			fail("database.host, database.dbname and database.username are required")
+		}
+		if _, err := strconv.Atoi(c.DataBase.Port); err != nil {
+			fail("database.port must be a number, got %q", c.DataBase.Port)
+		}
+	case "sqlite":
+		if c.DataBase.Path == "" {
+			fail("database.path is required with database.driver sqlite")
+		}
+	default:
+		fail("database.driver must be postgres or sqlite, got %q", c.DataBase.Driver)
+	}
+
+	for _, upstream := range []struct{ key, value string }{
+		{"twitch.api_url", c.Twitch.APIURL},
+		{"youtube.api_url", c.YouTube.APIURL},
+		{"youtube.oauth_url", c.YouTube.OAuthURL},
+		{"telegram.api_url", c.Telegram.APIURL},
+	} {
+		if u, err := url.Parse(upstream.value); upstream.value != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			fail("%s must be an absolute URL, got %q", upstream.key, upstream.value)
+		}
+	}
+
+	twitch := c.Twitch.ClientID != ""
+	youtube := c.YouTube.ClientID != ""
+	if !twitch && !youtube {
+		fail("twitch.clientid or youtube.clientid is required, nobody will be able to log in")
+	}
+	if twitch && (c.Twitch.ClientSecret == "" || c.Twitch.RedirectURI == "") {
+		fail("twitch.clientsecret and twitch.redirecturi are required with twitch.clientid")
+	}
+	if youtube && (c.YouTube.ClientSecret == "" || c.YouTube.RedirectURI == "") {
+		fail("youtube.clientsecret and youtube.redirecturi are required with youtube.clientid")
+	}
+
+	if c.DeleteVideoInterval < 0 || c.DeleteUserInterval < 0 {
+		fail("delete_video_interval and delete_user_interval must not be negative")
+	}
+	switch c.Log.Format {
+	case "", "text", "logfmt", "json":
+	default:
+		fail("log.format must be text or json, got %q", c.Log.Format)
+	}
+	var level slog.Level
+	if c.Log.Level != "" && level.UnmarshalText([]byte(c.Log.Level)) != nil {
+		fail("log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if c.SMTP.Host != "" {
+		if c.SMTP.From == "" {
+			fail("smtp.from is required with smtp.host")
+		}
+		if _, err := strconv.Atoi(c.SMTP.Port); err != nil {
+			fail("smtp.port must be a number, got %q", c.SMTP.Port)
+		}
+	}
+	if (c.WebPush.PublicKey == "") != (c.WebPush.PrivateKey == "") {
+		fail("webpush.public_key and webpush.private_key must be set together, generate them with -vapid")
+	}
+	if c.Telegram.Webhook && c.Telegram.Secret == "" {
+		fail("telegram.secret is required with telegram.webhook")
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyEnv переопределяет поля v переменными prefix_КЛЮЧ. Для любого ключа
+// вместо значения можно указать prefix_КЛЮЧ_FILE с путем до файла, например
+// секрета Docker или Kubernetes
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + "_" + strings.ToUpper(yamlKey(field))
+		if field.Type.Kind() == reflect.Struct {
+			err := applyEnv(v.Field(i), name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = setField(v.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func yamlKey(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func lookupEnv(name string) (value string, ok bool, err error) {
+	if value, ok = os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(dat), "\r\n"), true, nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// configCheck проверяет конфигурацию и печатает ее со скрытыми секретами,
+// код выхода 1 - конфигурация с ошибками
+func configCheck(configPath string) int {
+	err := getConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid config:\n%v\n", configPath, err)
+		return exitConfig
+	}
+	text, err := redactedConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Printf("%s: config is valid\n\n%s", configPath, text)
+	return exitOK
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
+)
+
+// digestLimit больше видео в одно письмо не кладем
+const digestLimit = 200
+
+var digestHours = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}
+
+// digestWeekdays по порядку time.Weekday
+var digestWeekdays = []string{"Воскресенье", "Понедельник", "Вторник", "Среда", "Четверг", "Пятница", "Суббота"}
+
+type DigestForm struct {
+	Email     string `form:"email"`
+	Frequency string `form:"frequency"`
+	Hour      int    `form:"hour"`
+	Weekday   int    `form:"weekday"`
+}
+
+type digestData struct {
+	Subject  string
+	User     models.User
+	Channels []models.DigestChannel
+	Count    int
+	HeadURL  string
+	// More сколько новых видео не поместилось в письмо
+	More int
+}
+
+// renderDigest собирает письмо с видео, добавленными после прошлого дайджеста
+func renderDigest(user models.User, digest models.Digest, now time.Time) (data digestData, text, html string, err error) {
+	since := digest.Since(now)
+	channels, count, err := models.SelectDigestVideo(user, since, digestLimit)
+	if err != nil {
+		return data, text, html, err
+	}
+	shown := 0
+	for _, channel := range channels {
+		shown += len(channel.Videos)
+	}
+	loc := userLocation(user)
+	data = digestData{
+		Subject:  fmt.Sprintf("Новые видео с %s: %d", since.In(loc).Format("02.01 15:04"), count),
+		User:     user,
+		Channels: channels,
+		Count:    count,
+		More:     count - shown,
+		HeadURL:  config().HeadURL,
+	}
+
+	tmpl, err := template.New("digest.html").
+		Funcs(template.FuncMap{"videoLen": videoLen, "getTime": getTime}).
+		ParseFiles(filepath.Join(config().Server.Templates, "mail", "digest.html"))
+	if err != nil {
+		return data, text, html, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return data, text, html, err
+	}
+	return data, digestText(data), buf.String(), nil
+}
+
+func digestText(data digestData) string {
+	var text strings.Builder
+	text.WriteString(data.Subject + "\r\n")
+	for _, channel := range data.Channels {
+		text.WriteString("\r\n" + channel.Channel + "\r\n")
+		for _, video := range channel.Videos {
+			fmt.Fprintf(&text, "  %s (%s)\r\n  %s\r\n", video.Title, strings.TrimSuffix(videoLen(video.Length), ", "), video.URL)
+		}
+	}
+	if data.More > 0 {
+		fmt.Fprintf(&text, "\r\nИ еще %d в ленте: %slast\r\n", data.More, data.HeadURL)
+	}
+	text.WriteString("\r\nНастройки рассылки: " + data.HeadURL + "user\r\n")
+	return text.String()
+}
+
+// runDigest раз в несколько минут проверяет, кому пора отправить дайджест
+func runDigest() {
+	if config().SMTP.Host == "" {
+		slog.Warn("digest is disabled, smtp is not configured")
+	}
+	for {
+		status.beat("digest", "waiting")
+		if !app.sleep(5 * time.Minute) {
+			return
+		}
+		// SMTP можно включить и выключить перезагрузкой конфигурации
+		if config().SMTP.Host == "" {
+			continue
+		}
+		status.beat("digest", "sending")
+
+		digests, err := models.SelectActiveDigests()
+		if err != nil {
+			slog.Error("digests failed", "err", err)
+			continue
+		}
+		for _, digest := range digests {
+			user, err := models.Users.SelectUserForID(digest.UserID)
+			if err != nil || user.Disabled {
+				continue
+			}
+			now := time.Now()
+			if !digest.Due(now, userLocation(user)) {
+				continue
+			}
+			// письмо и отметка об отправке не должны разойтись при остановке
+			if !app.begin() {
+				return
+			}
+			err = sendDigest(user, digest, now)
+			app.end()
+			if err != nil {
+				slog.Error("digest send failed", "user", user.UserName, "err", err)
+			}
+		}
+	}
+}
+
+// sendDigest отправляет письмо, пустой дайджест только сдвигает отметку
+func sendDigest(user models.User, digest models.Digest, now time.Time) error {
+	data, text, html, err := renderDigest(user, digest, now)
+	if err != nil {
+		return err
+	}
+	if data.Count != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = smtpSender().SendMail(ctx, digest.Email, data.Subject, text, html)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return digest.Sent(now)
+}
+
+func digestHandler(ctx *macaron.Context, digestForm DigestForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	digest := models.Digest{
+		UserID:    user.Id,
+		Email:     digestForm.Email,
+		Frequency: digestForm.Frequency,
+		Hour:      digestForm.Hour,
+		Weekday:   digestForm.Weekday,
+	}
+	err := digest.Save()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "digest failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/user?digest_error=" + url.QueryEscape(err.Error()))
+		return
+	}
+	ctx.Redirect(config().Server.BasePath + "/user")
+}
+
+func digestPreviewHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	digest, err := models.SelectDigest(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "digest failed", "err", err)
+	}
+	_, text, html, err := renderDigest(user, digest, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "digest preview failed", "err", err)
+		ctx.Error(500, "Internal Server Error")
+		return
+	}
+	if ctx.Query("format") == "text" {
+		ctx.Resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		ctx.Resp.Write([]byte(text))
+		return
+	}
+	ctx.Resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ctx.Resp.Write([]byte(html))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/video"
+	"gopkg.in/macaron.v1"
+)
+
+type errorPage struct {
+	Status  int
+	Title   string
+	Message string
+	Login   bool
+}
+
+// errorStatus HTTP код для ошибки из models и video
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, video.ErrAuthExpired):
+		return http.StatusUnauthorized
+	case errors.Is(err, video.ErrUpstreamUnavailable):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// renderError пишет ошибку в журнал и показывает страницу с подходящим кодом
+func renderError(ctx *macaron.Context, user models.User, err error) {
+	status := errorStatus(err)
+	page := errorPage{Status: status}
+	switch status {
+	case http.StatusNotFound:
+		page.Title = "Не найдено"
+		page.Message = "Такой страницы или видео нет, возможно оно уже удалено."
+	case http.StatusUnauthorized:
+		page.Title = "Нужно войти заново"
+		page.Message = "Twitch или YouTube больше не принимает ваш вход, авторизуйтесь еще раз."
+		page.Login = true
+	case http.StatusBadGateway:
+		page.Title = "Площадка недоступна"
+		page.Message = "Twitch или YouTube сейчас не отвечает, попробуйте обновить страницу позже."
+	default:
+		page.Title = "Ошибка"
+		page.Message = "Что-то пошло не так, мы уже смотрим журнал."
+	}
+
+	level := slog.LevelWarn
+	if status == http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(ctx.Req.Context(), level, "request failed", "status", status, "err", err)
+
+	ctx.Data["HeadInfo"] = headInfo{Title: page.Title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Error"] = page
+	ctx.HTML(status, "error")
+}
+
+func notFoundHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	renderError(ctx, user, models.ErrNotFound)
+}
@@ -0,0 +1,420 @@
+// Package fakeupstream поддельные Twitch и YouTube для разработки без сети.
+// Отвечает на те же запросы, что делает пакет video: OAuth, подписки, видео
+// и стримы, данные берутся из fixtures.go
+package fakeupstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Адреса, которые нужно указать в настройках subvideo, относительно
+// адреса сервера
+const (
+	TwitchPath       = "/kraken/"
+	YouTubePath      = "/"
+	YouTubeOAuthPath = "/o/oauth2/"
+)
+
+// Handler все ручки поддельных площадок
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/kraken/", twRoot)
+	mux.HandleFunc("/kraken/oauth2/authorize", authorize("fake-twitch-code"))
+	mux.HandleFunc("/kraken/oauth2/token", twToken)
+	mux.HandleFunc("/kraken/user", twAuth(twUser))
+	mux.HandleFunc("/kraken/streams/followed", twAuth(twStreams))
+	mux.HandleFunc("/kraken/videos/followed", twAuth(twVideosFollowed))
+	mux.HandleFunc("/kraken/channels/", twAuth(twChannelInfo))
+
+	mux.HandleFunc("/o/oauth2/auth", authorize("fake-youtube-code"))
+	mux.HandleFunc("/o/oauth2/token", ytToken)
+	mux.HandleFunc("/plus/v1/people/me", ytAuth(ytPerson))
+	mux.HandleFunc("/youtube/v3/channels", ytAuth(ytChannelsMine))
+	mux.HandleFunc("/youtube/v3/subscriptions", ytAuth(ytSubscriptions))
+	mux.HandleFunc("/youtube/v3/search", ytAuth(ytSearch))
+	mux.HandleFunc("/youtube/v3/playlistItems", ytAuth(ytPlaylistItems))
+	mux.HandleFunc("/youtube/v3/videos", ytAuth(ytVideosList))
+
+	mux.HandleFunc("/thumb/", thumb)
+
+	return logRequests(etags(mux))
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("fake upstream request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// etags как у настоящих площадок: ETag на каждый удачный GET и 304, если
+// клиент прислал тот же в If-None-Match
+func etags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		buf := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+		for name, values := range buf.header {
+			w.Header()[name] = values
+		}
+		if buf.status == http.StatusOK {
+			hash := fnv.New64a()
+			hash.Write(buf.body.Bytes())
+			etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	})
+}
+
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (buf *bufferedWriter) Header() http.Header { return buf.header }
+
+func (buf *bufferedWriter) WriteHeader(status int) { buf.status = status }
+
+func (buf *bufferedWriter) Write(data []byte) (int, error) { return buf.body.Write(data) }
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// baseURL адрес сервера, как его видит клиент, для ссылок на превью
+func baseURL(r *http.Request) string {
+	return "http://" + r.Host
+}
+
+func thumbURL(r *http.Request, id string) string {
+	return baseURL(r) + "/thumb/" + id + ".svg"
+}
+
+// authorize страница входа площадки: сразу возвращает на redirect_uri с кодом
+func authorize(code string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirect, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+		if err != nil || redirect.Scheme == "" {
+			http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+			return
+		}
+		q := redirect.Query()
+		q.Set("code", code)
+		if state := r.URL.Query().Get("state"); state != "" {
+			q.Set("state", state)
+		}
+		redirect.RawQuery = q.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	}
+}
+
+// tokens счетчик выданных токенов Google: при обновлении токен должен
+// меняться, иначе subvideo не сохранит новый срок действия
+var tokens int64
+
+func ytToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  "fake-youtube-token-" + strconv.FormatInt(atomic.AddInt64(&tokens, 1), 10),
+		"refresh_token": "fake-youtube-refresh",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func twToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "fake-twitch-token",
+		"scope":        []string{"user_read"},
+	})
+}
+
+// twAuth пропускает только запросы с токеном, как Kraken
+func twAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "OAuth ") {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "Unauthorized", "status": 401, "message": "authentication failed",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ytAuth пропускает только запросы с токеном, как API Google
+func ytAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": map[string]interface{}{"code": 401, "message": "Login Required"},
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// twRoot корень Kraken для проверки доступности, остальное - 404
+func twRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/kraken/" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "Not Found", "status": 404, "message": "no such endpoint",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"_links": map[string]string{}})
+}
+
+func twUser(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_id":          "1000",
+		"name":         viewerName,
+		"display_name": viewerDisplayName,
+		"logo":         thumbURL(r, viewerName),
+	})
+}
+
+func twChannelJSON(r *http.Request, channel twChannel) map[string]interface{} {
+	return map[string]interface{}{
+		"_id":          channel.ID,
+		"name":         channel.Name,
+		"display_name": channel.DisplayName,
+		"status":       channel.Status,
+		"game":         channel.Game,
+		"language":     channel.Language,
+		"url":          "https://www.twitch.tv/" + channel.Name,
+		"logo":         thumbURL(r, channel.Name),
+	}
+}
+
+func twStreams(w http.ResponseWriter, r *http.Request) {
+	streams := []interface{}{}
+	for _, channel := range twChannels {
+		if !channel.Live {
+			continue
+		}
+		streams = append(streams, map[string]interface{}{
+			"_id":        channel.ID * 10,
+			"game":       channel.Game,
+			"created_at": fixtureTime(2 * time.Hour),
+			"preview":    map[string]string{"large": thumbURL(r, "live-"+channel.Name)},
+			"channel":    twChannelJSON(r, channel),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"_total": len(streams), "streams": streams})
+}
+
+func twVideosFollowed(w http.ResponseWriter, r *http.Request) {
+	all := []interface{}{}
+	for _, video := range twVideos {
+		channel := twChannelFor(video.Channel)
+		all = append(all, map[string]interface{}{
+			"_id":         video.ID,
+			"title":       video.Title,
+			"description": video.Description,
+			"game":        video.Game,
+			"length":      video.Length,
+			"language":    channel.Language,
+			"recorded_at": fixtureTime(video.Age),
+			"url":         "https://www.twitch.tv/videos/" + strings.TrimPrefix(video.ID, "v"),
+			"preview":     map[string]string{"large": thumbURL(r, video.ID)},
+			"channel": map[string]interface{}{
+				"_id":          channel.ID,
+				"name":         channel.Name,
+				"display_name": channel.DisplayName,
+			},
+		})
+	}
+	offset, limit := page(r, "offset", "limit", 10)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"videos": slice(all, offset, limit)})
+}
+
+func twChannelInfo(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/kraken/channels/"))
+	channel := twChannelFor(id)
+	if channel.ID == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "Not Found", "status": 404, "message": "Channel does not exist",
+		})
+		return
+	}
+	data := twChannelJSON(r, channel)
+	// в ответе channels Kraken отдает _id строкой
+	data["_id"] = strconv.Itoa(channel.ID)
+	writeJSON(w, http.StatusOK, data)
+}
+
+func ytPerson(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":          "100000000000000000000",
+		"displayName": viewerDisplayName,
+		"nickname":    viewerDisplayName,
+		"image":       map[string]string{"url": thumbURL(r, viewerName)},
+	})
+}
+
+func ytChannelsMine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":  "youtube#channelListResponse",
+		"items": []interface{}{map[string]string{"kind": "youtube#channel", "id": viewerYTChannel}},
+	})
+}
+
+func ytSubscriptions(w http.ResponseWriter, r *http.Request) {
+	items := []interface{}{}
+	for _, channel := range ytChannels {
+		items = append(items, map[string]interface{}{
+			"kind": "youtube#subscription",
+			"snippet": map[string]interface{}{
+				"title":      channel.Title,
+				"resourceId": map[string]string{"kind": "youtube#channel", "channelId": channel.ID},
+			},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "youtube#subscriptionListResponse", "items": items})
+}
+
+// ytSearch поиск видео канала от новых к старым, понимает publishedAfter
+// и страницы
+func ytSearch(w http.ResponseWriter, r *http.Request) {
+	channelID := r.URL.Query().Get("channelId")
+	after, _ := time.Parse(time.RFC3339, r.URL.Query().Get("publishedAfter"))
+	all := []interface{}{}
+	for _, video := range ytVideos {
+		published := fixtureTime(video.Age)
+		if video.Channel != channelID || published < after.UTC().Format(time.RFC3339) {
+			continue
+		}
+		all = append(all, map[string]interface{}{
+			"kind":    "youtube#searchResult",
+			"id":      map[string]string{"kind": "youtube#video", "videoId": video.ID},
+			"snippet": map[string]string{"channelId": channelID, "title": video.Title, "publishedAt": published},
+		})
+	}
+	offset, limit := page(r, "pageToken", "maxResults", 5)
+	response := map[string]interface{}{"kind": "youtube#searchListResponse", "items": slice(all, offset, limit)}
+	if offset+limit < len(all) {
+		response["nextPageToken"] = strconv.Itoa(offset + limit)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ytPlaylistItems плейлист загрузок канала: UUxxx для канала UCxxx
+func ytPlaylistItems(w http.ResponseWriter, r *http.Request) {
+	channelID := "UC" + strings.TrimPrefix(r.URL.Query().Get("playlistId"), "UU")
+	all := []interface{}{}
+	for _, video := range ytVideos {
+		if video.Channel != channelID {
+			continue
+		}
+		all = append(all, map[string]interface{}{
+			"kind":           "youtube#playlistItem",
+			"contentDetails": map[string]string{"videoId": video.ID, "videoPublishedAt": fixtureTime(video.Age)},
+		})
+	}
+	offset, limit := page(r, "pageToken", "maxResults", 5)
+	response := map[string]interface{}{"kind": "youtube#playlistItemListResponse", "items": slice(all, offset, limit)}
+	if offset+limit < len(all) {
+		response["nextPageToken"] = strconv.Itoa(offset + limit)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// page смещение и размер страницы из параметров запроса
+func page(r *http.Request, offsetKey, limitKey string, defaultLimit int) (offset, limit int) {
+	offset, _ = strconv.Atoi(r.URL.Query().Get(offsetKey))
+	limit, err := strconv.Atoi(r.URL.Query().Get(limitKey))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+	return offset, limit
+}
+
+func slice(items []interface{}, offset, limit int) []interface{} {
+	if offset >= len(items) {
+		return []interface{}{}
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
+
+func ytVideosList(w http.ResponseWriter, r *http.Request) {
+	ids := map[string]bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+		ids[id] = true
+	}
+	items := []interface{}{}
+	for _, video := range ytVideos {
+		if !ids[video.ID] {
+			continue
+		}
+		channel := ytChannelFor(video.Channel)
+		item := map[string]interface{}{
+			"kind": "youtube#video",
+			"id":   video.ID,
+			"snippet": map[string]interface{}{
+				"title":                video.Title,
+				"description":          video.Description,
+				"channelId":            channel.ID,
+				"channelTitle":         channel.Title,
+				"publishedAt":          fixtureTime(video.Age),
+				"liveBroadcastContent": video.Broadcast,
+				"defaultAudioLanguage": channel.Language,
+				"thumbnails":           map[string]interface{}{"high": map[string]string{"url": thumbURL(r, video.ID)}},
+			},
+			"contentDetails": map[string]string{"duration": video.Duration},
+		}
+		switch video.Broadcast {
+		case "live":
+			item["liveStreamingDetails"] = map[string]string{"actualStartTime": fixtureTime(video.Age)}
+		case "upcoming":
+			item["liveStreamingDetails"] = map[string]string{"scheduledStartTime": fixtureTime(-video.StartsIn)}
+		}
+		items = append(items, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "youtube#videoListResponse", "items": items})
+}
+
+// thumb превью: цветной прямоугольник с подписью, цвет зависит от имени
+func thumb(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/thumb/"), ".svg")
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="640" height="360" viewBox="0 0 640 360">`+
+		`<rect width="640" height="360" fill="hsl(%d, 45%%, 45%%)"/>`+
+		`<text x="320" y="190" font-family="sans-serif" font-size="36" fill="#fff" text-anchor="middle">%s</text></svg>`,
+		h.Sum32()%360, html.EscapeString(name))
+}
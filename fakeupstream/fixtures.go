@@ -0,0 +1,121 @@
+package fakeupstream
+
+import (
+	"time"
+)
+
+// Учетные записи, под которыми входит любой пользователь. Имя одно и то же,
+// чтобы Twitch и YouTube привязались к одному пользователю subvideo
+const (
+	viewerName        = "fakeviewer"
+	viewerDisplayName = "FakeViewer"
+	viewerYTChannel   = "UCfakeviewer000000000000"
+)
+
+type twChannel struct {
+	ID          int
+	Name        string
+	DisplayName string
+	Game        string
+	Language    string
+	Status      string
+	Live        bool
+}
+
+type twVideo struct {
+	ID          string
+	Channel     int
+	Title       string
+	Description string
+	Game        string
+	Length      int
+	Age         time.Duration
+}
+
+var twChannels = []twChannel{
+	{ID: 1001, Name: "fake_speedrunner", DisplayName: "Fake_Speedrunner", Game: "Celeste",
+		Language: "en", Status: "Any% world record attempts", Live: true},
+	{ID: 1002, Name: "fake_strimer", DisplayName: "Фейковый_Стример", Game: "Ведьмак 3: Дикая Охота",
+		Language: "ru", Status: "Проходим дополнение Кровь и вино"},
+	{ID: 1003, Name: "fake_chess", DisplayName: "Fake_Chess", Game: "Chess",
+		Language: "en", Status: "Blitz with viewers"},
+}
+
+// twVideos от новых к старым, как их отдает videos/followed
+var twVideos = []twVideo{
+	{ID: "v9000001", Channel: 1001, Title: "Celeste any% 27:14", Game: "Celeste",
+		Description: "Full run with commentary and route explanation", Length: 1700, Age: 3 * time.Hour},
+	{ID: "v9000004", Channel: 1002, Title: "Ведьмак 3 - Кровь и вино, часть 1", Game: "Ведьмак 3: Дикая Охота",
+		Description: "Начинаем дополнение, Туссент и первые контракты", Length: 10800, Age: 20 * time.Hour},
+	{ID: "v9000002", Channel: 1001, Title: "Practice: chapter 7", Game: "Celeste",
+		Description: "Grinding the summit", Length: 7260, Age: 27 * time.Hour},
+	{ID: "v9000003", Channel: 1001, Title: "Short clip", Game: "Celeste",
+		Description: "Too short to be synced", Length: 120, Age: 30 * time.Hour},
+	{ID: "v9000005", Channel: 1002, Title: "Ведьмак 3 - Кровь и вино, часть 2", Game: "Ведьмак 3: Дикая Охота",
+		Description: "Бестия из Боклера и винодельня", Length: 9600, Age: 44 * time.Hour},
+	{ID: "v9000006", Channel: 1003, Title: "Blitz arena", Game: "Chess",
+		Description: "Sicilian defence all day", Length: 5400, Age: 50 * time.Hour},
+}
+
+type ytChannel struct {
+	ID       string
+	Title    string
+	Language string
+}
+
+type ytVideo struct {
+	ID          string
+	Channel     string
+	Title       string
+	Description string
+	Duration    string
+	Age         time.Duration
+	// Broadcast как liveBroadcastContent: none, live или upcoming
+	Broadcast string
+	// StartsIn через сколько начнется запланированный стрим
+	StartsIn time.Duration
+}
+
+var ytChannels = []ytChannel{
+	{ID: "UCfakecooking00000000000", Title: "Fake Cooking", Language: "en"},
+	{ID: "UCfakenews00000000000000", Title: "Фейковые новости", Language: "ru"},
+}
+
+// ytVideos от новых к старым, как их отдает search
+var ytVideos = []ytVideo{
+	{ID: "ytfake00003", Channel: "UCfakecooking00000000000", Title: "Live: Sunday baking stream",
+		Description: "Questions and answers while the bread proofs", Duration: "PT0S", Age: time.Hour, Broadcast: "live"},
+	{ID: "ytfake00001", Channel: "UCfakecooking00000000000", Title: "Pasta carbonara in 10 minutes",
+		Description: "Guanciale, eggs, pecorino and no cream", Duration: "PT10M31S", Age: 5 * time.Hour, Broadcast: "none"},
+	{ID: "ytfake00004", Channel: "UCfakenews00000000000000", Title: "Главное за неделю",
+		Description: "Обзор новостей технологий и игр", Duration: "PT15M", Age: 8 * time.Hour, Broadcast: "none"},
+	{ID: "ytfake00005", Channel: "UCfakenews00000000000000", Title: "Прямой эфир: итоги года",
+		Description: "Запланированная трансляция с ответами на вопросы", Duration: "PT0S", Age: 30 * time.Hour,
+		Broadcast: "upcoming", StartsIn: 18 * time.Hour},
+	{ID: "ytfake00002", Channel: "UCfakecooking00000000000", Title: "Sourdough for beginners",
+		Description: "Starter, folding and baking schedule", Duration: "PT24M5S", Age: 52 * time.Hour, Broadcast: "none"},
+}
+
+// fixtureTime время видео: отсчитывается от начала текущего часа, чтобы
+// ответы не менялись между запросами и видео не устаревали
+func fixtureTime(age time.Duration) string {
+	return time.Now().UTC().Truncate(time.Hour).Add(-age).Format(time.RFC3339)
+}
+
+func twChannelFor(id int) twChannel {
+	for _, channel := range twChannels {
+		if channel.ID == id {
+			return channel
+		}
+	}
+	return twChannel{}
+}
+
+func ytChannelFor(id string) ytChannel {
+	for _, channel := range ytChannels {
+		if channel.ID == id {
+			return channel
+		}
+	}
+	return ytChannel{}
+}
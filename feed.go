@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
+)
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Links   []atomLink `xml:"link"`
+	Updated string     `xml:"updated"`
+	Author  string     `xml:"author>name"`
+	Summary atomText   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedToken отдает токен пользователя для лент и API, создавая его при необходимости
+func feedToken(user models.User) string {
+	if user.FeedToken != "" {
+		return user.FeedToken
+	}
+	return newFeedToken(user)
+}
+
+// newFeedToken создает и сохраняет новый токен, старые ссылки перестают работать
+func newFeedToken(user models.User) string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		slog.Error("feed token failed", "err", err)
+		return ""
+	}
+	token := hex.EncodeToString(b)
+	err = user.SetFeedToken(token)
+	if err != nil {
+		slog.Error("feed token failed", "err", err)
+		return ""
+	}
+	return token
+}
+
+// feedTokenHandler меняет токен, если ссылка на ленту попала не в те руки
+func feedTokenHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	newFeedToken(user)
+	ctx.Redirect(config().Server.BasePath + "/user")
+}
+
+// requestUser ищет пользователя по cookie, а для лент и API - по токену
+func requestUser(ctx *macaron.Context) models.User {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName != "" {
+		return user
+	}
+	user, err := models.Users.SelectUserForFeedToken(ctx.Query("token"))
+	if err != nil {
+		return models.User{}
+	}
+	return user
+}
+
+func renderFeed(ctx *macaron.Context, title, link string, subVideos []models.Subvideo) {
+	feed := atomFeed{
+		Title:   title + " | SubVideo",
+		ID:      config().HeadURL + link[1:],
+		Links:   []atomLink{{Href: config().HeadURL + link[1:]}},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, video := range subVideos {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title: video.Title,
+			ID:    video.URL,
+			Links: []atomLink{
+				{Href: video.URL, Rel: "alternate"},
+				{Href: video.ThumbURL, Rel: "enclosure", Type: "image/jpeg"},
+			},
+			Updated: video.Date.UTC().Format(time.RFC3339),
+			Author:  video.Channel,
+			Summary: atomText{Type: "text", Body: video.Description},
+		})
+	}
+	if len(subVideos) > 0 {
+		feed.Updated = subVideos[0].Date.UTC().Format(time.RFC3339)
+	}
+
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		ctx.Error(500, err.Error())
+		return
+	}
+	ctx.Resp.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	ctx.RawData(200, append([]byte(xml.Header), body...))
+}
+
+func feedHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.Error(401, "Unauthorized")
+		return
+	}
+
+	subVideos, _, err := clientVideo().SortVideo(user, config().Server.PageSize, "", 1)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "feed failed", "err", err)
+		ctx.Error(500, "Internal Server Error")
+		return
+	}
+	renderFeed(ctx, "Что новенького?", "/", subVideos)
+}
+
+func groupFeedHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.Error(401, "Unauthorized")
+		return
+	}
+
+	group, err := models.SelectGroup(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		ctx.Error(404, "Not Found")
+		return
+	}
+	subVideos, _, err := clientVideo().GroupVideo(user, config().Server.PageSize, group.Id, 1)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "feed failed", "err", err)
+		ctx.Error(500, "Internal Server Error")
+		return
+	}
+	renderFeed(ctx, "Группа "+group.Name, fmt.Sprintf("/group/%d", group.Id), subVideos)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+
+	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
+)
+
+type GroupForm struct {
+	Name string `form:"name" binding:"Required"`
+}
+
+type groupInfo struct {
+	Group    models.Group
+	Channels []models.GroupChannel
+}
+
+func groupsHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	groups, err := models.SelectGroups(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "groups failed", "err", err)
+	}
+	var groupsInfo []groupInfo
+	for _, group := range groups {
+		channels, err := models.SelectGroupChannels(group.Id)
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "group channels failed", "err", err)
+		}
+		groupsInfo = append(groupsInfo, groupInfo{Group: group, Channels: channels})
+	}
+	channels, err := models.Videos.SelectChannels(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "channels failed", "err", err)
+	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: "Группы каналов", URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Groups"] = groupsInfo
+	ctx.Data["Channels"] = channels
+	ctx.Data["FeedToken"] = feedToken(user)
+	ctx.Data["GroupError"] = ctx.Query("group_error")
+	ctx.HTML(200, "groups")
+}
+
+func groupAddHandler(ctx *macaron.Context, groupForm GroupForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	group := models.Group{UserID: user.Id, Name: groupForm.Name}
+	err := group.Insert()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "group add failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/groups?group_error=" + url.QueryEscape(err.Error()))
+		return
+	}
+	ctx.Redirect(config().Server.BasePath + "/groups")
+}
+
+func groupDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	err := models.DeleteGroup(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "group delete failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/groups")
+}
+
+func groupChannelAddHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	group, err := models.SelectGroup(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "group failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/groups")
+		return
+	}
+	channels, err := models.Videos.SelectChannels(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "channels failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/groups")
+		return
+	}
+
+	channelID := ctx.Req.FormValue("channel_id")
+	for _, channel := range channels {
+		if channel.ChannelID != channelID {
+			continue
+		}
+		err = models.GroupChannel{
+			GroupID:   group.Id,
+			UserID:    user.Id,
+			ChannelID: channel.ChannelID,
+			Channel:   channel.Channel,
+			Platform:  channel.Platform,
+		}.Insert()
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "group channel add failed", "err", err)
+		}
+	}
+	ctx.Redirect(config().Server.BasePath + "/groups")
+}
+
+func groupChannelDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	err := models.DeleteGroupChannel(ctx.ParamsInt64(":id"), user.Id, ctx.Req.FormValue("channel_id"))
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "group channel delete failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/groups")
+}
+
+func groupHandler(ctx *macaron.Context) {
+	var page int
+
+	pageS := ctx.Req.FormValue("page")
+	page, err := strconv.Atoi(pageS)
+	if err != nil || page == 0 {
+		page = 1
+	}
+
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	group, err := models.SelectGroup(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+
+	subVideos, count, err := clientVideo().GroupVideo(user, config().Server.PageSize, group.Id, page)
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+	groupURL := fmt.Sprintf("/group/%d", group.Id)
+	pag := pagination(page, count, config().Server.PageSize, groupURL+"?")
+	if len(subVideos) == 0 && pag.Previous != 0 {
+		ctx.Redirect(config().Server.BasePath + groupURL + "?page=" + strconv.Itoa(pag.Previous))
+		return
+	}
+
+	title := fmt.Sprintf("Группа %s", group.Name)
+	if page != 1 {
+		title += fmt.Sprintf(", страница %d", page)
+	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["Group"] = group
+	ctx.Data["FeedToken"] = feedToken(user)
+	ctx.Data["SubVideos"] = subVideos
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Page"] = pag
+	ctx.HTML(200, "group")
+}
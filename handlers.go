@@ -1,46 +1,65 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/DeKoniX/subvideo/logging"
 	"github.com/DeKoniX/subvideo/models"
-
+	"github.com/DeKoniX/subvideo/video"
 	"gopkg.in/macaron.v1"
 )
 
 type ChangeUserForm struct {
-	TimeZone string `form:"timezone" binding:"Required"`
+	TimeZone   string `form:"timezone" binding:"Required"`
+	ShowHidden bool   `form:"show_hidden"`
+}
+
+type FilterForm struct {
+	Kind    string `form:"kind" binding:"Required"`
+	Value   string `form:"value"`
+	Comment string `form:"comment"`
 }
 
 func logoutHandler(ctx *macaron.Context) {
 	ctx.SetCookie("username", "", -1)
 	ctx.SetCookie("crypt", "", -1)
-	ctx.Redirect("/")
+	ctx.Redirect(config().Server.BasePath + "/")
 }
 
 func twOAuthHandler(ctx *macaron.Context) {
 	code := ctx.Query("code")
-	oauth, err := clientVideo.TWClient.Auth(code)
+	oauth, err := clientVideo().TWClient.Auth(ctx.Req.Context(), code)
 	if err != nil {
-		log.Println("ERR OAUTH Twitch:", err)
-		ctx.Redirect("/login")
+		slog.ErrorContext(logging.WithProvider(ctx.Req.Context(), "twitch"), "oauth failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
 	}
-	twChannelID, userName, avatarURL, err := clientVideo.TWClient.OAuthTest(oauth)
+	twChannelID, userName, avatarURL, err := clientVideo().TWClient.OAuthTest(ctx.Req.Context(), oauth)
 	if err != nil {
-		log.Println("ERR OAUTH Twitch:", err)
-		ctx.Redirect("/login")
+		slog.ErrorContext(logging.WithProvider(ctx.Req.Context(), "twitch"), "oauth failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
 	}
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 	if user.UserName == "" {
-		user, _ = models.SelectUserForUserName(userName)
+		user, err = models.Users.SelectUserForUserName(userName)
+		if err != nil && err != models.ErrNotFound {
+			slog.ErrorContext(ctx.Req.Context(), "user select failed", "username", userName, "err", err)
+			ctx.Redirect(config().Server.BasePath + "/login")
+			return
+		}
 		if user.UserName == "" {
 			user.UserName = userName
 		}
 	}
+	// история грузится один раз, при первой привязке площадки, а не при
+	// каждом входе
+	firstLink := user.TWOAuth == ""
 
 	user.TWChannelID = twChannelID
 	user.AvatarURL = avatarURL
@@ -54,31 +73,58 @@ func twOAuthHandler(ctx *macaron.Context) {
 
 	err = user.Insert()
 	if err != nil {
-		log.Println("ERR USER ADD:", err)
-		ctx.Redirect("/login")
+		slog.ErrorContext(ctx.Req.Context(), "user add failed", "username", userName, "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	name := user.UserName
+	user, err = models.Users.SelectUserForUserName(name)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "user select failed", "username", name, "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	if firstLink {
+		startBackfill(ctx.Req.Context(), user, "twitch")
 	}
 	go runUser(user)
 
 	ctx.SetCookie("username", user.UserName, time.Now().Add(time.Hour*24*30))
 	ctx.SetCookie("crypt", hash, time.Now().Add(time.Hour*24*30))
-	ctx.Redirect("/")
+	ctx.Redirect(config().Server.BasePath + "/")
 }
 
 func ytOAuthHandler(ctx *macaron.Context) {
 	code := ctx.Query("code")
-	token := clientVideo.YTClient.Auth(code)
-	ytChannelID, userName, avatarURL, err := clientVideo.YTClient.OAuthTest(token)
+	token, err := clientVideo().YTClient.Auth(ctx.Req.Context(), code)
+	if err != nil {
+		slog.ErrorContext(logging.WithProvider(ctx.Req.Context(), "youtube"), "oauth failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+	ytChannelID, userName, avatarURL, err := clientVideo().YTClient.OAuthTest(ctx.Req.Context(), token)
 	if err != nil {
-		log.Println("ERR OAUTH YouTube:", err)
-		ctx.Redirect("/login")
+		slog.ErrorContext(logging.WithProvider(ctx.Req.Context(), "youtube"), "oauth failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
 	}
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 	if user.UserName == "" {
-		user, _ = models.SelectUserForUserName(userName)
+		user, err = models.Users.SelectUserForUserName(userName)
+		if err != nil && err != models.ErrNotFound {
+			slog.ErrorContext(ctx.Req.Context(), "user select failed", "username", userName, "err", err)
+			ctx.Redirect(config().Server.BasePath + "/login")
+			return
+		}
 		if user.UserName == "" {
 			user.UserName = userName
 		}
 	}
+	// история грузится один раз, при первой привязке площадки, а не при
+	// каждом входе
+	firstLink := user.YTOAuth == ""
 	user.YTChannelID = ytChannelID
 	user.AvatarURL = avatarURL
 
@@ -93,38 +139,40 @@ func ytOAuthHandler(ctx *macaron.Context) {
 
 	err = user.Insert()
 	if err != nil {
-		log.Println("ERR USER ADD:", err)
-		ctx.Redirect("/login")
+		slog.ErrorContext(ctx.Req.Context(), "user add failed", "username", userName, "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
 	}
 
-	user, _ = models.SelectUserForUserName(user.UserName)
+	name := user.UserName
+	user, err = models.Users.SelectUserForUserName(name)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "user select failed", "username", name, "err", err)
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
 
+	if firstLink {
+		startBackfill(ctx.Req.Context(), user, "youtube")
+	}
 	go runUser(user)
 
 	ctx.SetCookie("username", user.UserName, time.Now().Add(time.Hour*24*30))
 	ctx.SetCookie("crypt", hash, time.Now().Add(time.Hour*24*30))
-	ctx.Redirect("/")
+	ctx.Redirect(config().Server.BasePath + "/")
 }
 
 func loginHandler(ctx *macaron.Context) {
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 
 	if user.UserName != "" {
-		ctx.Redirect("/")
+		ctx.Redirect(config().Server.BasePath + "/")
 		return
 	}
 
-	u, _ := url.Parse("https://api.twitch.tv/kraken/oauth2/authorize")
-	q := u.Query()
-	q.Set("response_type", "code")
-	q.Set("client_id", clientVideo.TWClient.ClientID)
-	q.Set("scope", "user_read")
-	q.Set("redirect_uri", config.Twitch.RedirectURI)
-	u.RawQuery = q.Encode()
-
-	ctx.Data["HeadURL"] = config.HeadURL
-	ctx.Data["TwitchURL"] = u.String()
-	ctx.Data["YouTubeURL"] = clientVideo.YTClient.URL
+	ctx.Data["HeadURL"] = config().HeadURL
+	ctx.Data["TwitchURL"] = clientVideo().TWClient.AuthURL()
+	ctx.Data["YouTubeURL"] = clientVideo().YTClient.URL
 
 	ctx.HTML(200, "login")
 }
@@ -138,38 +186,65 @@ func searchHandler(ctx *macaron.Context) {
 		page = 1
 	}
 	search := ctx.Req.FormValue("search")
+	sort := ctx.Req.FormValue("sort")
 
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 
 	if user.UserName != "" {
-		var title string
+		searchURL := "/search?search=" + url.QueryEscape(search) + "&"
+		renderSearch(ctx, user, search, sort, page, searchURL, fmt.Sprintf("Поиск по строке: %s", search))
+	} else {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+}
 
-		subVideos, count, err := clientVideo.SearchVideo(user, 42, page, search)
+func searchSort(sort string) string {
+	if sort != "rank" {
+		return "date"
+	}
+	return sort
+}
+
+// renderSearch выполняет поиск и отдает страницу search, baseURL - адрес
+// страницы без сортировки и номера, заканчивается на ? или &
+func renderSearch(ctx *macaron.Context, user models.User, search, sort string, page int, baseURL, title string) {
+	var subVideos []models.SearchResult
+	var count int
+
+	sort = searchSort(sort)
+	searchURL := baseURL + "sort=" + sort
+	query, err := models.ParseSearchQuery(search, userLocation(user))
+	if err == nil && query.Empty() {
+		ctx.Redirect(config().Server.BasePath + "/")
+		return
+	}
+	if err != nil {
+		ctx.Data["SearchError"] = err.Error()
+	} else {
+		query.ByRank = sort == "rank"
+		subVideos, count, err = clientVideo().SearchVideo(user, config().Server.PageSize, page, query)
 		if err != nil {
-			log.Panicln(err)
-		}
-		pag := pagination(page, count, 42, "/search?search="+search+"&")
-		if len(subVideos) == 0 {
-			if pag.Previous == 0 {
-				ctx.Redirect("/")
-				return
-			}
-			ctx.Redirect("/search?search=" + search + "&page=" + strconv.Itoa(pag.Previous))
+			renderError(ctx, user, err)
 			return
 		}
-		title = fmt.Sprintf("Поиск по строке: %s", search)
-
-		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config.HeadURL + ctx.Req.URL.String()[1:]}
-		ctx.Data["Search"] = search
-		ctx.Data["SubVideos"] = subVideos
-		ctx.Data["User"] = user
-		ctx.Data["SubVideo"] = models.Subvideo{}
-		ctx.Data["Page"] = pag
-		ctx.HTML(200, "search")
-	} else {
-		ctx.Redirect("/login")
+	}
+	pag := pagination(page, count, config().Server.PageSize, searchURL+"&")
+	if len(subVideos) == 0 && pag.Previous != 0 {
+		ctx.Redirect(config().Server.BasePath + searchURL + "&page=" + strconv.Itoa(pag.Previous))
 		return
 	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["Search"] = search
+	ctx.Data["SearchBase"] = baseURL
+	ctx.Data["Sort"] = sort
+	ctx.Data["Count"] = count
+	ctx.Data["SubVideos"] = subVideos
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Page"] = pag
+	ctx.HTML(200, "search")
 }
 
 func lastHandler(ctx *macaron.Context) {
@@ -187,23 +262,24 @@ func lastHandler(ctx *macaron.Context) {
 	if user.UserName != "" {
 		var title string
 
-		subVideos, count, err := clientVideo.SortVideo(user, 42, channelID, page)
+		subVideos, count, err := clientVideo().SortVideo(user, config().Server.PageSize, channelID, page)
 		if err != nil {
-			log.Panicln(err)
+			renderError(ctx, user, err)
+			return
 		}
-		pag := pagination(page, count, 42, "/last?channelID="+channelID+"&")
+		pag := pagination(page, count, config().Server.PageSize, "/last?channelID="+channelID+"&")
 
 		if len(subVideos) == 0 {
 			if pag.Previous == 0 {
-				ctx.Redirect("/")
+				ctx.Redirect(config().Server.BasePath + "/")
 				return
 			}
-			ctx.Redirect("/last?channelID=" + channelID + "&page=" + strconv.Itoa(pag.Previous))
+			ctx.Redirect(config().Server.BasePath + "/last?channelID=" + channelID + "&page=" + strconv.Itoa(pag.Previous))
 			return
 		}
 		title = fmt.Sprintf("%s последние видео", subVideos[0].Channel)
 
-		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config.HeadURL + ctx.Req.URL.String()[1:]}
+		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
 		ctx.Data["SubVideos"] = subVideos
 		ctx.Data["User"] = user
 		ctx.Data["SubVideo"] = models.Subvideo{}
@@ -211,7 +287,7 @@ func lastHandler(ctx *macaron.Context) {
 
 		ctx.HTML(200, "last")
 	} else {
-		ctx.Redirect("/login")
+		ctx.Redirect(config().Server.BasePath + "/login")
 		return
 	}
 }
@@ -229,17 +305,26 @@ func indexHandler(ctx *macaron.Context) {
 	if user.UserName != "" {
 		var title string
 
-		// TODO: display panic error to user
-
-		subVideos, count, err := clientVideo.SortVideo(user, 42, "", page)
+		subVideos, count, err := clientVideo().SortVideo(user, config().Server.PageSize, "", page)
 		if err != nil {
-			log.Panicln(err)
+			renderError(ctx, user, err)
+			return
 		}
-		pag := pagination(page, count, 42, "/?")
+		pag := pagination(page, count, config().Server.PageSize, "/?")
 
-		channelOnline, err := clientVideo.GetOnlineStreams(user)
+		// без стримов лента все равно показывается, только с предупреждением,
+		// а если Twitch не отвечает - со стримами из последнего ответа
+		channelOnline, updated, err := onlineStreams(ctx.Req.Context(), user)
 		if err != nil {
-			log.Panicln(err)
+			slog.WarnContext(logging.WithProvider(ctx.Req.Context(), "twitch"), "online streams failed", "err", err)
+			ctx.Data["StreamsError"] = true
+			if errors.Is(err, video.ErrAuthExpired) {
+				ctx.Data["StreamsAuthExpired"] = true
+			}
+			if !updated.IsZero() {
+				ctx.Data["StreamsStale"] = true
+				ctx.Data["StreamsAge"] = int(time.Since(updated).Minutes())
+			}
 		}
 		switch len(channelOnline) {
 		case 1:
@@ -255,16 +340,23 @@ func indexHandler(ctx *macaron.Context) {
 			title += fmt.Sprintf(", страница %d", page)
 		}
 
-		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config.HeadURL + ctx.Req.URL.String()[1:]}
+		// история видео догружается в фоне, пока она идет, показываем прогресс
+		backfills, err := models.SelectBackfills(user.Id)
+		if err != nil {
+			slog.WarnContext(ctx.Req.Context(), "backfills failed", "err", err)
+		}
+
+		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
 		ctx.Data["SubVideos"] = subVideos
 		ctx.Data["ChannelOnline"] = channelOnline
+		ctx.Data["Backfills"] = backfills
 		ctx.Data["User"] = user
 		ctx.Data["SubVideo"] = models.Subvideo{}
 		ctx.Data["Page"] = pag
 
 		ctx.HTML(200, "index")
 	} else {
-		ctx.Redirect("/login")
+		ctx.Redirect(config().Server.BasePath + "/login")
 		return
 	}
 }
@@ -274,21 +366,21 @@ func playHandler(ctx *macaron.Context) {
 	idVideo := ctx.Req.FormValue("id")
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 	if typeVideo == "twitch-stream" {
-		subvideo, err := clientVideo.TWClient.GetChannel(user.TWOAuth, idVideo)
+		subvideo, err := clientVideo().TWClient.GetChannel(ctx.Req.Context(), user.TWOAuth, idVideo)
 		if err != nil {
-			log.Println(err)
-			ctx.Redirect("/")
+			renderError(ctx, user, err)
+			return
 		}
 		ctx.Data["SubVideo"] = subvideo
 		ctx.Data["HeadInfo"] = headInfo{Title: subvideo.Title, URL: subvideo.URL, ImageURL: subvideo.ThumbURL, Description: subvideo.Description}
 	} else {
-		subvideo, err := models.SelectVideoForID(idVideo)
+		subvideo, err := models.Videos.SelectVideoForID(idVideo)
 		if err != nil {
-			log.Println(err)
-			ctx.Redirect("/")
+			renderError(ctx, user, err)
+			return
 		}
 		ctx.Data["SubVideo"] = subvideo
-		embedDomain, _ := url.Parse(config.HeadURL)
+		embedDomain, _ := url.Parse(config().HeadURL)
 		ctx.Data["HeadInfo"] = headInfo{Title: subvideo.Title, URL: subvideo.URL, ImageURL: subvideo.ThumbURL, Description: subvideo.Description, EmbedDomain: embedDomain.Hostname()}
 	}
 	ctx.Data["TypeVideo"] = typeVideo
@@ -305,27 +397,48 @@ func userHandler(ctx *macaron.Context) {
 	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 
 	if user.UserName != "" {
-		u, _ := url.Parse("https://api.twitch.tv/kraken/oauth2/authorize")
-		q := u.Query()
-		q.Set("response_type", "code")
-		q.Set("client_id", clientVideo.TWClient.ClientID)
-		q.Set("scope", "user_read")
-		q.Set("redirect_uri", config.Twitch.RedirectURI)
-		u.RawQuery = q.Encode()
-
-		ctx.Data["TwitchURL"] = u.String()
-		ctx.Data["YouTubeURL"] = clientVideo.YTClient.URL
+		ctx.Data["TwitchURL"] = clientVideo().TWClient.AuthURL()
+		ctx.Data["YouTubeURL"] = clientVideo().YTClient.URL
 
 		var title string
 
 		title = fmt.Sprintf("Настройки пользователя %s", user.UserName)
-		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config.HeadURL + ctx.Req.URL.String()[1:]}
+		ctx.Data["HeadInfo"] = headInfo{Title: title, URL: config().HeadURL + ctx.Req.URL.String()[1:]}
 		ctx.Data["User"] = user
 		ctx.Data["SubVideo"] = models.Subvideo{}
 		ctx.Data["TimeZones"] = getTimeZones()
+		ctx.Data["Admin"] = isAdmin(user)
+
+		filters, err := models.SelectFilters(user.Id)
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "filters failed", "err", err)
+		}
+		ctx.Data["Filters"] = filters
+		ctx.Data["FilterTypes"] = models.FilterTypes
+		ctx.Data["FilterError"] = ctx.Query("filter_error")
+		ctx.Data["FeedToken"] = feedToken(user)
+		digest, err := models.SelectDigest(user.Id)
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "digest failed", "err", err)
+		}
+		ctx.Data["Digest"] = digest
+		ctx.Data["DigestError"] = ctx.Query("digest_error")
+		ctx.Data["DigestEnabled"] = config().SMTP.Host != ""
+		ctx.Data["Hours"] = digestHours
+		ctx.Data["Weekdays"] = digestWeekdays
+		if telegramBot != nil {
+			link, err := models.SelectTelegramLink(user.Id)
+			if err != nil {
+				slog.ErrorContext(ctx.Req.Context(), "telegram link failed", "err", err)
+			}
+			ctx.Data["Telegram"] = true
+			ctx.Data["TelegramLink"] = link
+			ctx.Data["TelegramCodeValid"] = link.Code != "" && link.CodeExpiry.After(time.Now())
+			ctx.Data["TelegramStartURL"] = telegramStartURL(link.Code)
+		}
 		ctx.HTML(200, "user")
 	} else {
-		ctx.Redirect("/login")
+		ctx.Redirect(config().Server.BasePath + "/login")
 	}
 }
 
@@ -341,14 +454,69 @@ func userChangeHandler(ctx *macaron.Context, changeUserForm ChangeUserForm) {
 		timezone := changeUserForm.TimeZone
 		user.TimeZone = timezone
 		err := user.Insert()
+		if err == nil {
+			err = user.SetShowHidden(changeUserForm.ShowHidden)
+		}
 		if err != nil {
-			log.Panic(err)
+			renderError(ctx, user, err)
+			return
 		}
 
 		user = currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
 		go runUser(user)
-		ctx.Redirect("/")
+		ctx.Redirect(config().Server.BasePath + "/")
 	} else {
-		ctx.Redirect("/login")
+		ctx.Redirect(config().Server.BasePath + "/login")
+	}
+}
+
+func filterAddHandler(ctx *macaron.Context, filterForm FilterForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	filter := models.Filter{
+		UserID:  user.Id,
+		Kind:    filterForm.Kind,
+		Value:   filterForm.Value,
+		Comment: filterForm.Comment,
+	}
+	if filter.Kind == models.FilterMinLength || filter.Kind == models.FilterMaxLength {
+		minutes, err := strconv.Atoi(filter.Value)
+		if err == nil {
+			filter.Value = strconv.Itoa(minutes * 60)
+		}
+	}
+
+	err := filter.Insert()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "filter add failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/user?filter_error=" + url.QueryEscape(err.Error()))
+		return
+	}
+
+	if filter.Kind == models.FilterChannel && ctx.Req.Referer() != "" {
+		ctx.Redirect(ctx.Req.Referer())
+		return
+	}
+	ctx.Redirect(config().Server.BasePath + "/user")
+}
+
+func filterDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	id, err := strconv.ParseInt(ctx.Req.FormValue("id"), 10, 64)
+	if err == nil {
+		err = models.DeleteFilter(id, user.Id)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "filter delete failed", "err", err)
 	}
+	ctx.Redirect(config().Server.BasePath + "/user")
 }
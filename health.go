@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// version задается при сборке: -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+var startedAt = time.Now()
+
+// schedulerTimeout сколько планировщик синхронизации может молчать,
+// прежде чем /readyz сочтет его зависшим. Во время синхронизации он
+// отмечается на каждом канале и странице, а не только между пользователями
+const schedulerTimeout = 15 * time.Minute
+
+// workerState что сейчас делает фоновый обработчик
+type workerState struct {
+	Name  string
+	State string
+	Beat  time.Time
+}
+
+// syncRecord последняя синхронизация площадки
+type syncRecord struct {
+	Provider string
+	User     string
+	At       time.Time
+	Duration time.Duration
+	Err      string
+}
+
+// maxFailures сколько последних ошибок синхронизации помнить для /admin
+const maxFailures = 50
+
+type appStatus struct {
+	mu       sync.Mutex
+	workers  map[string]workerState
+	lastSync map[string]syncRecord
+	failures []syncRecord
+}
+
+var status = &appStatus{
+	workers:  map[string]workerState{},
+	lastSync: map[string]syncRecord{},
+}
+
+// beat отмечает, что обработчик name жив и занят state
+func (s *appStatus) beat(name, state string) {
+	s.mu.Lock()
+	s.workers[name] = workerState{Name: name, State: state, Beat: time.Now()}
+	s.mu.Unlock()
+}
+
+func (s *appStatus) synced(provider, username string, start time.Time, err error) {
+	record := syncRecord{Provider: provider, User: username, At: start, Duration: time.Since(start)}
+	if err != nil {
+		record.Err = err.Error()
+	}
+	s.mu.Lock()
+	s.lastSync[provider] = record
+	if err != nil {
+		s.failures = append(s.failures, record)
+		if len(s.failures) > maxFailures {
+			s.failures = s.failures[len(s.failures)-maxFailures:]
+		}
+	}
+	s.mu.Unlock()
+}
+
+// recentFailures ошибки синхронизации с момента запуска, новые первыми
+func (s *appStatus) recentFailures() (failures []syncRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.failures) - 1; i >= 0; i-- {
+		failures = append(failures, s.failures[i])
+	}
+	return failures
+}
+
+func (s *appStatus) worker(name string) (state workerState, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok = s.workers[name]
+	return state, ok
+}
+
+func (s *appStatus) snapshot() (workers []workerState, syncs []syncRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, worker := range s.workers {
+		workers = append(workers, worker)
+	}
+	for _, record := range s.lastSync {
+		syncs = append(syncs, record)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+	sort.Slice(syncs, func(i, j int) bool { return syncs[i].Provider < syncs[j].Provider })
+	return workers, syncs
+}
+
+// schedulerAlive планировщик синхронизации отмечался недавно
+func schedulerAlive(now time.Time) bool {
+	state, ok := status.worker("sync")
+	return ok && now.Sub(state.Beat) < schedulerTimeout
+}
+
+// buildVersion версия из -ldflags, а без нее ревизия git из сборки
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				modified = "-dirty"
+			}
+		}
+	}
+	if revision == "" {
+		return version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	return version + "-" + revision + modified
+}
+
+func healthzHandler(ctx *macaron.Context) {
+	ctx.PlainText(200, []byte("ok"))
+}
+
+func readyzHandler(ctx *macaron.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx.Req.Context(), 3*time.Second)
+	defer cancel()
+
+	ready := true
+	checks := map[string]string{"database": "ok", "scheduler": "ok"}
+	err := models.Ready(checkCtx)
+	if err != nil {
+		ready = false
+		checks["database"] = err.Error()
+	}
+	if !schedulerAlive(time.Now()) {
+		ready = false
+		checks["scheduler"] = "no heartbeat for " + schedulerTimeout.String()
+	}
+
+	if !ready {
+		ctx.JSON(503, map[string]interface{}{"status": "fail", "checks": checks})
+		return
+	}
+	ctx.JSON(200, map[string]interface{}{"status": "ok", "checks": checks})
+}
+
+// upstreamCheck доступность API площадки
+type upstreamCheck struct {
+	Name    string
+	URL     string
+	Status  int
+	Latency time.Duration
+	Err     string
+}
+
+// upstreams площадки по адресам из клиентов, с ними же работает синхронизация
+func upstreams() []upstreamCheck {
+	return []upstreamCheck{
+		{Name: "twitch", URL: clientVideo().TWClient.APIURL},
+		{Name: "youtube", URL: clientVideo().YTClient.APIURL() + "youtube/v3/"},
+	}
+}
+
+// checkUpstreams проверяет площадки параллельно. Любой HTTP ответ, даже
+// 401 или 404, значит что площадка доступна. Запросы идут мимо
+// monitor.Transport, чтобы не тратить квоту YouTube и не портить метрики
+func checkUpstreams(ctx context.Context) []upstreamCheck {
+	client := &http.Client{Timeout: 5 * time.Second}
+	checks := upstreams()
+
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(check *upstreamCheck) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, "GET", check.URL, nil)
+			if err != nil {
+				check.Err = err.Error()
+				return
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			check.Latency = time.Since(start).Round(time.Millisecond)
+			if err != nil {
+				check.Err = err.Error()
+				return
+			}
+			resp.Body.Close()
+			check.Status = resp.StatusCode
+		}(&checks[i])
+	}
+	wg.Wait()
+	return checks
+}
+
+// secretKeys части ключей конфигурации, значения которых не показываются
+var secretKeys = []string{"secret", "password", "token", "private", "developerkey"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedConfig конфигурация в YAML со скрытыми секретами
+func redactedConfig() (string, error) {
+	dat, err := yaml.Marshal(config())
+	if err != nil {
+		return "", err
+	}
+	var tree yaml.MapSlice
+	err = yaml.Unmarshal(dat, &tree)
+	if err != nil {
+		return "", err
+	}
+	dat, err = yaml.Marshal(redact(tree))
+	return string(dat), err
+}
+
+func redact(tree yaml.MapSlice) yaml.MapSlice {
+	for i, item := range tree {
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			tree[i].Value = redact(nested)
+			continue
+		}
+		key, _ := item.Key.(string)
+		if isSecretKey(key) && item.Value != "" && item.Value != nil {
+			tree[i].Value = "********"
+		}
+	}
+	return tree
+}
+
+// isAdmin администраторы задаются именем пользователя или ID канала
+// площадки: "name", "twitch:<id>", "youtube:<id>"
+func isAdmin(user models.User) bool {
+	if user.UserName == "" {
+		return false
+	}
+	for _, admin := range config().Admins {
+		switch {
+		case admin == user.UserName:
+			return true
+		case user.TWChannelID != "" && admin == "twitch:"+user.TWChannelID:
+			return true
+		case user.YTChannelID != "" && admin == "youtube:"+user.YTChannelID:
+			return true
+		}
+	}
+	return false
+}
+
+func debugStatusHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if !isAdmin(user) {
+		// для остальных страницы как будто нет
+		renderError(ctx, user, models.ErrNotFound)
+		return
+	}
+
+	configText, err := redactedConfig()
+	if err != nil {
+		renderError(ctx, user, err)
+		return
+	}
+	workers, syncs := status.snapshot()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	ctx.Data["HeadInfo"] = headInfo{Title: "Состояние", URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Version"] = buildVersion()
+	ctx.Data["GoVersion"] = runtime.Version()
+	ctx.Data["Uptime"] = time.Since(startedAt).Round(time.Second)
+	ctx.Data["Goroutines"] = runtime.NumGoroutine()
+	ctx.Data["MemoryMB"] = mem.Alloc / 1024 / 1024
+	ctx.Data["DBStats"] = models.DB().Stats()
+	ctx.Data["NotifyQueue"] = notifier.Queued()
+	ctx.Data["SchedulerAlive"] = schedulerAlive(time.Now())
+	ctx.Data["Workers"] = workers
+	ctx.Data["Syncs"] = syncs
+	ctx.Data["Upstreams"] = checkUpstreams(ctx.Req.Context())
+	ctx.Data["Config"] = configText
+	ctx.HTML(200, "debug")
+}
@@ -5,20 +5,26 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DeKoniX/subvideo/models"
+	"gopkg.in/macaron.v1"
 )
 
 func currentUser(username, hash string) (user models.User) {
 	if username == "" {
 		return user
 	}
-	user, err := models.SelectUserForUserName(username)
-	if err != nil {
+	user, err := models.Users.SelectUserForUserName(username)
+	if err != nil || user.Disabled {
 		return models.User{}
 	}
 	if cryptTest(username, hash, user.UpdatedAt.UTC()) {
@@ -27,6 +33,11 @@ func currentUser(username, hash string) (user models.User) {
 	return models.User{}
 }
 
+// basePath префикс всех ссылок приложения, "" если оно в корне сайта
+func basePath() string {
+	return config().Server.BasePath
+}
+
 func split(a, b int) bool {
 	return a%b == 0
 }
@@ -45,12 +56,33 @@ func getTime(t time.Time, tz string) (timeString string) {
 }
 
 type utzavStruct struct {
-	Video models.Subvideo
-	TZ    string
+	Video    models.Subvideo
+	TZ       string
+	Headline template.HTML
 }
 
 func userTimeZoneAndVideo(video models.Subvideo, tz string) utzavStruct {
-	return utzavStruct{video, tz}
+	return utzavStruct{Video: video, TZ: tz}
+}
+
+func searchResultAndTimeZone(result models.SearchResult, tz string) utzavStruct {
+	return utzavStruct{Video: result.Subvideo, TZ: tz, Headline: highlight(result.Headline)}
+}
+
+// highlight экранирует фрагмент из ts_headline и превращает маркеры в <mark>
+func highlight(headline string) template.HTML {
+	headline = html.EscapeString(headline)
+	headline = strings.Replace(headline, models.HeadlineStart, "<mark>", -1)
+	headline = strings.Replace(headline, models.HeadlineStop, "</mark>", -1)
+	return template.HTML(headline)
+}
+
+func userLocation(user models.User) *time.Location {
+	location, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
 }
 
 type timeZones []struct {
@@ -59,7 +91,7 @@ type timeZones []struct {
 }
 
 func getTimeZones() (timeZones timeZones) {
-	dat, _ := ioutil.ReadFile("timezones.json")
+	dat, _ := ioutil.ReadFile(config().Server.TimeZones)
 	json.Unmarshal(dat, &timeZones)
 
 	return timeZones
@@ -98,7 +130,7 @@ func videoLen(len int) (strLength string) {
 func crypt(username string, dateChange time.Time) string {
 	h := md5.New()
 	io.WriteString(h, username)
-	io.WriteString(h, config.Secret)
+	io.WriteString(h, config().Secret)
 	io.WriteString(h, dateChange.Format(time.Stamp))
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
@@ -106,7 +138,7 @@ func crypt(username string, dateChange time.Time) string {
 func cryptTest(username, hash string, dateChange time.Time) bool {
 	h := md5.New()
 	io.WriteString(h, username)
-	io.WriteString(h, config.Secret)
+	io.WriteString(h, config().Secret)
 	io.WriteString(h, dateChange.Format(time.Stamp))
 	thisHash := fmt.Sprintf("%x", h.Sum(nil))
 	return thisHash == hash
@@ -116,10 +148,17 @@ type navMenuStruct struct {
 	User     models.User
 	SubVideo models.Subvideo
 	Search   string
+	Groups   []models.Group
+	New      int
 }
 
 func navMenu(user models.User, subvideo models.Subvideo, search string) navMenuStruct {
-	return navMenuStruct{User: user, SubVideo: subvideo, Search: search}
+	nav := navMenuStruct{User: user, SubVideo: subvideo, Search: search}
+	if user.Id != 0 {
+		nav.Groups, _ = models.SelectGroups(user.Id)
+		nav.New, _ = models.CountSavedSearchNew(user, userLocation(user))
+	}
+	return nav
 }
 
 type headInfo struct {
@@ -136,8 +175,8 @@ type Metrics struct {
 }
 
 func metrics() (met Metrics) {
-	met.Yandex = config.Metrics.Yandex
-	met.Google = config.Metrics.Google
+	met.Yandex = config().Metrics.Yandex
+	met.Google = config().Metrics.Google
 	return met
 }
 
@@ -171,7 +210,7 @@ func pagination(page, count, n int, url string) (p paginationStruct) {
 		p.Previous = p.Page - 1
 		p.Next = p.Page + 1
 	}
-	p.URL = url
+	p.URL = config().Server.BasePath + url
 
 	return p
 }
@@ -181,7 +220,7 @@ func minus(a, b int) int {
 }
 
 func hashFile(fileName string) (returnMD5String string) {
-	file, err := os.Open("public/assets" + fileName)
+	file, err := os.Open(filepath.Join(config().Server.Public, "assets", fileName))
 	if err != nil {
 		return ""
 	}
@@ -197,3 +236,68 @@ func hashFile(fileName string) (returnMD5String string) {
 
 	return returnMD5String
 }
+
+func filterText(filter models.Filter) string {
+	switch filter.Kind {
+	case models.FilterChannel:
+		if filter.Comment != "" {
+			return "Канал: " + filter.Comment
+		}
+		return "Канал: " + filter.Value
+	case models.FilterTitle:
+		return "Название: " + filter.Value
+	case models.FilterDescription:
+		return "Описание: " + filter.Value
+	case models.FilterGame:
+		return "Игра: " + filter.Value
+	case models.FilterMinLength:
+		length, _ := strconv.Atoi(filter.Value)
+		return "Короче чем: " + videoLen(length)
+	case models.FilterMaxLength:
+		length, _ := strconv.Atoi(filter.Value)
+		return "Длиннее чем: " + videoLen(length)
+	case models.FilterType:
+		return "Тип: " + filter.Value
+	}
+	return filter.Kind + ": " + filter.Value
+}
+
+// routeKey ключ ctx.Data с шаблоном маршрута, который обработал запрос
+const routeKey = "route"
+
+// router запоминает шаблон маршрута при регистрации: перед обработчиками
+// встает еще один, который кладет шаблон в ctx.Data для метрик
+type router struct {
+	*macaron.Macaron
+}
+
+func routePattern(pattern string) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		ctx.Data[routeKey] = pattern
+	}
+}
+
+func (r router) Get(pattern string, h ...macaron.Handler) {
+	r.Macaron.Get(pattern, append([]macaron.Handler{routePattern(pattern)}, h...)...)
+}
+
+func (r router) Post(pattern string, h ...macaron.Handler) {
+	r.Macaron.Post(pattern, append([]macaron.Handler{routePattern(pattern)}, h...)...)
+}
+
+func (r router) Combo(pattern string, h ...macaron.Handler) *macaron.ComboRouter {
+	return r.Macaron.Combo(pattern, append([]macaron.Handler{routePattern(pattern)}, h...)...)
+}
+
+// routeLabel маршрут для метрик - шаблон из router. Запрос без маршрута
+// отдал macaron.Static, если файла нет - это unmatched, чтобы случайные
+// адреса не плодили метки
+func routeLabel(ctx *macaron.Context) string {
+	if pattern, ok := ctx.Data[routeKey].(string); ok {
+		return pattern
+	}
+	if ctx.Resp.Status() != 404 {
+		return "static"
+	}
+	return "unmatched"
+}
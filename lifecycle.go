@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout сколько после сигнала ждем идущие запросы и синхронизации
+const shutdownTimeout = 30 * time.Second
+
+// lifecycle останавливает приложение по SIGINT/SIGTERM. stop отменяется
+// сразу: фоновые циклы выходят и новая работа не начинается. work отменяется,
+// только если идущие синхронизации не уложились в shutdownTimeout, тогда
+// API запросы и запись в базу прерываются на ближайшем видео
+type lifecycle struct {
+	stop        context.Context
+	stopSignals context.CancelFunc
+	work        context.Context
+	cancelWork  context.CancelFunc
+
+	mu       sync.Mutex
+	stopping bool
+	jobs     sync.WaitGroup
+}
+
+var app = newLifecycle()
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.stop, l.stopSignals = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	l.work, l.cancelWork = context.WithCancel(context.Background())
+	return l
+}
+
+// begin отмечает начало работы, которую нужно дождаться при остановке,
+// false - приложение уже останавливается и начинать не нужно
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.jobs.Add(1)
+	return true
+}
+
+func (l *lifecycle) end() {
+	l.jobs.Done()
+}
+
+// sleep ждет d, false - пришел сигнал остановки
+func (l *lifecycle) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-l.stop.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (l *lifecycle) stopped() bool {
+	return l.stop.Err() != nil
+}
+
+// listen открывает server.listen или Unix сокет server.socket. Сокет,
+// оставшийся от упавшего процесса, удаляется, при остановке его удалит Close
+func listen() (net.Listener, error) {
+	if config().Server.Socket == "" {
+		return net.Listen("tcp", config().Server.Listen)
+	}
+	if info, err := os.Stat(config().Server.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(config().Server.Socket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", config().Server.Socket)
+	if err != nil {
+		return nil, err
+	}
+	// прокси обычно работает от другого пользователя той же группы
+	err = os.Chmod(config().Server.Socket, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// shutdown закрывает HTTP сервер и ждет идущие синхронизации
+func (l *lifecycle) shutdown(server *http.Server) {
+	l.mu.Lock()
+	l.stopping = true
+	l.mu.Unlock()
+	// повторный Ctrl+C завершит процесс сразу
+	l.stopSignals()
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		slog.Error("http shutdown failed", "err", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("syncs did not finish in time, cancelling")
+		l.cancelWork()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			slog.Error("syncs are still running, exiting anyway")
+		}
+	}
+	l.cancelWork()
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/DeKoniX/subvideo/logging"
+	"github.com/DeKoniX/subvideo/models"
+)
+
+const (
+	// liveTTL сколько стримы Twitch пользователя считаются свежими
+	liveTTL = time.Minute
+	// liveActive пользователей, которые открывали ленту за это время,
+	// фоновое обновление держит с теплым кэшем
+	liveActive = 15 * time.Minute
+	// liveTimeout на один запрос к Twitch, общий для всех, кто его ждет
+	liveTimeout = 15 * time.Second
+	// liveWait сколько страница ждет Twitch, потом показывает старые стримы
+	liveWait = 3 * time.Second
+)
+
+// errLiveSlow Twitch не ответил за liveWait, запрос продолжается в фоне
+var errLiveSlow = errors.New("twitch is slow, showing cached streams")
+
+// liveEntry последние известные стримы пользователя. updated - время
+// последнего удачного запроса, tried - последнего вообще, err - его
+// ошибка, если он не удался
+type liveEntry struct {
+	oauth   string
+	streams []models.Subvideo
+	updated time.Time
+	tried   time.Time
+	err     error
+	seen    time.Time
+	// refreshing закрывается, когда текущий запрос к Twitch закончится
+	refreshing chan struct{}
+}
+
+// liveCache стримы Twitch по пользователям. Одновременные загрузки страниц
+// ждут один запрос к Twitch, а если Twitch не отвечает, отдаются последние
+// известные стримы
+type liveCache struct {
+	mu      sync.Mutex
+	entries map[int64]*liveEntry
+}
+
+var liveStreams = &liveCache{entries: map[int64]*liveEntry{}}
+
+// get стримы Twitch, свежие или из последнего удачного запроса. updated -
+// когда они получены, нулевой - ни разу. err - Twitch сейчас не отвечает
+func (c *liveCache) get(ctx context.Context, user models.User) (streams []models.Subvideo, updated time.Time, err error) {
+	if user.TWOAuth == "" {
+		return nil, time.Time{}, nil
+	}
+	c.mu.Lock()
+	entry := c.entry(user)
+	entry.seen = time.Now()
+	// неудачный запрос тоже не повторяется раньше liveTTL, чтобы каждая
+	// страница не ждала лежащий Twitch
+	if time.Since(entry.tried) < liveTTL {
+		streams, updated, err = entry.streams, entry.updated, entry.err
+		c.mu.Unlock()
+		return streams, updated, err
+	}
+	done := c.start(entry, user)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(liveWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		err = nil
+	case <-timer.C:
+		err = errLiveSlow
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		err = entry.err
+	}
+	return entry.streams, entry.updated, err
+}
+
+// refresh запрашивает стримы, даже если в кэше они свежие, и ждет ответа
+func (c *liveCache) refresh(ctx context.Context, user models.User) (streams []models.Subvideo, err error) {
+	if user.TWOAuth == "" {
+		return nil, nil
+	}
+	c.mu.Lock()
+	entry := c.entry(user)
+	done := c.start(entry, user)
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return entry.streams, entry.err
+}
+
+// entry запись пользователя, после смены токена старые стримы не годятся
+func (c *liveCache) entry(user models.User) *liveEntry {
+	entry, ok := c.entries[user.Id]
+	if !ok || entry.oauth != user.TWOAuth {
+		entry = &liveEntry{oauth: user.TWOAuth}
+		c.entries[user.Id] = entry
+	}
+	return entry
+}
+
+// start запускает запрос к Twitch, если он еще не идет, и отдает канал,
+// который закроется по его окончании. Вызывается под c.mu
+func (c *liveCache) start(entry *liveEntry, user models.User) <-chan struct{} {
+	if entry.refreshing != nil {
+		return entry.refreshing
+	}
+	done := make(chan struct{})
+	entry.refreshing = done
+	go func() {
+		// запрос не привязан к странице, которая его начала: ее закрытие не
+		// должно отменять его для остальных
+		ctx, cancel := context.WithTimeout(logging.WithProvider(logging.WithUser(app.work, user.UserName), "twitch"), liveTimeout)
+		defer cancel()
+		streams, err := clientVideo().TWLiveStreams(ctx, user)
+
+		c.mu.Lock()
+		entry.refreshing = nil
+		entry.tried = time.Now()
+		entry.err = err
+		if err == nil {
+			entry.streams, entry.updated = streams, time.Now()
+		} else {
+			slog.WarnContext(ctx, "live streams failed", "err", err, "stale", time.Since(entry.updated).Round(time.Second))
+		}
+		c.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// active пользователи, которые недавно открывали ленту. Остальные записи
+// удаляются, чтобы кэш не рос
+func (c *liveCache) active() (userIDs []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for userID, entry := range c.entries {
+		if time.Since(entry.seen) > liveActive && entry.refreshing == nil {
+			delete(c.entries, userID)
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// onlineStreams идущие стримы для ленты: Twitch из кэша, YouTube из базы.
+// updated и err как у liveCache.get
+func onlineStreams(ctx context.Context, user models.User) (streams []models.Subvideo, updated time.Time, err error) {
+	youtube, err := clientVideo().YTLiveStreams(user)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	streams, updated, err = liveStreams.get(ctx, user)
+	// срез из кэша общий, append не должен писать в его массив
+	return append(streams[:len(streams):len(streams)], youtube...), updated, err
+}
+
+// runLiveCache обновляет стримы активных пользователей раньше, чем они
+// устареют, чтобы страница не ждала Twitch
+func runLiveCache() {
+	for {
+		status.beat("streams", "waiting")
+		if !app.sleep(liveTTL * 3 / 4) {
+			return
+		}
+		userIDs := liveStreams.active()
+		status.beat("streams", "refreshing")
+		for _, userID := range userIDs {
+			if app.stopped() {
+				return
+			}
+			user, err := models.Users.SelectUserForID(userID)
+			if err != nil {
+				slog.Warn("live cache user failed", "user_id", userID, "err", err)
+				continue
+			}
+			if user.Disabled {
+				continue
+			}
+			liveStreams.refresh(app.stop, user)
+		}
+	}
+}
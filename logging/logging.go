@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	userKey
+	providerKey
+	syncIDKey
+)
+
+// Setup настраивает slog по умолчанию: format json или text (logfmt),
+// level debug, info, warn или error.
+func Setup(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(defaultString(level, "info")))
+	if err != nil {
+		return fmt.Errorf("logging: bad level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(defaultString(format, "text")) {
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text", "logfmt":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("logging: bad format %q, want json or text", format)
+	}
+	// после SetDefault стандартный log тоже пишет через этот handler
+	slog.SetDefault(slog.New(&contextHandler{handler}))
+	return nil
+}
+
+// NewID короткий случайный идентификатор для запросов и синхронизаций
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+func WithProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, providerKey, provider)
+}
+
+func WithSyncID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, syncIDKey, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// contextHandler дописывает к записи поля из контекста
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		for _, field := range []struct {
+			key  ctxKey
+			name string
+		}{
+			{requestIDKey, "request_id"},
+			{syncIDKey, "sync_id"},
+			{userKey, "user"},
+			{providerKey, "provider"},
+		} {
+			if value, ok := ctx.Value(field.key).(string); ok && value != "" {
+				record.AddAttrs(slog.String(field.name, value))
+			}
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"log/slog"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// Middleware выдает запросу ID (или берет X-Request-ID от прокси), кладет
+// его и имя пользователя в контекст запроса и пишет строку о каждом запросе.
+// Запросы к quiet (проверки балансировщика) пишутся только на уровне debug
+func Middleware(quiet ...string) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		start := time.Now()
+		id := ctx.Req.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = NewID()
+		}
+		ctx.Resp.Header().Set("X-Request-ID", id)
+
+		reqCtx := WithRequestID(ctx.Req.Context(), id)
+		if username := ctx.GetCookie("username"); username != "" {
+			reqCtx = WithUser(reqCtx, username)
+		}
+		ctx.Req.Request = ctx.Req.Request.WithContext(reqCtx)
+
+		ctx.Next()
+
+		status := ctx.Resp.Status()
+		if status == 0 {
+			status = 200
+		}
+		level := slog.LevelInfo
+		for _, path := range quiet {
+			if ctx.Req.URL.Path == path {
+				level = slog.LevelDebug
+			}
+		}
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(reqCtx, level, "request",
+			"method", ctx.Req.Method,
+			"path", ctx.Req.URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+			"remote", ctx.RemoteAddr(),
+		)
+	}
+}
@@ -1,80 +1,84 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"html/template"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
+	"github.com/DeKoniX/subvideo/logging"
 	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/monitor"
+	"github.com/DeKoniX/subvideo/notify"
+	"github.com/DeKoniX/subvideo/upstream"
 	"github.com/DeKoniX/subvideo/video"
 	"github.com/go-macaron/binding"
 	"github.com/go-macaron/gzip"
 	macaron "gopkg.in/macaron.v1"
-	yaml "gopkg.in/yaml.v2"
 )
 
-type configYML struct {
-	YouTube struct {
-		ClientID     string `yaml:"clientid"`
-		ClientSecret string `yaml:"clientsecret"`
-		RedirectURI  string `yaml:"redirecturi"`
-		DeveloperKey string `yaml:"developerkey"`
-	}
-	Twitch struct {
-		ClientID     string `yaml:"clientid"`
-		ClientSecret string `yaml:"clientsecret"`
-		RedirectURI  string `yaml:"redirecturi"`
-	}
-	DataBase struct {
-		Host     string `yaml:"host"`
-		Port     string `yaml:"port"`
-		DBname   string `yaml:"dbname"`
-		UserName string `yaml:"username"`
-		Password string `yaml:"password"`
-	}
-	Secret              string `yaml:"secret"`
-	HeadURL             string `yaml:"headurl"`
-	DeleteVideoInterval int    `yaml:"delete_video_interval"`
-	DeleteUserInterval  int    `yaml:"delete_user_interval"`
-	Metrics             struct {
-		Yandex int    `yaml:"yandex"`
-		Google string `yaml:"google"`
-	}
-}
+// currentVideo клиенты площадок, перезагрузка конфигурации заменяет их целиком
+var currentVideo atomic.Pointer[video.ClientVideo]
 
-var config configYML
+func clientVideo() *video.ClientVideo {
+	return currentVideo.Load()
+}
 
-var clientVideo *video.ClientVideo
+var notifier *notify.Dispatcher
 
 func main() {
 	var configPath = flag.String("config", "subvideo.yml", "Путь до конфигурационного файла")
+	var genVAPID = flag.Bool("vapid", false, "Создать ключи VAPID для Web Push и выйти")
+	flag.Usage = usage
 	flag.Parse()
 
-	err := getConfig(*configPath)
-	if err != nil {
-		log.Panic(err)
+	if *genVAPID {
+		err := printVAPIDKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
+	os.Exit(runCommand(*configPath, flag.Args()))
+}
 
-	clientVideo = video.Init(
-		config.Twitch.ClientID,
-		config.Twitch.ClientSecret,
-		config.Twitch.RedirectURI,
-		config.YouTube.ClientID,
-		config.YouTube.ClientSecret,
-		config.YouTube.RedirectURI,
-	)
-
-	err = models.Init(config.DataBase.Host, config.DataBase.Port, config.DataBase.UserName, config.DataBase.Password, config.DataBase.DBname)
-	if err != nil {
-		log.Panic(err)
+// serve запускает веб-сервер и фоновые задачи до SIGINT или SIGTERM
+func serve(configPath string) int {
+	if code := setup(configPath, true); code != exitOK {
+		return code
+	}
+	dbName := config().DataBase.DBname
+	if config().DataBase.Driver == "sqlite" {
+		dbName = filepath.Base(config().DataBase.Path)
 	}
+	monitor.RegisterDB(models.DB(), dbName)
+	telegramBot = initTelegram()
+	notifier = initNotify()
+	notifier.Start(app.stop, config().Notify.Workers)
 	go runTime()
+	go runLive()
+	go runLiveCache()
+	go runDigest()
+	go runBackfill()
+	if telegramBot != nil {
+		go runTelegram()
+	}
+	go runReload(configPath)
 
-	m := macaron.Classic()
+	m := router{macaron.New()}
+	m.SetURLPrefix(config().Server.BasePath)
+	m.Use(logging.Middleware("/healthz", "/readyz"))
+	m.Use(macaron.Recovery())
+	m.Use(monitor.Middleware(routeLabel))
 	m.Use(macaron.Renderer(macaron.RenderOptions{
+		Directory: config().Server.Templates,
 		Funcs: []template.FuncMap{map[string]interface{}{
 			"split":                split,
 			"getTime":              getTime,
@@ -85,9 +89,13 @@ func main() {
 			"userTimeZoneAndVideo": userTimeZoneAndVideo,
 			"minus":                minus,
 			"hashFile":             hashFile,
+			"filterText":           filterText,
+			"searchResult":         searchResultAndTimeZone,
+			"notifyRuleText":       notifyRuleText,
+			"basePath":             basePath,
 		}},
 	}))
-	m.Use(macaron.Static("public"))
+	m.Use(macaron.Static(config().Server.Public))
 	m.Use(gzip.Gziper())
 
 	m.Get("/", indexHandler)
@@ -101,89 +109,239 @@ func main() {
 	m.Combo("/user").
 		Get(userHandler).
 		Post(binding.Bind(ChangeUserForm{}), userChangeHandler)
+	m.Post("/user/filters", binding.Bind(FilterForm{}), filterAddHandler)
+	m.Post("/user/filters/delete", filterDeleteHandler)
+	m.Post("/user/digest", binding.Bind(DigestForm{}), digestHandler)
+	m.Post("/user/feed/token", feedTokenHandler)
+	m.Get("/user/digest/preview", digestPreviewHandler)
+	m.Combo("/groups").
+		Get(groupsHandler).
+		Post(binding.Bind(GroupForm{}), groupAddHandler)
+	m.Post("/groups/:id/delete", groupDeleteHandler)
+	m.Post("/groups/:id/channels", groupChannelAddHandler)
+	m.Post("/groups/:id/channels/delete", groupChannelDeleteHandler)
+	m.Get("/group/:id", groupHandler)
+	m.Get("/group/:id/feed", groupFeedHandler)
+	m.Get("/feed", feedHandler)
+	m.Combo("/saved").
+		Get(savedSearchesHandler).
+		Post(binding.Bind(SavedSearchForm{}), savedSearchAddHandler)
+	m.Get("/saved/:id", savedSearchHandler)
+	m.Get("/saved/:id/feed", savedSearchFeedHandler)
+	m.Post("/saved/:id/notify", savedSearchNotifyHandler)
+	m.Post("/saved/:id/delete", savedSearchDeleteHandler)
+	m.Combo("/user/notify").
+		Get(notifyHandler).
+		Post(binding.Bind(NotifyRuleForm{}), notifyAddHandler)
+	m.Post("/user/notify/:id/delete", notifyDeleteHandler)
+	m.Post("/user/push/:id/mute", binding.Bind(PushMuteForm{}), pushMuteHandler)
+	m.Post("/user/push/:id/delete", pushDeleteHandler)
+	m.Post("/push/subscribe", pushSubscribeHandler)
+	m.Post("/push/unsubscribe", pushUnsubscribeHandler)
+	m.Post("/user/telegram", telegramCodeHandler)
+	m.Post("/user/telegram/unlink", telegramUnlinkHandler)
+	m.Post("/telegram/:secret", telegramWebhookHandler)
+	m.Get("/metrics", monitor.Handler(func() string { return config().Monitoring.Token }))
+	m.Get("/healthz", healthzHandler)
+	m.Get("/readyz", readyzHandler)
+	m.Get("/debug/status", debugStatusHandler)
+	m.Get("/admin", adminHandler)
+	m.Post("/admin/users/:id/sync", adminSyncHandler)
+	m.Post("/admin/users/:id/disable", adminDisableHandler)
+	m.Post("/admin/users/:id/delete", adminDeleteHandler)
+	m.Get("/api/videos", apiVideosHandler)
+	m.Get("/api/groups", apiGroupsHandler)
+	m.Get("/api/groups/:id/videos", apiGroupVideosHandler)
+	m.NotFound(notFoundHandler)
 
-	log.Println("Server is running...")
-	log.Println(http.ListenAndServe(":8181", m))
+	listener, err := listen()
+	if err != nil {
+		slog.Error("listen failed", "err", err)
+		return exitFailure
+	}
+	server := &http.Server{Handler: m}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+	slog.Info("server is running", "addr", listener.Addr().String(), "base_path", config().Server.BasePath, "version", buildVersion())
+
+	select {
+	case err = <-serverErr:
+		slog.Error("server stopped", "err", err)
+		app.shutdown(server)
+		return exitFailure
+	case <-app.stop.Done():
+		app.shutdown(server)
+	}
+	return exitOK
+}
+
+func newVideoClient(conf *configYML) *video.ClientVideo {
+	client := video.Init(
+		video.TWInit(conf.Twitch.ClientID, conf.Twitch.ClientSecret, conf.Twitch.RedirectURI, conf.Twitch.APIURL),
+		video.YTInit(conf.YouTube.ClientID, conf.YouTube.ClientSecret, conf.YouTube.RedirectURI,
+			conf.YouTube.APIURL, conf.YouTube.OAuthURL),
+	)
+	client.ChannelLimit = conf.Sync.ChannelLimit
+	client.Workers = conf.Sync.Workers
+	opts := upstreamOptions(conf)
+	client.TWClient.HTTPClient = upstream.NewClient("twitch",
+		monitor.NewTransport("twitch", upstream.DefaultBase(opts.Timeout)), opts)
+	client.YTClient.SetHTTPClient(upstream.NewClient("youtube",
+		monitor.NewTransport("youtube", upstream.DefaultBase(opts.Timeout)), opts))
+	return client
+}
+
+// upstreamOptions у каждой площадки свой лимит частоты и размыкатель,
+// настройки общие
+func upstreamOptions(conf *configYML) upstream.Options {
+	return upstream.Options{
+		Timeout:  time.Duration(conf.Upstream.Timeout) * time.Second,
+		Retries:  conf.Upstream.Retries,
+		Rate:     conf.Upstream.Rate,
+		Failures: conf.Upstream.Failures,
+		Cooldown: time.Duration(conf.Upstream.Cooldown) * time.Second,
+		Cache:    httpCache,
+	}
 }
 
 func runUser(user models.User) {
-	log.Println("RUN User: ", user.UserName)
-	err := clientVideo.YTGetVideo(user)
+	syncUser(user)
+}
+
+// syncUser синхронизирует пользователя, все строки журнала одной
+// синхронизации связаны через sync_id
+func syncUser(user models.User) {
+	if user.Disabled || !app.begin() {
+		return
+	}
+	defer app.end()
+
+	ctx := logging.WithSyncID(logging.WithUser(app.work, user.UserName), logging.NewID())
+	slog.InfoContext(ctx, "sync started")
+
+	status.beat("sync", "sync "+user.UserName)
+	// у пользователя с сотнями подписок синхронизация идет дольше
+	// schedulerTimeout, планировщик жив, пока она продвигается
+	ctx = video.WithProgress(ctx, func() { status.beat("sync", "sync "+user.UserName) })
+	syncPipeline(ctx, user, "", nil)
+}
+
+// syncProvider площадка для синхронизации, name - как в sync --provider
+type syncProvider struct {
+	name     string
+	provider string
+	sync     func(ctx context.Context, user models.User) (video.SyncResult, error)
+}
+
+var syncProviders = []syncProvider{
+	{"yt", "youtube", func(ctx context.Context, user models.User) (video.SyncResult, error) {
+		return clientVideo().YTGetVideo(ctx, user)
+	}},
+	{"tw", "twitch", func(ctx context.Context, user models.User) (video.SyncResult, error) {
+		return clientVideo().TWGetVideo(ctx, user)
+	}},
+}
+
+// syncPipeline синхронизирует площадки пользователя, потом сверяет новые
+// видео с сохраненными поисками и рассылает уведомления. Общая для
+// планировщика и subvideo sync: only - одна площадка, пустая - все, report
+// получает итог каждой площадки. Отдает первую ошибку
+func syncPipeline(ctx context.Context, user models.User, only string, report func(p syncProvider, result video.SyncResult, err error)) (err error) {
+	var result video.SyncResult
+	for _, p := range syncProviders {
+		if only != "" && only != p.name {
+			continue
+		}
+		start := time.Now()
+		providerResult, providerErr := p.sync(ctx, user)
+		var partial *video.ChannelErrors
+		saved := providerErr == nil || errors.As(providerErr, &partial)
+		monitor.ObserveSync(p.provider, start, len(providerResult.NewVideos), saved, providerErr)
+		status.synced(p.provider, user.UserName, start, providerErr)
+		if providerErr != nil {
+			slog.ErrorContext(logging.WithProvider(ctx, p.provider), "sync failed", "err", providerErr)
+			if err == nil {
+				err = providerErr
+			}
+		}
+		if report != nil {
+			report(p, providerResult, providerErr)
+		}
+		result.NewVideos = append(result.NewVideos, providerResult.NewVideos...)
+		result.WentLive = append(result.WentLive, providerResult.WentLive...)
+	}
+
+	matchSavedSearches(ctx, user, result.NewVideos)
+	notifySync(ctx, user, result)
+	slog.InfoContext(ctx, "sync finished", "new_videos", len(result.NewVideos), "went_live", len(result.WentLive))
+	return err
+}
+
+// cleanup удаляет старые видео и пользователей, которые давно не заходили
+func cleanup() (videos int64, users int, err error) {
+	videos, err = models.Videos.DeleteVideoWhereInterval(config().DeleteVideoInterval)
+	if err != nil {
+		slog.Error("clear videos failed", "err", err)
+		return videos, users, err
+	}
+	users, err = models.Users.DeleteUserWhereInterval(config().DeleteUserInterval)
 	if err != nil {
-		log.Println("ERR YT: ", err)
+		slog.Error("clear users failed", "err", err)
+		return videos, users, err
 	}
-	err = clientVideo.TWGetVideo(user)
+	pruned, err := httpCache.Prune(time.Now().Add(-httpCacheAge))
 	if err != nil {
-		log.Println("ERR TW: ", err)
+		slog.Error("clear upstream cache failed", "err", err)
 	}
+	slog.Info("cleanup finished", "videos", videos, "users", users, "cached_responses", pruned)
+	return videos, users, nil
 }
 
 func runTime() {
 	var err error
 	run := true
 
-	users, err := models.SelectUsers()
+	status.beat("sync", "starting")
+	users, err := models.Users.SelectUsers()
 	if err != nil {
-		log.Println("ERR Users get: ", err)
+		slog.Error("select users failed", "err", err)
 	}
 
-	log.Println("This RUN groutine")
+	slog.Info("sync run", "users", len(users))
 	for _, user := range users {
-
-		err = clientVideo.YTGetVideo(user)
-		if err != nil {
-			log.Println("ERR YT: ", err)
-		}
-		err = clientVideo.TWGetVideo(user)
-		if err != nil {
-			log.Println("ERR TW: ", err)
+		if app.stopped() {
+			return
 		}
+		syncUser(user)
 	}
 
 	for {
 		if time.Now().Minute() == 0 && run {
-			log.Println("RUN groutine")
 			run = false
-			users, err = models.SelectUsers()
+			users, err = models.Users.SelectUsers()
 			if err != nil {
-				log.Println("ERR Users get: ", err)
+				slog.Error("select users failed", "err", err)
 			}
+			slog.Info("sync run", "users", len(users))
 			for _, user := range users {
-				err := clientVideo.YTGetVideo(user)
-				if err != nil {
-					log.Println("ERR YT: ", err)
-				}
-				err = clientVideo.TWGetVideo(user)
-				if err != nil {
-					log.Println("ERR TW: ", err)
+				if app.stopped() {
+					return
 				}
+				syncUser(user)
 			}
+			logCacheStats()
 			if time.Now().Minute() == 0 {
-				err = models.DeleteVideoWhereInterval(config.DeleteVideoInterval)
-				if err != nil {
-					log.Println("ERR Clear Video: ", err)
-				}
-				err = models.DeleteUserWhereInterval(config.DeleteUserInterval)
-				if err != nil {
-					log.Println("ERR Clear Users: ", err)
-				}
+				cleanup()
 			}
 		} else {
 			run = true
 		}
 
-		time.Sleep(time.Second * 30)
-	}
-}
-
-func getConfig(configPath string) (err error) {
-	dat, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return err
-	}
-	err = yaml.Unmarshal(dat, &config)
-	if err != nil {
-		return err
+		status.beat("sync", "waiting")
+		if !app.sleep(time.Second * 30) {
+			return
+		}
 	}
-	return nil
 }
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"strconv"
+)
+
+// Stats общая статистика для администратора
+type Stats struct {
+	Users         int
+	DisabledUsers int
+	Videos        int
+	DBSize        string
+}
+
+func SelectStats() (stats Stats, err error) {
+	results, err := x.QueryString(
+		"SELECT (SELECT count(*) FROM \"user\") AS users, "+
+			"(SELECT count(*) FROM \"user\" WHERE disabled = ?) AS disabled, "+
+			"(SELECT count(*) FROM subvideo) AS videos",
+		true,
+	)
+	if err != nil {
+		return stats, err
+	}
+	stats.Users, _ = strconv.Atoi(results[0]["users"])
+	stats.DisabledUsers, _ = strconv.Atoi(results[0]["disabled"])
+	stats.Videos, _ = strconv.Atoi(results[0]["videos"])
+	stats.DBSize, err = sqlDialect.size()
+	return stats, err
+}
+
+// CountVideosByUser число видео у каждого пользователя
+func (s sqlStore) CountVideosByUser() (counts map[int64]int, err error) {
+	counts = map[int64]int{}
+	results, err := x.QueryString("SELECT user_id, count(*) AS count FROM subvideo GROUP BY user_id")
+	if err != nil {
+		return counts, err
+	}
+	for _, row := range results {
+		userID, _ := strconv.ParseInt(row["user_id"], 10, 64)
+		counts[userID], _ = strconv.Atoi(row["count"])
+	}
+	return counts, nil
+}
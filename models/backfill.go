@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+)
+
+// Состояния загрузки истории
+const (
+	BackfillRunning = "running"
+	BackfillDone    = "done"
+	BackfillFailed  = "failed"
+)
+
+// Backfill загрузка истории видео после первой привязки площадки. Хранит
+// место, где остановилась, чтобы продолжить после перезапуска: для YouTube
+// список каналов и сколько из них пройдено, для Twitch сдвиг в ленте
+// videos/followed. Done из Total - прогресс: каналы YouTube или часы
+// истории Twitch
+type Backfill struct {
+	Id        int64
+	UserID    int64     `xorm:"notnull unique(backfill) 'user_id'"`
+	Provider  string    `xorm:"notnull unique(backfill) 'provider'"`
+	Status    string    `xorm:"notnull index 'status'"`
+	Channels  string    `xorm:"text 'channels'"`
+	Offset    int       `xorm:"'page_offset'"`
+	Total     int       `xorm:"'total'"`
+	Done      int       `xorm:"'done'"`
+	Videos    int       `xorm:"'videos'"`
+	Error     string    `xorm:"text 'error'"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+}
+
+// Percent прогресс в процентах
+func (backfill Backfill) Percent() int {
+	if backfill.Total == 0 {
+		return 0
+	}
+	return min(100, backfill.Done*100/backfill.Total)
+}
+
+// StartBackfill ставит загрузку истории, если для этой площадки
+// пользователя ее еще не было. started - задача новая
+func StartBackfill(userID int64, provider string) (started bool, err error) {
+	exist, err := x.Exist(&Backfill{UserID: userID, Provider: provider})
+	if err != nil || exist {
+		return false, err
+	}
+	_, err = x.Insert(&Backfill{UserID: userID, Provider: provider, Status: BackfillRunning})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SelectRunningBackfills незаконченные загрузки истории всех пользователей
+func SelectRunningBackfills() (backfills []Backfill, err error) {
+	err = x.Where("status = ?", BackfillRunning).Asc("id").Find(&backfills)
+	return backfills, err
+}
+
+// SelectBackfills загрузки истории пользователя, которые сейчас идут
+func SelectBackfills(userID int64) (backfills []Backfill, err error) {
+	err = x.Where("user_id = ? AND status = ?", userID, BackfillRunning).Asc("provider").Find(&backfills)
+	return backfills, err
+}
+
+// Save сохраняет прогресс
+func (backfill *Backfill) Save() error {
+	_, err := x.ID(backfill.Id).Cols("status", "channels", "page_offset", "total", "done", "videos", "error").Update(backfill)
+	return err
+}
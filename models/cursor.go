@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+)
+
+// SyncCursor последнее видео канала, которое уже видела синхронизация.
+// Следующая синхронизация забирает только то, что вышло после него
+type SyncCursor struct {
+	Id          int64
+	UserID      int64     `xorm:"notnull unique(sync_cursor) 'user_id'"`
+	Provider    string    `xorm:"notnull unique(sync_cursor) 'provider'"`
+	ChannelID   string    `xorm:"notnull unique(sync_cursor) 'channel_id'"`
+	VideoID     string    `xorm:"'video_id'"`
+	PublishedAt time.Time `xorm:"'published_at'"`
+	UpdatedAt   time.Time `xorm:"updated"`
+}
+
+// SelectSyncCursors курсоры пользователя на площадке по ID канала
+func SelectSyncCursors(userID int64, provider string) (cursors map[string]SyncCursor, err error) {
+	var list []SyncCursor
+	err = x.Where("user_id = ? AND provider = ?", userID, provider).Find(&list)
+	if err != nil {
+		return cursors, err
+	}
+	cursors = make(map[string]SyncCursor, len(list))
+	for _, cursor := range list {
+		cursors[cursor.ChannelID] = cursor
+	}
+	return cursors, nil
+}
+
+// Save создает курсор канала или сдвигает существующий
+func (cursor *SyncCursor) Save() (err error) {
+	existing := SyncCursor{UserID: cursor.UserID, Provider: cursor.Provider, ChannelID: cursor.ChannelID}
+	b, err := x.Get(&existing)
+	if err != nil {
+		return err
+	}
+	if b == false {
+		_, err = x.Insert(cursor)
+		return err
+	}
+	cursor.Id = existing.Id
+	_, err = x.ID(cursor.Id).Cols("video_id", "published_at").Update(cursor)
+	return err
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Периодичность дайджеста
+const (
+	DigestOff    = ""
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// Digest настройки письма с пропущенными видео, Hour и Weekday в часовом поясе пользователя
+type Digest struct {
+	Id         int64
+	UserID     int64     `xorm:"notnull unique 'user_id'"`
+	Email      string    `xorm:"'email'"`
+	Frequency  string    `xorm:"'frequency'"`
+	Hour       int       `xorm:"'hour'"`
+	Weekday    int       `xorm:"'weekday'"`
+	LastSentAt time.Time `xorm:"'last_sent_at'"`
+	CreatedAt  time.Time `xorm:"created"`
+}
+
+// DigestChannel видео одного канала в дайджесте
+type DigestChannel struct {
+	Channel   string
+	ChannelID string
+	TypeSub   string
+	Videos    []Subvideo
+}
+
+// Save сохраняет настройки, нулевые значения тоже, поэтому через Cols
+func (digest *Digest) Save() (err error) {
+	digest.Email = strings.TrimSpace(digest.Email)
+	switch digest.Frequency {
+	case DigestOff, DigestDaily, DigestWeekly:
+	default:
+		return errors.New("Неизвестная периодичность: " + digest.Frequency)
+	}
+	if digest.Frequency != DigestOff {
+		_, err = mail.ParseAddress(digest.Email)
+		if err != nil {
+			return errors.New("Неверный адрес почты: " + digest.Email)
+		}
+	}
+	if digest.Hour < 0 || digest.Hour > 23 || digest.Weekday < 0 || digest.Weekday > 6 {
+		return errors.New("Неверное время отправки")
+	}
+
+	var old Digest
+	b, err := x.Where("user_id = ?", digest.UserID).Get(&old)
+	if err != nil {
+		return err
+	}
+	if b == false {
+		_, err = x.Insert(digest)
+		return err
+	}
+	digest.Id = old.Id
+	digest.LastSentAt = old.LastSentAt
+	_, err = x.ID(digest.Id).Cols("email", "frequency", "hour", "weekday").Update(digest)
+	return err
+}
+
+func (digest Digest) Sent(at time.Time) (err error) {
+	digest.LastSentAt = at.UTC()
+	_, err = x.ID(digest.Id).Cols("last_sent_at").Update(&digest)
+	return err
+}
+
+// Period сколько времени покрывает один дайджест
+func (digest Digest) Period() time.Duration {
+	if digest.Frequency == DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Since с какого момента брать видео: с прошлого письма или за один период
+func (digest Digest) Since(now time.Time) time.Time {
+	if digest.LastSentAt.IsZero() {
+		return now.Add(-digest.Period())
+	}
+	return digest.LastSentAt
+}
+
+// Due пора ли отправлять: наступил час отправки в поясе loc и за этот период
+// письма еще не было
+func (digest Digest) Due(now time.Time, loc *time.Location) bool {
+	if digest.Frequency == DigestOff {
+		return false
+	}
+	local := now.In(loc)
+	if local.Hour() != digest.Hour {
+		return false
+	}
+	if digest.Frequency == DigestWeekly && int(local.Weekday()) != digest.Weekday {
+		return false
+	}
+	return now.Sub(digest.LastSentAt) > digest.Period()-2*time.Hour
+}
+
+func SelectDigest(userID int64) (digest Digest, err error) {
+	_, err = x.Where("user_id = ?", userID).Get(&digest)
+	digest.UserID = userID
+	return digest, err
+}
+
+func SelectActiveDigests() (digests []Digest, err error) {
+	err = x.Where("frequency <> ''").Find(&digests)
+	return digests, err
+}
+
+// SelectDigestVideo последние n видео, добавленных после since, по
+// каналам, с учетом правил скрытия пользователя. count - сколько их всего,
+// может быть больше, чем попало в письмо
+func SelectDigestVideo(user User, since time.Time, n int) (channels []DigestChannel, count int, err error) {
+	where := "user_id = ? AND created_at > ? AND NOT backfilled AND type <> 'youtube-stream'"
+	args := []interface{}{user.Id, since.UTC()}
+	if !user.ShowHidden {
+		where, args, err = withFilters(user.Id, where, args)
+		if err != nil {
+			return channels, count, err
+		}
+	}
+
+	// сначала самые новые, иначе лимит целиком отрезает каналы в конце алфавита
+	var subvideos []Subvideo
+	err = x.Where(where, args...).
+		Desc("date").
+		Limit(n).
+		Find(&subvideos)
+	if err != nil {
+		return channels, count, err
+	}
+	countS, err := x.QueryString(append([]interface{}{"SELECT count(*) AS count FROM subvideo WHERE " + where}, args...)...)
+	if err != nil {
+		return channels, count, err
+	}
+	count, err = strconv.Atoi(countS[0]["count"])
+	if err != nil {
+		return channels, count, err
+	}
+
+	sort.SliceStable(subvideos, func(i, j int) bool {
+		if subvideos[i].Channel != subvideos[j].Channel {
+			return subvideos[i].Channel < subvideos[j].Channel
+		}
+		return subvideos[i].ChannelID < subvideos[j].ChannelID
+	})
+	for _, subvideo := range subvideos {
+		last := len(channels) - 1
+		if last < 0 || channels[last].ChannelID != subvideo.ChannelID {
+			channels = append(channels, DigestChannel{
+				Channel:   subvideo.Channel,
+				ChannelID: subvideo.ChannelID,
+				TypeSub:   subvideo.TypeSub,
+			})
+			last++
+		}
+		channels[last].Videos = append(channels[last].Videos, subvideo)
+	}
+	return channels, count, nil
+}
@@ -0,0 +1,9 @@
+package models
+
+import "errors"
+
+// ErrNotFound запись не найдена, обработчики отвечают на нее 404
+var ErrNotFound = errors.New("not found")
+
+// ErrUserExists пользователь с таким именем уже есть
+var ErrUserExists = errors.New("user already exists")
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"github.com/go-xorm/xorm"
+)
+
+// UserDump все данные пользователя для export и import
+type UserDump struct {
+	User              User
+	Filters           []Filter
+	Groups            []GroupDump
+	SavedSearches     []SavedSearch
+	NotifyRules       []NotifyRule
+	Digest            *Digest            `json:",omitempty"`
+	Telegram          *TelegramLink      `json:",omitempty"`
+	PushSubscriptions []PushSubscription `json:",omitempty"`
+	Videos            []Subvideo         `json:",omitempty"`
+}
+
+type GroupDump struct {
+	Group    Group
+	Channels []GroupChannel
+}
+
+// DumpUser собирает данные пользователя, videos - вместе с видео.
+// Служебные поля GroupChannel в JSON скрыты, связи с группой
+// восстанавливаются по вложенности
+func DumpUser(user User, videos bool) (dump UserDump, err error) {
+	dump.User = user
+	err = x.Where("user_id = ?", user.Id).Asc("id").Find(&dump.Filters)
+	if err != nil {
+		return dump, err
+	}
+	var groups []Group
+	err = x.Where("user_id = ?", user.Id).Asc("id").Find(&groups)
+	if err != nil {
+		return dump, err
+	}
+	for _, group := range groups {
+		channels, err := SelectGroupChannels(group.Id)
+		if err != nil {
+			return dump, err
+		}
+		dump.Groups = append(dump.Groups, GroupDump{Group: group, Channels: channels})
+	}
+	err = x.Where("user_id = ?", user.Id).Asc("id").Find(&dump.SavedSearches)
+	if err != nil {
+		return dump, err
+	}
+	err = x.Where("user_id = ?", user.Id).Asc("id").Find(&dump.NotifyRules)
+	if err != nil {
+		return dump, err
+	}
+	digest := Digest{UserID: user.Id}
+	b, err := x.Get(&digest)
+	if err != nil {
+		return dump, err
+	}
+	if b {
+		dump.Digest = &digest
+	}
+	link := TelegramLink{UserID: user.Id}
+	b, err = x.Get(&link)
+	if err != nil {
+		return dump, err
+	}
+	if b && link.ChatID != 0 {
+		dump.Telegram = &link
+	}
+	dump.PushSubscriptions, err = SelectPushSubscriptions(user.Id)
+	if err != nil {
+		return dump, err
+	}
+	if videos {
+		err = x.Where("user_id = ?", user.Id).Asc("id").Find(&dump.Videos)
+		if err != nil {
+			return dump, err
+		}
+	}
+	return dump, nil
+}
+
+// RestoreUser создает пользователя из выгрузки одной транзакцией.
+// Идентификаторы выдаются заново, группы в правилах уведомлений
+// переназначаются на новые. Пользователь с тем же именем удаляется
+// при replace, иначе возвращается ErrUserExists
+func RestoreUser(dump UserDump, replace bool) (user User, err error) {
+	// выгрузка могла прийти из базы другого вида, чье правило эта не выполнит
+	for _, filter := range dump.Filters {
+		err = filter.Validate()
+		if err != nil {
+			return user, err
+		}
+	}
+	session := x.NewSession()
+	defer session.Close()
+	err = session.Begin()
+	if err != nil {
+		return user, err
+	}
+	user, err = restoreUser(session, dump, replace)
+	if err != nil {
+		session.Rollback()
+		return user, err
+	}
+	return user, session.Commit()
+}
+
+func restoreUser(session *xorm.Session, dump UserDump, replace bool) (user User, err error) {
+	var existing User
+	b, err := session.Where("username = ?", dump.User.UserName).Get(&existing)
+	if err != nil {
+		return user, err
+	}
+	if b && !replace {
+		return user, ErrUserExists
+	}
+	if b {
+		err = deleteUser(session, existing.Id)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	user = dump.User
+	user.Id = 0
+	_, err = session.Insert(&user)
+	if err != nil {
+		return user, err
+	}
+
+	for _, filter := range dump.Filters {
+		filter.Id, filter.UserID = 0, user.Id
+		_, err = session.Insert(&filter)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	groupIDs := map[int64]int64{}
+	for _, groupDump := range dump.Groups {
+		group := groupDump.Group
+		oldID := group.Id
+		group.Id, group.UserID = 0, user.Id
+		_, err = session.Insert(&group)
+		if err != nil {
+			return user, err
+		}
+		groupIDs[oldID] = group.Id
+		for _, channel := range groupDump.Channels {
+			channel.Id, channel.GroupID, channel.UserID = 0, group.Id, user.Id
+			_, err = session.Insert(&channel)
+			if err != nil {
+				return user, err
+			}
+		}
+	}
+
+	for _, search := range dump.SavedSearches {
+		search.Id, search.UserID = 0, user.Id
+		_, err = session.Insert(&search)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	for _, rule := range dump.NotifyRules {
+		rule.Id, rule.UserID = 0, user.Id
+		if rule.GroupID != 0 {
+			rule.GroupID = groupIDs[rule.GroupID]
+		}
+		_, err = session.Insert(&rule)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if dump.Digest != nil {
+		digest := *dump.Digest
+		digest.Id, digest.UserID = 0, user.Id
+		_, err = session.Insert(&digest)
+		if err != nil {
+			return user, err
+		}
+	}
+	if dump.Telegram != nil {
+		link := TelegramLink{UserID: user.Id, ChatID: dump.Telegram.ChatID}
+		_, err = session.Insert(&link)
+		if err != nil {
+			return user, err
+		}
+	}
+	for _, sub := range dump.PushSubscriptions {
+		sub.Id, sub.UserID = 0, user.Id
+		_, err = session.Insert(&sub)
+		if err != nil {
+			return user, err
+		}
+	}
+	for _, video := range dump.Videos {
+		video.Id, video.UserID = 0, user.Id
+		_, err = session.Insert(&video)
+		if err != nil {
+			return user, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Виды правил скрытия видео
+const (
+	FilterChannel     = "channel"
+	FilterTitle       = "title"
+	FilterDescription = "description"
+	FilterGame        = "game"
+	FilterMinLength   = "min_length"
+	FilterMaxLength   = "max_length"
+	FilterType        = "type"
+)
+
+// FilterTypes типы видео, которые можно скрыть правилом FilterType
+var FilterTypes = []string{"twitch", "youtube", "youtube-stream", "youtube-stream-live"}
+
+type Filter struct {
+	Id        int64
+	UserID    int64     `xorm:"notnull index 'user_id'"`
+	Kind      string    `xorm:"notnull 'kind'"`
+	Value     string    `xorm:"notnull 'value'"`
+	Comment   string    `xorm:"'comment'"`
+	CreatedAt time.Time `xorm:"created"`
+}
+
+// Validate проверяет правило, регулярные выражения - еще и самой базой
+func (filter Filter) Validate() error {
+	switch filter.Kind {
+	case FilterChannel, FilterGame:
+		if strings.TrimSpace(filter.Value) == "" {
+			return errors.New("Пустое значение правила")
+		}
+	case FilterTitle, FilterDescription:
+		if filter.Value == "" {
+			return errors.New("Пустое регулярное выражение")
+		}
+		_, err := regexp.Compile(filter.Value)
+		if err != nil {
+			return err
+		}
+		// выражение выполняет база, а синтаксис регулярных выражений
+		// Postgres не совпадает с Go: (?P<n>x) или \z он не примет
+		_, err = x.QueryString("SELECT "+sqlDialect.iregexp("''")+" AS ok", filter.Value)
+		if err != nil {
+			return errors.New("База не понимает это регулярное выражение: " + filter.Value)
+		}
+	case FilterMinLength, FilterMaxLength:
+		length, err := strconv.Atoi(filter.Value)
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			return errors.New("Длина не может быть отрицательной")
+		}
+	case FilterType:
+		for _, typeSub := range FilterTypes {
+			if typeSub == filter.Value {
+				return nil
+			}
+		}
+		return errors.New("Неизвестный тип видео: " + filter.Value)
+	default:
+		return errors.New("Неизвестный вид правила: " + filter.Kind)
+	}
+	return nil
+}
+
+func (filter Filter) Insert() (err error) {
+	err = filter.Validate()
+	if err != nil {
+		return err
+	}
+	b, err := x.Get(&Filter{UserID: filter.UserID, Kind: filter.Kind, Value: filter.Value})
+	if err != nil {
+		return err
+	}
+	if b == false {
+		_, err = x.Insert(&filter)
+	}
+	return err
+}
+
+func SelectFilters(userID int64) (filters []Filter, err error) {
+	err = x.Where("user_id = ?", userID).
+		Asc("kind", "id").
+		Find(&filters)
+	return filters, err
+}
+
+// SelectMutedChannels каналы, скрытые правилами FilterChannel: их видео и
+// стримы не попадают и в уведомления
+func SelectMutedChannels(userID int64) (muted map[string]bool, err error) {
+	var filters []Filter
+	err = x.Where("user_id = ? AND kind = ?", userID, FilterChannel).Find(&filters)
+	if err != nil {
+		return muted, err
+	}
+	muted = map[string]bool{}
+	for _, filter := range filters {
+		muted[filter.Value] = true
+	}
+	return muted, nil
+}
+
+func DeleteFilter(id, userID int64) (err error) {
+	_, err = x.Where("id = ? AND user_id = ?", id, userID).Delete(&Filter{})
+	return err
+}
+
+// lengthTypes типы, к которым применяются правила длины. У анонсов и идущих
+// стримов длины еще нет, правило "короче чем" скрывало бы их все
+const lengthTypes = "('youtube', 'twitch')"
+
+// filterCondition собирает условие, которое отбрасывает видео, попавшие
+// под любое из правил пользователя. Пустая строка - правил нет.
+func filterCondition(userID int64) (condition string, args []interface{}, err error) {
+	filters, err := SelectFilters(userID)
+	if err != nil {
+		return condition, args, err
+	}
+
+	var rules []string
+	for _, filter := range filters {
+		switch filter.Kind {
+		case FilterChannel:
+			rules = append(rules, "channel_id = ?")
+			args = append(args, filter.Value)
+		case FilterTitle:
+			rules = append(rules, sqlDialect.iregexp("coalesce(title, '')"))
+			args = append(args, filter.Value)
+		case FilterDescription:
+			rules = append(rules, sqlDialect.iregexp("coalesce(description, '')"))
+			args = append(args, filter.Value)
+		case FilterGame:
+			rules = append(rules, sqlDialect.iequal("coalesce(game, '')"))
+			args = append(args, filter.Value)
+		case FilterMinLength:
+			length, _ := strconv.Atoi(filter.Value)
+			rules = append(rules, "(type IN "+lengthTypes+" AND length < ?)")
+			args = append(args, length)
+		case FilterMaxLength:
+			length, _ := strconv.Atoi(filter.Value)
+			rules = append(rules, "(type IN "+lengthTypes+" AND length > ?)")
+			args = append(args, length)
+		case FilterType:
+			rules = append(rules, "type = ?")
+			args = append(args, filter.Value)
+		}
+	}
+	if len(rules) == 0 {
+		return "", nil, nil
+	}
+
+	return "NOT (" + strings.Join(rules, " OR ") + ")", args, nil
+}
+
+// withFilters дописывает к условию выборки правила скрытия пользователя
+func withFilters(userID int64, where string, args []interface{}) (string, []interface{}, error) {
+	condition, filterArgs, err := filterCondition(userID)
+	if err != nil {
+		return where, args, err
+	}
+	if condition == "" {
+		return where, args, nil
+	}
+	return where + " AND " + condition, append(args, filterArgs...), nil
+}
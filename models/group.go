@@ -0,0 +1,118 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Group struct {
+	Id        int64
+	UserID    int64     `xorm:"notnull index 'user_id'"`
+	Name      string    `xorm:"notnull 'name'"`
+	CreatedAt time.Time `xorm:"created"`
+}
+
+type GroupChannel struct {
+	Id        int64     `json:"-"`
+	GroupID   int64     `xorm:"notnull index 'group_id'" json:"-"`
+	UserID    int64     `xorm:"notnull index 'user_id'" json:"-"`
+	ChannelID string    `xorm:"notnull 'channel_id'" json:"channel_id"`
+	Channel   string    `xorm:"'channel'" json:"channel"`
+	Platform  string    `xorm:"'platform'" json:"platform"`
+	CreatedAt time.Time `xorm:"created" json:"-"`
+}
+
+// Channel канал из подписок пользователя, собранный по его видео
+type Channel struct {
+	ChannelID string `xorm:"'channel_id'" json:"channel_id"`
+	Channel   string `xorm:"'channel'" json:"channel"`
+	Platform  string `xorm:"'platform'" json:"platform"`
+}
+
+func (Group) TableName() string {
+	return "channel_group"
+}
+
+func (group *Group) Insert() (err error) {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return errors.New("Пустое название группы")
+	}
+	_, err = x.Insert(group)
+	return err
+}
+
+func SelectGroups(userID int64) (groups []Group, err error) {
+	err = x.Where("user_id = ?", userID).
+		Asc("name").
+		Find(&groups)
+	return groups, err
+}
+
+func SelectGroup(id, userID int64) (group Group, err error) {
+	b, err := x.Where("id = ? AND user_id = ?", id, userID).Get(&group)
+	if err != nil {
+		return group, err
+	}
+	if b == false {
+		return group, ErrNotFound
+	}
+	return group, nil
+}
+
+func DeleteGroup(id, userID int64) (err error) {
+	_, err = x.Where("group_id = ? AND user_id = ?", id, userID).Delete(&GroupChannel{})
+	if err != nil {
+		return err
+	}
+	_, err = x.Where("id = ? AND user_id = ?", id, userID).Delete(&Group{})
+	return err
+}
+
+func (groupChannel GroupChannel) Insert() (err error) {
+	b, err := x.Get(&GroupChannel{GroupID: groupChannel.GroupID, ChannelID: groupChannel.ChannelID})
+	if err != nil {
+		return err
+	}
+	if b == false {
+		_, err = x.Insert(&groupChannel)
+	}
+	return err
+}
+
+func SelectGroupChannels(groupID int64) (channels []GroupChannel, err error) {
+	err = x.Where("group_id = ?", groupID).
+		Asc("platform", "channel").
+		Find(&channels)
+	return channels, err
+}
+
+func DeleteGroupChannel(groupID, userID int64, channelID string) (err error) {
+	_, err = x.Where("group_id = ? AND user_id = ? AND channel_id = ?", groupID, userID, channelID).Delete(&GroupChannel{})
+	return err
+}
+
+// SelectChannels отдает все каналы, видео которых есть у пользователя
+func (s sqlStore) SelectChannels(userID int64) (channels []Channel, err error) {
+	err = x.SQL("SELECT channel_id, channel, platform FROM ("+
+		"SELECT channel_id, channel, "+
+		"CASE WHEN type LIKE 'twitch%' THEN 'twitch' ELSE 'youtube' END AS platform, "+
+		"row_number() OVER (PARTITION BY channel_id ORDER BY date DESC) AS n "+
+		"FROM subvideo WHERE user_id = ?) AS latest WHERE n = 1", userID).
+		Find(&channels)
+	if err != nil {
+		return channels, err
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return strings.ToLower(channels[i].Channel) < strings.ToLower(channels[j].Channel)
+	})
+	return channels, nil
+}
+
+func (s sqlStore) SelectGroupVideo(userID int, groupID int64, n, page int, showHidden bool) (subvideos []Subvideo, countVideos int, err error) {
+	where := "user_id = ? AND channel_id IN (SELECT channel_id FROM group_channel WHERE group_id = ?)"
+	args := []interface{}{userID, groupID}
+	return selectVideoWhere(int64(userID), where, args, n, page, showHidden)
+}
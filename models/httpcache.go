@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+)
+
+// HTTPCache сохраненный ответ API площадки для условных запросов. Key -
+// хэш адреса и пользователя, Value - ответ в формате пакета upstream
+type HTTPCache struct {
+	Id        int64
+	Key       string    `xorm:"notnull unique 'cache_key'"`
+	Value     []byte    `xorm:"blob 'value'"`
+	UpdatedAt time.Time `xorm:"index 'updated_at'"`
+}
+
+func GetHTTPCache(key string) (value []byte, err error) {
+	var cache HTTPCache
+	b, err := x.Where("cache_key = ?", key).Get(&cache)
+	if err != nil {
+		return nil, err
+	}
+	if b == false {
+		return nil, ErrNotFound
+	}
+	return cache.Value, nil
+}
+
+func SetHTTPCache(key string, value []byte) (err error) {
+	cache := HTTPCache{Key: key, Value: value, UpdatedAt: time.Now()}
+	n, err := x.Where("cache_key = ?", key).Cols("value", "updated_at").Update(&cache)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = x.Insert(&cache)
+	return err
+}
+
+// DeleteHTTPCacheBefore удаляет ответы, которые давно не запрашивались
+func DeleteHTTPCacheBefore(before time.Time) (count int64, err error) {
+	return x.Where("updated_at < ?", before).Delete(&HTTPCache{})
+}
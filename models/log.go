@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"xorm.io/core"
+)
+
+// sqlLogger передает журнал xorm в slog, SQL пишется на уровне debug
+type sqlLogger struct {
+	showSQL bool
+}
+
+func (l *sqlLogger) log(level slog.Level, msg string) {
+	slog.Log(context.Background(), level, msg, "component", "db")
+}
+
+func (l *sqlLogger) Debug(v ...interface{}) { l.log(slog.LevelDebug, fmt.Sprint(v...)) }
+func (l *sqlLogger) Debugf(format string, v ...interface{}) {
+	l.log(slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+func (l *sqlLogger) Info(v ...interface{}) { l.log(slog.LevelDebug, fmt.Sprint(v...)) }
+func (l *sqlLogger) Infof(format string, v ...interface{}) {
+	l.log(slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+func (l *sqlLogger) Warn(v ...interface{}) { l.log(slog.LevelWarn, fmt.Sprint(v...)) }
+func (l *sqlLogger) Warnf(format string, v ...interface{}) {
+	l.log(slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+func (l *sqlLogger) Error(v ...interface{}) { l.log(slog.LevelError, fmt.Sprint(v...)) }
+func (l *sqlLogger) Errorf(format string, v ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l *sqlLogger) Level() core.LogLevel {
+	if l.showSQL {
+		return core.LOG_DEBUG
+	}
+	return core.LOG_WARNING
+}
+
+func (l *sqlLogger) SetLevel(level core.LogLevel) {}
+
+func (l *sqlLogger) ShowSQL(show ...bool) {
+	l.showSQL = len(show) == 0 || show[0]
+}
+
+func (l *sqlLogger) IsShowSQL() bool {
+	return l.showSQL
+}
@@ -1,10 +1,12 @@
 package models
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"log/slog"
 
 	"github.com/go-xorm/xorm"
-	_ "github.com/lib/pq"
 )
 
 var (
@@ -12,63 +14,77 @@ var (
 	err error
 )
 
-func Init(host, port, username, password, dbname string) (err error) {
-	pgurl := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", username, password, host, port, dbname)
-	x, err = xorm.NewEngine("postgres", pgurl)
+// tables все таблицы приложения, Migrate создает их, Ready проверяет
+var tables = []interface{}{
+	new(User),
+	new(Subvideo),
+	new(Filter),
+	new(Group), new(GroupChannel),
+	new(SavedSearch),
+	new(NotifyRule), new(NotifyDelivery),
+	new(TelegramLink),
+	new(PushSubscription),
+	new(Digest),
+	new(SyncCursor),
+	new(Backfill),
+	new(HTTPCache),
+}
+
+// Init подключается к базе, таблицы не трогает. driver - postgres или
+// sqlite, source - строка подключения Postgres или путь к файлу SQLite
+func Init(driver, source string) (err error) {
+	switch driver {
+	case "postgres":
+		sqlDialect = postgres{}
+		x, err = xorm.NewEngine("postgres", source)
+	case "sqlite":
+		sqlDialect = sqlite{}
+		x, err = xorm.NewEngine(sqliteDriver, sqliteSource(source))
+	default:
+		return fmt.Errorf("unknown database driver %q", driver)
+	}
 	if err != nil {
 		return err
 	}
-	// x.ShowSQL(true)
-	err = x.Sync(new(User))
+	x.SetLogger(&sqlLogger{})
+	x.ShowSQL(slog.Default().Enabled(context.Background(), slog.LevelDebug))
+	return nil
+}
+
+// Migrate создает и обновляет таблицы, индексы и функции базы. Вызывается
+// из subvideo migrate и при запуске сервера, остальные команды только
+// проверяют базу через Ready
+func Migrate() (err error) {
+	err = x.Sync(tables...)
 	if err != nil {
 		return err
 	}
-	err = x.Sync(new(Subvideo))
+	err = migrateTelegram()
 	if err != nil {
 		return err
 	}
+	return sqlDialect.migrate()
+}
 
-	results, err := x.Query("SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = ? AND column_name = ?", "subvideo", "tsv")
+// Ready проверяет, что база доступна и все миграции применены
+func Ready(ctx context.Context) (err error) {
+	err = x.PingContext(ctx)
 	if err != nil {
 		return err
 	}
-	if len(results) == 0 {
-		_, err = x.Exec("ALTER TABLE subvideo ADD COLUMN tsv tsvector")
+	for _, table := range tables {
+		exist, err := x.IsTableExist(table)
 		if err != nil {
 			return err
 		}
-		_, err = x.Exec("UPDATE subvideo SET tsv = " +
-			"setweight(to_tsvector(coalesce(title, '')), 'A') ||" +
-			"setweight(to_tsvector(coalesce(channel, '')), 'B') ||" +
-			"setweight(to_tsvector(coalesce(game, '')), 'C') ||" +
-			"setweight(to_tsvector(coalesce(description, '')), 'D')")
-		if err != nil {
-			return err
-		}
-		_, err = x.Exec("CREATE INDEX ix_subvideo_tsv ON subvideo USING GIN(tsv)")
-		if err != nil {
-			return err
+		if !exist {
+			return fmt.Errorf("table %s is missing", x.TableName(table))
 		}
-		_, err = x.Exec(
-			`CREATE FUNCTION subvideo_trigger() RETURNS trigger AS $$
-			begin
-				new.tsv :=
-				setweight(to_tsvector(coalesce(new.title, '')),
-					'A') ||
-				setweight(to_tsvector(coalesce(new.channel, '')),
-						'B') ||
-				setweight(to_tsvector(coalesce(new.game, '')),
-						'C') ||
-				setweight(to_tsvector(coalesce(new.description, '')),
-						'D');
-				return new;
-			end
-			$$ LANGUAGE plpgsql;
-
-			CREATE TRIGGER tsvectorupdate BEFORE INSERT OR UPDATE
-			ON subvideo FOR EACH ROW EXECUTE PROCEDURE subvideo_trigger();`,
-		)
 	}
+	return sqlDialect.ready(ctx)
+}
 
-	return nil
+// DB пул соединений для статистики
+func DB() *sql.DB {
+	return x.DB().DB
 }
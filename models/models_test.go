@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// openTestDB база с таблицами и пользователь в ней
+func openTestDB(t *testing.T, driver, source string) User {
+	t.Helper()
+	err := Init(driver, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { x.Close() })
+	err = Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{UserName: "tester"}
+	err = user.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = Users.SelectUserForUserName("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func insertVideos(t *testing.T, user User, videos []Subvideo) {
+	t.Helper()
+	for i, video := range videos {
+		video.UserID = user.Id
+		video.VideoID = video.ChannelID + "-" + video.Title
+		video.URL = "https://example.com/" + video.VideoID
+		if video.Language == "" {
+			video.Language = "en"
+		}
+		inserted, err := video.Insert(context.Background())
+		if err != nil || !inserted {
+			t.Fatalf("insert video %d: %v, %v", i, inserted, err)
+		}
+	}
+}
+
+func testVideos(t *testing.T, user User) {
+	t.Helper()
+	insertVideos(t, user, []Subvideo{
+		{TypeSub: "youtube", Title: "Dark Souls boss fight", Channel: "Ёжик", ChannelID: "UC1", Game: "Dark Souls",
+			Description: "The hardest boss in the game", Length: 3600, Date: testNow.Add(-time.Hour)},
+		{TypeSub: "youtube", Title: "Baking bread at home", Channel: "Ёжик", ChannelID: "UC1",
+			Description: "Sourdough, no boss involved", Length: 600, Date: testNow.Add(-2 * time.Hour)},
+		{TypeSub: "twitch", Title: "Raid night", Channel: "Streamer_1", ChannelID: "42", Game: "World of Warcraft",
+			Description: "Boss progression", Length: 14400, Date: testNow.Add(-3 * time.Hour)},
+		{TypeSub: "twitch-stream", Title: "Live raid", Channel: "Streamer_1", ChannelID: "42", Game: "World of Warcraft",
+			Date: testNow.Add(-10 * time.Minute)},
+		{TypeSub: "youtube", Title: "100% speedrun", Channel: "Runner", ChannelID: "UC2", Game: "Celeste",
+			Length: 1800, Date: testNow.Add(-24 * time.Hour)},
+	})
+}
+
+func searchTitles(t *testing.T, user User, search string, showHidden bool) []string {
+	t.Helper()
+	query, err := ParseSearchQuery(search, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, count, err := Videos.SearchVideo(query, int(user.Id), 50, 1, showHidden)
+	if err != nil {
+		t.Fatalf("SearchVideo(%q): %v", search, err)
+	}
+	if count != len(results) {
+		t.Errorf("SearchVideo(%q) count = %d, got %d results", search, count, len(results))
+	}
+	titles := []string{}
+	for _, result := range results {
+		titles = append(titles, result.Title)
+	}
+	return titles
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Статусы доставки уведомлений
+const (
+	DeliveryPending = "pending"
+	DeliveryOK      = "ok"
+	DeliveryFailed  = "failed"
+)
+
+type NotifyRule struct {
+	Id        int64
+	UserID    int64     `xorm:"notnull index 'user_id'"`
+	Backend   string    `xorm:"notnull 'backend'"`
+	Target    string    `xorm:"notnull 'target'"`
+	Event     string    `xorm:"'event'"`
+	ChannelID string    `xorm:"'channel_id'"`
+	GroupID   int64     `xorm:"'group_id'"`
+	TypeSub   string    `xorm:"'type'"`
+	Keyword   string    `xorm:"'keyword'"`
+	CreatedAt time.Time `xorm:"created"`
+}
+
+type NotifyDelivery struct {
+	Id        int64
+	RuleID    int64     `xorm:"notnull index 'rule_id'"`
+	UserID    int64     `xorm:"notnull index 'user_id'"`
+	Backend   string    `xorm:"'backend'"`
+	Target    string    `xorm:"'target'"`
+	EventKey  string    `xorm:"index 'event_key'"`
+	Title     string    `xorm:"'title'"`
+	Payload   string    `xorm:"text 'payload'"`
+	Status    string    `xorm:"index 'status'"`
+	Attempts  int       `xorm:"'attempts'"`
+	Error     string    `xorm:"text 'error'"`
+	NextTryAt time.Time `xorm:"'next_try_at'"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+}
+
+func (rule *NotifyRule) Insert() (err error) {
+	rule.Target = strings.TrimSpace(rule.Target)
+	switch rule.Backend {
+	case "webhook":
+		u, err := url.Parse(rule.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Нужен http или https адрес: " + rule.Target)
+		}
+	case "email":
+		_, err := mail.ParseAddress(rule.Target)
+		if err != nil {
+			return errors.New("Неверный адрес почты: " + rule.Target)
+		}
+	case "telegram":
+		// слать можно только в свой привязанный чат
+		chatID, err := strconv.ParseInt(rule.Target, 10, 64)
+		if err != nil {
+			return errors.New("Нужен ID чата в Telegram: " + rule.Target)
+		}
+		exists, err := x.Exist(&TelegramLink{UserID: rule.UserID, ChatID: chatID})
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("Чат не привязан: " + rule.Target)
+		}
+	case "webpush":
+		subID, err := strconv.ParseInt(rule.Target, 10, 64)
+		if err != nil {
+			return errors.New("Нужен ID устройства: " + rule.Target)
+		}
+		exists, err := x.Exist(&PushSubscription{Id: subID, UserID: rule.UserID})
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("Устройство не найдено: " + rule.Target)
+		}
+	case "":
+		return errors.New("Не выбран способ доставки")
+	default:
+		return errors.New("Неизвестный способ доставки: " + rule.Backend)
+	}
+	_, err = x.Insert(rule)
+	return err
+}
+
+func SelectNotifyRules(userID int64) (rules []NotifyRule, err error) {
+	err = x.Where("user_id = ?", userID).
+		Asc("id").
+		Find(&rules)
+	return rules, err
+}
+
+func SelectNotifyRule(id int64) (rule NotifyRule, err error) {
+	b, err := x.ID(id).Get(&rule)
+	if err != nil {
+		return rule, err
+	}
+	if b == false {
+		return rule, ErrNotFound
+	}
+	return rule, nil
+}
+
+func DeleteNotifyRule(id, userID int64) (err error) {
+	_, err = x.Where("id = ? AND user_id = ?", id, userID).Delete(&NotifyRule{})
+	return err
+}
+
+// SelectNotifyRuleFor ищет правило с заданным способом доставки и адресом
+func SelectNotifyRuleFor(userID int64, backend, target string) (rule NotifyRule, exists bool, err error) {
+	exists, err = x.Where("user_id = ? AND backend = ? AND target = ?", userID, backend, target).Get(&rule)
+	return rule, exists, err
+}
+
+func DeleteNotifyRulesFor(userID int64, backend, target string) (err error) {
+	_, err = x.Where("user_id = ? AND backend = ? AND target = ?", userID, backend, target).Delete(&NotifyRule{})
+	return err
+}
+
+// SelectNotifyUsers пользователи, у которых есть хотя бы одно правило
+func SelectNotifyUsers() (users []User, err error) {
+	err = x.Where("id IN (SELECT DISTINCT user_id FROM notify_rule) AND disabled = ?", false).Find(&users)
+	return users, err
+}
+
+func GroupHasChannel(groupID int64, channelID string) (bool, error) {
+	return x.Exist(&GroupChannel{GroupID: groupID, ChannelID: channelID})
+}
+
+func (delivery *NotifyDelivery) Insert() (err error) {
+	_, err = x.Insert(delivery)
+	return err
+}
+
+func (delivery *NotifyDelivery) Update() (err error) {
+	_, err = x.ID(delivery.Id).
+		Cols("status", "attempts", "error", "next_try_at").
+		Update(delivery)
+	return err
+}
+
+// ClaimDelivery берет доставку в работу до until, если ее время пришло и
+// никто ее еще не взял. Опрос сервера, таймер повтора и subvideo sync
+// так не отправят одно уведомление дважды
+func ClaimDelivery(id int64, now, until time.Time) (bool, error) {
+	affected, err := x.Where("id = ? AND status = ? AND next_try_at <= ?", id, DeliveryPending, now).
+		Cols("next_try_at").
+		Update(&NotifyDelivery{NextTryAt: until})
+	return affected == 1, err
+}
+
+func SelectNotifyDelivery(id int64) (delivery NotifyDelivery, err error) {
+	b, err := x.ID(id).Get(&delivery)
+	if err != nil {
+		return delivery, err
+	}
+	if b == false {
+		return delivery, ErrNotFound
+	}
+	return delivery, nil
+}
+
+// DeliveryExists не дает отправить одно событие по одному правилу дважды
+func DeliveryExists(ruleID int64, eventKey string) (bool, error) {
+	return x.Exist(&NotifyDelivery{RuleID: ruleID, EventKey: eventKey})
+}
+
+func SelectDeliveries(userID int64, n int) (deliveries []NotifyDelivery, err error) {
+	err = x.Where("user_id = ?", userID).
+		Desc("id").
+		Limit(n).
+		Find(&deliveries)
+	return deliveries, err
+}
+
+// SelectDueDeliveries недоставленное, чье время попытки уже пришло
+func SelectDueDeliveries(now time.Time, n int) (deliveries []NotifyDelivery, err error) {
+	err = x.Where("status = ? AND next_try_at <= ?", DeliveryPending, now).
+		Asc("next_try_at").
+		Limit(n).
+		Find(&deliveries)
+	return deliveries, err
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	_ "github.com/lib/pq"
+)
+
+// postgres поиск через tsvector, который триггер строит с конфигурацией
+// по языку видео
+type postgres struct{}
+
+func (postgres) migrate() (err error) {
+	results, err := x.Query("SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = ? AND column_name = ?", "subvideo", "tsv")
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		_, err = x.Exec("ALTER TABLE subvideo ADD COLUMN tsv tsvector")
+		if err != nil {
+			return err
+		}
+		_, err = x.Exec("CREATE INDEX ix_subvideo_tsv ON subvideo USING GIN(tsv)")
+		if err != nil {
+			return err
+		}
+	}
+
+	// раньше канал индексировался с simple, такой tsv тоже пересобирается
+	results, err = x.Query("SELECT proname FROM pg_proc WHERE proname = ? AND prosrc NOT LIKE ?",
+		"subvideo_trigger", "%'simple', coalesce(new.channel%")
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		err = initLanguageSearch()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initLanguageSearch пересобирает tsv с конфигурацией поиска по языку видео:
+// russian, english, а для остальных simple. Все поля, и название канала
+// тоже, индексируются с одной конфигурацией, чтобы запрос в ней же находил
+// и исключал слова в любом поле
+func initLanguageSearch() (err error) {
+	_, err = x.Exec(
+		`CREATE OR REPLACE FUNCTION subvideo_tsconfig(lang text) RETURNS regconfig AS $$
+			SELECT CASE lower(split_part(coalesce(lang, ''), '-', 1))
+				WHEN 'ru' THEN 'russian'::regconfig
+				WHEN 'en' THEN 'english'::regconfig
+				ELSE 'simple'::regconfig
+			END
+		$$ LANGUAGE sql IMMUTABLE;
+
+		CREATE OR REPLACE FUNCTION subvideo_trigger() RETURNS trigger AS $$
+		begin
+			new.tsv :=
+			setweight(to_tsvector(subvideo_tsconfig(new.language), coalesce(new.title, '')),
+				'A') ||
+			setweight(to_tsvector(subvideo_tsconfig(new.language), coalesce(new.channel, '')),
+					'B') ||
+			setweight(to_tsvector(subvideo_tsconfig(new.language), coalesce(new.game, '')),
+					'C') ||
+			setweight(to_tsvector(subvideo_tsconfig(new.language), coalesce(new.description, '')),
+					'D');
+			return new;
+		end
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS tsvectorupdate ON subvideo;
+		CREATE TRIGGER tsvectorupdate BEFORE INSERT OR UPDATE
+		ON subvideo FOR EACH ROW EXECUTE PROCEDURE subvideo_trigger();`,
+	)
+	if err != nil {
+		return err
+	}
+
+	// язык старых видео угадываем по кириллице, заодно триггер пересчитает tsv
+	_, err = x.Exec("UPDATE subvideo SET language = " +
+		"CASE WHEN coalesce(language, '') <> '' THEN language " +
+		"WHEN title || ' ' || coalesce(description, '') ~ '[А-Яа-яЁё]' THEN 'ru' " +
+		"ELSE 'en' END")
+	return err
+}
+
+func (postgres) ready(ctx context.Context) error {
+	results, err := x.Context(ctx).Query("SELECT proname FROM pg_proc WHERE proname = ?", "subvideo_tsconfig")
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("search migration is not applied")
+	}
+	return nil
+}
+
+func (postgres) match(text string) (string, []interface{}) {
+	tsQuery, args := searchTSQuery(text)
+	return "tsv @@ " + tsQuery, args
+}
+
+func (postgres) headline(text string) (string, []interface{}) {
+	tsQuery, args := searchTSQuery(text)
+	args = append(args, "StartSel="+HeadlineStart+", StopSel="+HeadlineStop+", MaxFragments=2, MaxWords=25, MinWords=8")
+	return "ts_headline(subvideo_tsconfig(language), coalesce(description, ''), " + tsQuery + ", ?)", args
+}
+
+func (postgres) rank(text string) (string, []interface{}) {
+	tsQuery, args := searchTSQuery(text)
+	return "ts_rank(tsv, " + tsQuery + ") DESC", args
+}
+
+func (postgres) ilike(column string) string {
+	return column + " ILIKE ?"
+}
+
+func (postgres) iregexp(column string) string {
+	return column + " ~* ?"
+}
+
+func (postgres) iequal(column string) string {
+	return "lower(" + column + ") = lower(?)"
+}
+
+func (postgres) size() (string, error) {
+	results, err := x.QueryString("SELECT pg_size_pretty(pg_database_size(current_database())) AS size")
+	if err != nil {
+		return "", err
+	}
+	return results[0]["size"], nil
+}
+
+// searchTSQuery строит запрос в конфигурации языка самой строки, с которой
+// построен ее tsv. Объединение запросов во всех конфигурациях не годится:
+// исключение через минус в чужой конфигурации стеммится иначе и не
+// срабатывает. Фразы в кавычках и исключения понимает websearch_to_tsquery
+func searchTSQuery(text string) (sql string, args []interface{}) {
+	return "websearch_to_tsquery(subvideo_tsconfig(language), ?)", []interface{}{text}
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Тесты на настоящей Postgres, база из SUBVIDEO_TEST_POSTGRES, например
+// "postgres://subvideo@localhost/subvideo_test?sslmode=disable". Все таблицы
+// в ней пересоздаются
+func testPostgres(t *testing.T) User {
+	t.Helper()
+	source := os.Getenv("SUBVIDEO_TEST_POSTGRES")
+	if source == "" {
+		t.Skip("SUBVIDEO_TEST_POSTGRES is not set")
+	}
+	err := Init("postgres", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = x.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+	x.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openTestDB(t, "postgres", source)
+}
+
+func TestPostgresSearchVideo(t *testing.T) {
+	user := testPostgres(t)
+	testVideos(t, user)
+	insertVideos(t, user, []Subvideo{
+		{TypeSub: "youtube", Title: "Running the boss rush", Channel: "Runner", ChannelID: "UC2",
+			Length: 900, Date: testNow.Add(-30 * time.Hour)},
+		{TypeSub: "youtube", Title: "Прохождение босса", Channel: "Ёжик", ChannelID: "UC1", Language: "ru",
+			Description: "Проходим игру без урона", Length: 1200, Date: testNow.Add(-48 * time.Hour)},
+		{TypeSub: "youtube", Title: "Gaming news", Channel: "Games Weekly", ChannelID: "UC3",
+			Length: 300, Date: testNow.Add(-72 * time.Hour)},
+	})
+
+	tests := []struct {
+		search string
+		want   []string
+	}{
+		{"boss", []string{"Dark Souls boss fight", "Baking bread at home", "Raid night", "Running the boss rush"}},
+		// исключение стеммится в конфигурации строки: running -> run
+		{"boss -running", []string{"Dark Souls boss fight", "Baking bread at home", "Raid night"}},
+		{"boss -sourdough -raid", []string{"Dark Souls boss fight", "Running the boss rush"}},
+		{`"boss fight"`, []string{"Dark Souls boss fight"}},
+		{`"fight boss"`, []string{}},
+		{`"boss rush" -running`, []string{}},
+		{"прохождения", []string{"Прохождение босса"}},
+		{"игры -урона", []string{}},
+		// название канала индексируется с той же конфигурацией
+		{"game weekly", []string{"Gaming news"}},
+		{"-weekly gaming", []string{"Dark Souls boss fight"}},
+	}
+	for _, test := range tests {
+		titles := searchTitles(t, user, test.search, false)
+		if !reflect.DeepEqual(titles, test.want) {
+			t.Errorf("search %q = %q, want %q", test.search, titles, test.want)
+		}
+	}
+}
+
+func TestPostgresSearchRankAndHeadline(t *testing.T) {
+	user := testPostgres(t)
+	testVideos(t, user)
+
+	query, err := ParseSearchQuery("boss -sourdough", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.ByRank = true
+	results, _, err := Videos.SearchVideo(query, int(user.Id), 50, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Title != "Dark Souls boss fight" {
+		t.Fatalf("rank: %+v", results)
+	}
+	want := "The hardest " + HeadlineStart + "boss" + HeadlineStop + " in the game"
+	if results[0].Headline != want {
+		t.Errorf("headline = %q, want %q", results[0].Headline, want)
+	}
+}
+
+// TestPostgresFilterRegexp выражения, которые понимает Go, но не Postgres,
+// не сохраняются: иначе с ними падала бы каждая выборка ленты
+func TestPostgresFilterRegexp(t *testing.T) {
+	user := testPostgres(t)
+	testVideos(t, user)
+
+	for _, pattern := range []string{`(?P<n>dark)`, `souls\z`} {
+		filter := Filter{UserID: user.Id, Kind: FilterTitle, Value: pattern}
+		if err := filter.Insert(); err == nil {
+			t.Errorf("filter %q saved", pattern)
+		}
+	}
+	filter := Filter{UserID: user.Id, Kind: FilterTitle, Value: `^dark\s`}
+	if err := filter.Insert(); err != nil {
+		t.Fatal(err)
+	}
+	if titles := searchTitles(t, user, "boss", false); len(titles) != 2 {
+		t.Errorf("filtered = %q", titles)
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PushSubscription подписка браузера на Web Push, одна на устройство
+type PushSubscription struct {
+	Id           int64
+	UserID       int64     `xorm:"notnull index 'user_id'"`
+	Endpoint     string    `xorm:"text notnull unique 'endpoint'"`
+	P256dh       string    `xorm:"notnull 'p256dh'"`
+	Auth         string    `xorm:"notnull 'auth'"`
+	Device       string    `xorm:"'device'"`
+	MuteLive     bool      `xorm:"'mute_live'"`
+	MuteNewVideo bool      `xorm:"'mute_new_video'"`
+	CreatedAt    time.Time `xorm:"created"`
+}
+
+// Insert сохраняет подписку, повторная подписка того же браузера обновляет ключи
+func (sub *PushSubscription) Insert() (err error) {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("Неверный адрес подписки")
+	}
+	if sub.P256dh == "" || sub.Auth == "" {
+		return errors.New("Нет ключей подписки")
+	}
+	sub.Device = strings.TrimSpace(sub.Device)
+
+	var old PushSubscription
+	b, err := x.Where("endpoint = ?", sub.Endpoint).Get(&old)
+	if err != nil {
+		return err
+	}
+	if b == false {
+		_, err = x.Insert(sub)
+		return err
+	}
+	sub.Id = old.Id
+	if old.UserID != sub.UserID {
+		// в браузере вошел другой пользователь: правила прежнего владельца
+		// не должны слать ему уведомления, настройки начинаются заново
+		err = DeleteNotifyRulesFor(old.UserID, "webpush", strconv.FormatInt(old.Id, 10))
+		if err != nil {
+			return err
+		}
+		_, err = x.ID(sub.Id).Cols("user_id", "p256dh", "auth", "device", "mute_live", "mute_new_video").Update(sub)
+		return err
+	}
+	sub.MuteLive = old.MuteLive
+	sub.MuteNewVideo = old.MuteNewVideo
+	_, err = x.ID(sub.Id).Cols("user_id", "p256dh", "auth", "device").Update(sub)
+	return err
+}
+
+func (sub PushSubscription) SetMute(muteLive, muteNewVideo bool) (err error) {
+	sub.MuteLive = muteLive
+	sub.MuteNewVideo = muteNewVideo
+	_, err = x.ID(sub.Id).Cols("mute_live", "mute_new_video").Update(&sub)
+	return err
+}
+
+func SelectPushSubscriptions(userID int64) (subs []PushSubscription, err error) {
+	err = x.Where("user_id = ?", userID).
+		Asc("id").
+		Find(&subs)
+	return subs, err
+}
+
+func SelectPushSubscription(id int64) (sub PushSubscription, err error) {
+	b, err := x.ID(id).Get(&sub)
+	if err != nil {
+		return sub, err
+	}
+	if b == false {
+		return sub, ErrNotFound
+	}
+	return sub, nil
+}
+
+func SelectPushSubscriptionForEndpoint(endpoint string, userID int64) (sub PushSubscription, err error) {
+	b, err := x.Where("endpoint = ? AND user_id = ?", endpoint, userID).Get(&sub)
+	if err != nil {
+		return sub, err
+	}
+	if b == false {
+		return sub, ErrNotFound
+	}
+	return sub, nil
+}
+
+func DeletePushSubscription(id int64) (err error) {
+	_, err = x.ID(id).Delete(&PushSubscription{})
+	return err
+}
@@ -0,0 +1,256 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Маркеры подсветки найденного, символы из области для частного использования
+const (
+	HeadlineStart = "\uE000"
+	HeadlineStop  = "\uE001"
+)
+
+// SearchQuery разобранная строка поиска.
+// Text уходит в полнотекстовый поиск базы как есть: фразы в кавычках и
+// исключения через минус понимают оба диалекта, остальные поля - SQL условия.
+type SearchQuery struct {
+	Text        string
+	Channels    []string
+	NotChannels []string
+	Games       []string
+	NotGames    []string
+	Types       []string
+	NotTypes    []string
+	Before      time.Time
+	After       time.Time
+	Longer      int
+	Shorter     int
+	ByRank      bool
+}
+
+// searchTypes значения для type:. Идущие стримы Twitch в базу не пишутся,
+// они живут только в кэше стримов ленты, поэтому type:live находит лишь
+// трансляции YouTube
+var searchTypes = map[string][]string{
+	"twitch":   {"twitch", "twitch-stream"},
+	"youtube":  {"youtube"},
+	"live":     {"youtube-stream-live"},
+	"upcoming": {"youtube-stream"},
+}
+
+var searchDateLayouts = []string{"2006-01-02", "02.01.2006", "2006-01", "2006"}
+
+// ParseSearchQuery разбирает строку поиска, даты считаются в часовом поясе loc
+func ParseSearchQuery(search string, loc *time.Location) (query SearchQuery, err error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var text []string
+	for _, token := range splitSearch(search) {
+		negative := strings.HasPrefix(token, "-")
+		field, value, ok := searchField(strings.TrimPrefix(token, "-"))
+		if !ok {
+			text = append(text, token)
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if value == "" {
+			return query, fmt.Errorf("Пустое значение у %s:", field)
+		}
+
+		switch field {
+		case "channel":
+			if negative {
+				query.NotChannels = append(query.NotChannels, value)
+			} else {
+				query.Channels = append(query.Channels, value)
+			}
+		case "game":
+			if negative {
+				query.NotGames = append(query.NotGames, value)
+			} else {
+				query.Games = append(query.Games, value)
+			}
+		case "type":
+			types, ok := searchTypes[strings.ToLower(value)]
+			if !ok {
+				return query, errors.New("Неизвестный тип: " + value + ", можно twitch, youtube, live, upcoming")
+			}
+			if negative {
+				query.NotTypes = append(query.NotTypes, types...)
+			} else {
+				query.Types = append(query.Types, types...)
+			}
+		case "before", "after":
+			date, err := parseSearchDate(value, loc)
+			if err != nil {
+				return query, err
+			}
+			if field == "before" {
+				query.Before = date
+			} else {
+				query.After = date
+			}
+		case "longer", "shorter":
+			length, err := parseSearchLength(value)
+			if err != nil {
+				return query, err
+			}
+			if field == "longer" {
+				query.Longer = length
+			} else {
+				query.Shorter = length
+			}
+		}
+	}
+	query.Text = strings.Join(text, " ")
+
+	return query, nil
+}
+
+func (query SearchQuery) Empty() bool {
+	return query.Text == "" && len(query.Channels) == 0 && len(query.NotChannels) == 0 &&
+		len(query.Games) == 0 && len(query.NotGames) == 0 && len(query.Types) == 0 &&
+		len(query.NotTypes) == 0 && query.Before.IsZero() && query.After.IsZero() &&
+		query.Longer == 0 && query.Shorter == 0
+}
+
+// where собирает условие выборки без учета пользователя
+func (query SearchQuery) where() (where []string, args []interface{}) {
+	if query.Text != "" {
+		match, matchArgs := sqlDialect.match(query.Text)
+		where = append(where, match)
+		args = append(args, matchArgs...)
+	}
+	for _, channel := range query.Channels {
+		where = append(where, "("+sqlDialect.ilike("channel")+" OR channel_id = ?)")
+		args = append(args, likePattern(channel), channel)
+	}
+	for _, channel := range query.NotChannels {
+		where = append(where, "NOT ("+sqlDialect.ilike("channel")+" OR channel_id = ?)")
+		args = append(args, likePattern(channel), channel)
+	}
+	for _, game := range query.Games {
+		where = append(where, sqlDialect.ilike("game"))
+		args = append(args, likePattern(game))
+	}
+	for _, game := range query.NotGames {
+		where = append(where, "NOT "+sqlDialect.ilike("coalesce(game, '')"))
+		args = append(args, likePattern(game))
+	}
+	if len(query.Types) != 0 {
+		where = append(where, "type IN ("+placeholders(len(query.Types))+")")
+		for _, typeSub := range query.Types {
+			args = append(args, typeSub)
+		}
+	}
+	if len(query.NotTypes) != 0 {
+		where = append(where, "type NOT IN ("+placeholders(len(query.NotTypes))+")")
+		for _, typeSub := range query.NotTypes {
+			args = append(args, typeSub)
+		}
+	}
+	if !query.Before.IsZero() {
+		where = append(where, "date < ?")
+		args = append(args, query.Before.UTC())
+	}
+	if !query.After.IsZero() {
+		where = append(where, "date >= ?")
+		args = append(args, query.After.UTC())
+	}
+	if query.Longer != 0 {
+		where = append(where, "length > ?")
+		args = append(args, query.Longer)
+	}
+	if query.Shorter != 0 {
+		where = append(where, "length < ?")
+		args = append(args, query.Shorter)
+	}
+	return where, args
+}
+
+// splitSearch делит строку по пробелам, не разрывая фразы в кавычках
+func splitSearch(search string) (tokens []string) {
+	var token strings.Builder
+	quoted := false
+	for _, r := range search {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if token.Len() != 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() != 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+func searchField(token string) (field, value string, ok bool) {
+	i := strings.Index(token, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	field = strings.ToLower(token[:i])
+	switch field {
+	case "channel", "game", "type", "before", "after", "longer", "shorter":
+		return field, token[i+1:], true
+	}
+	return "", "", false
+}
+
+func parseSearchDate(value string, loc *time.Location) (date time.Time, err error) {
+	for _, layout := range searchDateLayouts {
+		date, err = time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return date, errors.New("Не понимаю дату: " + value + ", нужно 2006-01-02")
+}
+
+// parseSearchLength понимает 90 (минуты), 1h30m и 1:30:00, отдает секунды
+func parseSearchLength(value string) (int, error) {
+	minutes, err := strconv.Atoi(value)
+	if err == nil {
+		return minutes * 60, nil
+	}
+	if strings.Contains(value, ":") {
+		var seconds int
+		for _, part := range strings.Split(value, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, errors.New("Не понимаю длительность: " + value)
+			}
+			seconds = seconds*60 + n
+		}
+		return seconds, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("Не понимаю длительность: " + value + ", нужно 90, 1h30m или 1:30:00")
+	}
+	return int(duration.Seconds()), nil
+}
+
+func likePattern(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	return "%" + value + "%"
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
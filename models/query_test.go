@@ -0,0 +1,71 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	tests := []struct {
+		search string
+		want   SearchQuery
+	}{
+		{"", SearchQuery{}},
+		{"speedrun any%", SearchQuery{Text: "speedrun any%"}},
+		{`"dark souls" -dlc`, SearchQuery{Text: `"dark souls" -dlc`}},
+		{"channel:foo -channel:bar", SearchQuery{Channels: []string{"foo"}, NotChannels: []string{"bar"}}},
+		{`game:"Dark Souls" -game:Minecraft`, SearchQuery{Games: []string{"Dark Souls"}, NotGames: []string{"Minecraft"}}},
+		{"type:live -type:YouTube", SearchQuery{
+			Types:    []string{"youtube-stream-live"},
+			NotTypes: []string{"youtube"},
+		}},
+		{"after:2019-05-01 before:02.06.2019", SearchQuery{
+			After:  time.Date(2019, 5, 1, 0, 0, 0, 0, moscow),
+			Before: time.Date(2019, 6, 2, 0, 0, 0, 0, moscow),
+		}},
+		{"after:2019", SearchQuery{After: time.Date(2019, 1, 1, 0, 0, 0, 0, moscow)}},
+		{"longer:90 shorter:1h30m", SearchQuery{Longer: 90 * 60, Shorter: 90 * 60}},
+		{"shorter:1:02:03", SearchQuery{Shorter: 3723}},
+		{"Channel:foo boss fight", SearchQuery{Text: "boss fight", Channels: []string{"foo"}}},
+		{"http://example.com", SearchQuery{Text: "http://example.com"}},
+	}
+	for _, test := range tests {
+		query, err := ParseSearchQuery(test.search, moscow)
+		if err != nil {
+			t.Errorf("ParseSearchQuery(%q): %v", test.search, err)
+			continue
+		}
+		if !reflect.DeepEqual(query, test.want) {
+			t.Errorf("ParseSearchQuery(%q) = %+v, want %+v", test.search, query, test.want)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	for _, search := range []string{
+		"channel:",
+		`game:""`,
+		"type:podcast",
+		"before:yesterday",
+		"longer:long",
+		"shorter:1:xx",
+	} {
+		_, err := ParseSearchQuery(search, nil)
+		if err == nil {
+			t.Errorf("ParseSearchQuery(%q): no error", search)
+		}
+	}
+}
+
+func TestParseSearchQueryEmpty(t *testing.T) {
+	query, err := ParseSearchQuery("  ", time.UTC)
+	if err != nil || !query.Empty() {
+		t.Errorf("ParseSearchQuery(blank) = %+v, %v, want empty", query, err)
+	}
+	query, err = ParseSearchQuery("-type:twitch", time.UTC)
+	if err != nil || query.Empty() {
+		t.Errorf("ParseSearchQuery(-type:twitch) = %+v, %v, want not empty", query, err)
+	}
+}
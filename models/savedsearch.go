@@ -0,0 +1,166 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SavedSearch struct {
+	Id           int64
+	UserID       int64     `xorm:"notnull index 'user_id'"`
+	Name         string    `xorm:"notnull 'name'"`
+	Query        string    `xorm:"text notnull 'query'"`
+	Sort         string    `xorm:"'sort'"`
+	Notify       bool      `xorm:"'notify'"`
+	LastViewedAt time.Time `xorm:"'last_viewed_at'"`
+	CreatedAt    time.Time `xorm:"created"`
+}
+
+func (search *SavedSearch) Insert() (err error) {
+	search.Name = strings.TrimSpace(search.Name)
+	if search.Name == "" {
+		search.Name = search.Query
+	}
+	if strings.TrimSpace(search.Query) == "" {
+		return errors.New("Пустой поисковый запрос")
+	}
+	search.LastViewedAt = time.Now().UTC()
+	_, err = x.Insert(search)
+	return err
+}
+
+// Viewed сбрасывает счетчик новых совпадений
+func (search SavedSearch) Viewed() (err error) {
+	search.LastViewedAt = time.Now().UTC()
+	_, err = x.ID(search.Id).Cols("last_viewed_at").Update(&search)
+	return err
+}
+
+func (search SavedSearch) SetNotify(notify bool) (err error) {
+	search.Notify = notify
+	_, err = x.ID(search.Id).Cols("notify").Update(&search)
+	return err
+}
+
+// CountNew считает видео, подходящие под поиск и добавленные после последнего просмотра
+func (search SavedSearch) CountNew(user User, loc *time.Location) (count int, err error) {
+	query, err := ParseSearchQuery(search.Query, loc)
+	if err != nil {
+		return count, err
+	}
+	return countSearchVideo(query, user, "created_at > ? AND NOT backfilled", search.LastViewedAt)
+}
+
+func SelectSavedSearches(userID int64) (searches []SavedSearch, err error) {
+	err = x.Where("user_id = ?", userID).
+		Asc("name").
+		Find(&searches)
+	return searches, err
+}
+
+func SelectSavedSearch(id, userID int64) (search SavedSearch, err error) {
+	b, err := x.Where("id = ? AND user_id = ?", id, userID).Get(&search)
+	if err != nil {
+		return search, err
+	}
+	if b == false {
+		return search, ErrNotFound
+	}
+	return search, nil
+}
+
+func DeleteSavedSearch(id, userID int64) (err error) {
+	_, err = x.Where("id = ? AND user_id = ?", id, userID).Delete(&SavedSearch{})
+	return err
+}
+
+// CountSavedSearchNew сколько новых совпадений накопилось в поисках с
+// уведомлениями, по CountNew каждого, как на странице поисков
+func CountSavedSearchNew(user User, loc *time.Location) (count int, err error) {
+	var searches []SavedSearch
+	err = x.Where("user_id = ? AND notify = true", user.Id).Find(&searches)
+	if err != nil {
+		return count, err
+	}
+	for _, search := range searches {
+		n, err := search.CountNew(user, loc)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// SavedSearchMatch новые видео, подошедшие под сохраненный поиск
+type SavedSearchMatch struct {
+	Search SavedSearch
+	Videos []Subvideo
+}
+
+// MatchSavedSearches проверяет только что добавленные видео по поискам с
+// уведомлениями и отдает поиски, в которых нашлись совпадения. Счетчик
+// новых не хранится, его считает CountNew
+func MatchSavedSearches(user User, videos []Subvideo, loc *time.Location) (matched []SavedSearchMatch, err error) {
+	if len(videos) == 0 {
+		return matched, nil
+	}
+
+	var searches []SavedSearch
+	err = x.Where("user_id = ? AND notify = true", user.Id).Find(&searches)
+	if err != nil {
+		return matched, err
+	}
+
+	ids := make([]interface{}, 0, len(videos))
+	for _, video := range videos {
+		ids = append(ids, video.Id)
+	}
+	for _, search := range searches {
+		query, err := ParseSearchQuery(search.Query, loc)
+		if err != nil {
+			continue
+		}
+		where, args, err := searchWhere(query, user, "id IN ("+placeholders(len(ids))+")", ids...)
+		if err != nil {
+			return matched, err
+		}
+		var found []Subvideo
+		err = x.Where(where, args...).Asc("date").Find(&found)
+		if err != nil {
+			return matched, err
+		}
+		if len(found) == 0 {
+			continue
+		}
+		matched = append(matched, SavedSearchMatch{Search: search, Videos: found})
+	}
+	return matched, nil
+}
+
+// searchWhere условие поиска по видео пользователя с его правилами скрытия
+func searchWhere(query SearchQuery, user User, condition string, conditionArgs ...interface{}) (where string, args []interface{}, err error) {
+	conditions, args := query.where()
+	conditions = append([]string{"user_id = ?", condition}, conditions...)
+	args = append(append([]interface{}{user.Id}, conditionArgs...), args...)
+	where = strings.Join(conditions, " AND ")
+	if !user.ShowHidden {
+		where, args, err = withFilters(user.Id, where, args)
+	}
+	return where, args, err
+}
+
+func countSearchVideo(query SearchQuery, user User, condition string, conditionArgs ...interface{}) (count int, err error) {
+	where, args, err := searchWhere(query, user, condition, conditionArgs...)
+	if err != nil {
+		return count, err
+	}
+
+	countS, err := x.QueryString(append([]interface{}{"SELECT count(*) AS count FROM subvideo WHERE " + where}, args...)...)
+	if err != nil {
+		return count, err
+	}
+	return strconv.Atoi(countS[0]["count"])
+}
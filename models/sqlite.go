@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+	"xorm.io/core"
+)
+
+// sqlite база в одном файле для установки на одного пользователя. Поиск
+// идет по FTS5 без стемминга, поэтому SQLite собирается с -tags sqlite_fts5
+type sqlite struct{}
+
+// sqliteDriver SQLite с функциями, которых в нем нет: регулярные выражения
+// и нижний регистр не только для латиницы
+const sqliteDriver = "sqlite3_subvideo"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("iregexp", sqliteRegexp, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterFunc("casefold", strings.ToLower, true)
+		},
+	})
+	// xorm выбирает диалект по имени драйвера, берем разбор адреса у sqlite3
+	core.RegisterDriver(sqliteDriver, core.QueryDriver("sqlite3"))
+}
+
+// sqliteSource путь к файлу с настройками подключения: WAL и ожидание
+// блокировки, чтобы синхронизация не мешала чтению
+func sqliteSource(path string) string {
+	return "file:" + path + "?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+}
+
+var sqliteRegexps sync.Map
+
+// sqliteRegexp iregexp(pattern, s), скомпилированные выражения кешируются,
+// так как функция вызывается для каждой строки
+func sqliteRegexp(pattern, s string) (bool, error) {
+	re, ok := sqliteRegexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = sqliteRegexps.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(s), nil
+}
+
+// sqliteSearch индекс FTS5 поверх subvideo и триггеры, которые его обновляют
+var sqliteSearch = []string{
+	`CREATE VIRTUAL TABLE subvideo_fts USING fts5(title, channel, game, description,
+		content='subvideo', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+	`CREATE TRIGGER subvideo_fts_insert AFTER INSERT ON subvideo BEGIN
+		INSERT INTO subvideo_fts(rowid, title, channel, game, description)
+		VALUES (new.id, new.title, new.channel, new.game, new.description);
+	END`,
+	`CREATE TRIGGER subvideo_fts_delete AFTER DELETE ON subvideo BEGIN
+		INSERT INTO subvideo_fts(subvideo_fts, rowid, title, channel, game, description)
+		VALUES ('delete', old.id, old.title, old.channel, old.game, old.description);
+	END`,
+	`CREATE TRIGGER subvideo_fts_update AFTER UPDATE ON subvideo BEGIN
+		INSERT INTO subvideo_fts(subvideo_fts, rowid, title, channel, game, description)
+		VALUES ('delete', old.id, old.title, old.channel, old.game, old.description);
+		INSERT INTO subvideo_fts(rowid, title, channel, game, description)
+		VALUES (new.id, new.title, new.channel, new.game, new.description);
+	END`,
+	// индекс для видео, которые были до миграции
+	`INSERT INTO subvideo_fts(subvideo_fts) VALUES ('rebuild')`,
+}
+
+func (sqlite) migrate() error {
+	exist, err := sqliteSearchExists(context.Background())
+	if err != nil || exist {
+		return err
+	}
+
+	session := x.NewSession()
+	defer session.Close()
+	err = session.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range sqliteSearch {
+		_, err = session.Exec(statement)
+		if err != nil {
+			session.Rollback()
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return errors.New("sqlite is built without FTS5, rebuild with -tags sqlite_fts5")
+			}
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+func (sqlite) ready(ctx context.Context) error {
+	exist, err := sqliteSearchExists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return errors.New("search migration is not applied")
+	}
+	return nil
+}
+
+func sqliteSearchExists(ctx context.Context) (bool, error) {
+	results, err := x.Context(ctx).QueryString("SELECT name FROM sqlite_master WHERE name = ?", "subvideo_fts")
+	if err != nil {
+		return false, err
+	}
+	return len(results) != 0, nil
+}
+
+func (sqlite) match(text string) (string, []interface{}) {
+	match, exclude := ftsQuery(text)
+	switch {
+	case match != "":
+		return "id IN (SELECT rowid FROM subvideo_fts WHERE subvideo_fts MATCH ?)", []interface{}{match}
+	case exclude != "":
+		return "id NOT IN (SELECT rowid FROM subvideo_fts WHERE subvideo_fts MATCH ?)", []interface{}{exclude}
+	}
+	return "1 = 0", nil
+}
+
+func (sqlite) headline(text string) (string, []interface{}) {
+	match, _ := ftsQuery(text)
+	if match == "" {
+		return "''", nil
+	}
+	return "coalesce((SELECT snippet(subvideo_fts, 3, ?, ?, '…', 25) FROM subvideo_fts " +
+			"WHERE subvideo_fts MATCH ? AND rowid = subvideo.id), '')",
+		[]interface{}{HeadlineStart, HeadlineStop, match}
+}
+
+func (sqlite) rank(text string) (string, []interface{}) {
+	match, _ := ftsQuery(text)
+	if match == "" {
+		return "date DESC", nil
+	}
+	// веса как у setweight в Postgres: название, канал, игра, описание
+	return "(SELECT bm25(subvideo_fts, 10.0, 5.0, 2.0, 1.0) FROM subvideo_fts " +
+			"WHERE subvideo_fts MATCH ? AND rowid = subvideo.id) ASC",
+		[]interface{}{match}
+}
+
+func (sqlite) ilike(column string) string {
+	return "casefold(" + column + ") LIKE casefold(?) ESCAPE '\\'"
+}
+
+func (sqlite) iregexp(column string) string {
+	return "iregexp(?, " + column + ")"
+}
+
+// iequal встроенный lower в SQLite меняет регистр только у латиницы
+func (sqlite) iequal(column string) string {
+	return "casefold(" + column + ") = casefold(?)"
+}
+
+func (sqlite) size() (string, error) {
+	results, err := x.QueryString("SELECT page_count * page_size AS size FROM pragma_page_count(), pragma_page_size()")
+	if err != nil {
+		return "", err
+	}
+	var size float64
+	fmt.Sscan(results[0]["size"], &size)
+	unit := "bytes"
+	for _, next := range []string{"kB", "MB", "GB", "TB"} {
+		if size < 10*1024 {
+			break
+		}
+		size, unit = size/1024, next
+	}
+	return fmt.Sprintf("%.0f %s", size, unit), nil
+}
+
+// ftsQuery переводит строку поиска в синтаксис FTS5 так же, как его понимает
+// websearch_to_tsquery: слова и фразы в кавычках ищутся вместе, or между
+// ними - любое из, слова с минусом исключаются. exclude - только исключения,
+// на случай когда искать больше нечего
+func ftsQuery(text string) (match, exclude string) {
+	var terms, excluded []string
+	or := false
+	for _, token := range splitSearch(text) {
+		if strings.EqualFold(token, "or") {
+			or = len(terms) != 0
+			continue
+		}
+		negative := strings.HasPrefix(token, "-")
+		token = strings.Trim(strings.TrimPrefix(token, "-"), `"`)
+		if token == "" {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(token, `"`, `""`) + `"`
+		switch {
+		case negative:
+			excluded = append(excluded, term)
+		case or:
+			terms[len(terms)-1] += " OR " + term
+		default:
+			terms = append(terms, term)
+		}
+		or = false
+	}
+	if len(terms) != 0 {
+		match = "(" + strings.Join(terms, ") AND (") + ")"
+		for _, term := range excluded {
+			match += " NOT " + term
+		}
+	}
+	return match, strings.Join(excluded, " OR ")
+}
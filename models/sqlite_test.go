@@ -0,0 +1,260 @@
+//go:build sqlite_fts5
+
+package models
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Тесты на настоящей SQLite: go test -tags sqlite_fts5 ./models
+
+// testDB новая база в каталоге теста и пользователь в ней
+func testDB(t *testing.T) User {
+	return openTestDB(t, "sqlite", filepath.Join(t.TempDir(), "subvideo.db"))
+}
+
+func TestFTSQuery(t *testing.T) {
+	tests := []struct {
+		text, match, exclude string
+	}{
+		{"boss fight", `("boss") AND ("fight")`, ""},
+		{`"dark souls" dlc`, `("dark souls") AND ("dlc")`, ""},
+		{"boss or raid fight", `("boss" OR "raid") AND ("fight")`, ""},
+		{"or boss", `("boss")`, ""},
+		{"boss -raid", `("boss") NOT "raid"`, `"raid"`},
+		{"-raid -dlc", "", `"raid" OR "dlc"`},
+		{`say"hi`, `("say""hi")`, ""},
+		{`"" -""`, "", ""},
+	}
+	for _, test := range tests {
+		match, exclude := ftsQuery(test.text)
+		if match != test.match || exclude != test.exclude {
+			t.Errorf("ftsQuery(%q) = %q, %q, want %q, %q", test.text, match, exclude, test.match, test.exclude)
+		}
+	}
+}
+
+func TestSQLiteSearchVideo(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+
+	tests := []struct {
+		search string
+		want   []string
+	}{
+		{"boss", []string{"Dark Souls boss fight", "Baking bread at home", "Raid night"}},
+		{"BOSS fight", []string{"Dark Souls boss fight"}},
+		{`"boss fight"`, []string{"Dark Souls boss fight"}},
+		{"bread or raid", []string{"Live raid", "Baking bread at home", "Raid night"}},
+		{"boss -sourdough", []string{"Dark Souls boss fight", "Raid night"}},
+		{"-boss", []string{"Live raid", "100% speedrun"}},
+		{"channel:ёжик", []string{"Dark Souls boss fight", "Baking bread at home"}},
+		{"channel:42 type:twitch", []string{"Live raid", "Raid night"}},
+		{"type:live", []string{}},
+		{"-channel:streamer_1", []string{"Dark Souls boss fight", "Baking bread at home", "100% speedrun"}},
+		{"channel:r_1", []string{"Live raid", "Raid night"}},
+		{"channel:unn_", []string{}},
+		{"100%", []string{"100% speedrun"}},
+		{"game:souls", []string{"Dark Souls boss fight"}},
+		{"-game:warcraft -game:souls", []string{"Baking bread at home", "100% speedrun"}},
+		{"longer:30 shorter:2h", []string{"Dark Souls boss fight"}},
+		{"after:2019-06-01 type:youtube", []string{"Dark Souls boss fight", "Baking bread at home"}},
+		{"before:2019-06-01", []string{"100% speedrun"}},
+	}
+	for _, test := range tests {
+		titles := searchTitles(t, user, test.search, false)
+		if !reflect.DeepEqual(titles, test.want) {
+			t.Errorf("search %q = %q, want %q", test.search, titles, test.want)
+		}
+	}
+}
+
+func TestSQLiteSearchRankAndHeadline(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+
+	query, err := ParseSearchQuery("boss", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.ByRank = true
+	results, _, err := Videos.SearchVideo(query, int(user.Id), 50, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Title != "Dark Souls boss fight" {
+		t.Fatalf("rank: %+v", results)
+	}
+	want := "The hardest " + HeadlineStart + "boss" + HeadlineStop + " in the game"
+	if results[0].Headline != want {
+		t.Errorf("headline = %q, want %q", results[0].Headline, want)
+	}
+}
+
+func TestSQLiteSearchAfterUpdate(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+
+	video := Subvideo{URL: "https://example.com/UC2-100% speedrun", UserID: user.Id, Title: "Any% glitchless"}
+	inserted, err := video.Insert(context.Background())
+	if err != nil || inserted {
+		t.Fatalf("update: %v, %v", inserted, err)
+	}
+	if titles := searchTitles(t, user, "glitchless", false); !reflect.DeepEqual(titles, []string{"Any% glitchless"}) {
+		t.Errorf("new title not indexed: %q", titles)
+	}
+	if titles := searchTitles(t, user, "speedrun", false); len(titles) != 0 {
+		t.Errorf("old title still indexed: %q", titles)
+	}
+}
+
+func TestSQLiteFilters(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+
+	filters := []Filter{
+		{Kind: FilterTitle, Value: "^dark"},
+		{Kind: FilterDescription, Value: "SOURDOUGH"},
+		{Kind: FilterGame, Value: "world of warcraft"},
+	}
+	for _, filter := range filters {
+		filter.UserID = user.Id
+		err := filter.Insert()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"100% speedrun"}
+	if titles := searchTitles(t, user, "", false); !reflect.DeepEqual(titles, want) {
+		t.Errorf("filtered = %q, want %q", titles, want)
+	}
+	if titles := searchTitles(t, user, "", true); len(titles) != 5 {
+		t.Errorf("show hidden = %q, want all 5", titles)
+	}
+
+	subvideos, count, err := Videos.SelectVideo(int(user.Id), 50, "", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(subvideos) != 1 || subvideos[0].Title != "100% speedrun" {
+		t.Errorf("SelectVideo = %d %+v", count, subvideos)
+	}
+}
+
+func TestSQLiteSelectChannels(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+	renamed := Subvideo{TypeSub: "twitch", Title: "Raid night 2", Channel: "streamer_one", ChannelID: "42",
+		VideoID: "42-2", URL: "https://example.com/42-2", Date: testNow, UserID: user.Id}
+	_, err := renamed.Insert(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels, err := Videos.SelectChannels(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Channel{
+		{ChannelID: "UC2", Channel: "Runner", Platform: "youtube"},
+		{ChannelID: "42", Channel: "streamer_one", Platform: "twitch"},
+		{ChannelID: "UC1", Channel: "Ёжик", Platform: "youtube"},
+	}
+	if !reflect.DeepEqual(channels, want) {
+		t.Errorf("SelectChannels = %+v, want %+v", channels, want)
+	}
+}
+
+func TestSQLiteLinkTelegram(t *testing.T) {
+	user := testDB(t)
+	other := User{UserName: "other"}
+	if err := other.Insert(); err != nil {
+		t.Fatal(err)
+	}
+	other, _ = Users.SelectUserForUserName("other")
+
+	link := func(userID int64, code string, chatID int64) {
+		t.Helper()
+		if err := SetTelegramCode(userID, code, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		linked, err := LinkTelegram(code, chatID)
+		if err != nil || linked.Id != userID {
+			t.Fatalf("LinkTelegram(%s, %d) = %d, %v", code, chatID, linked.Id, err)
+		}
+		rule := NotifyRule{UserID: userID, Backend: "telegram", Target: strconv.FormatInt(chatID, 10)}
+		if err := rule.Insert(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := func(userID int64) (targets []string) {
+		t.Helper()
+		var found []NotifyRule
+		if err := x.Where("user_id = ?", userID).Find(&found); err != nil {
+			t.Fatal(err)
+		}
+		for _, rule := range found {
+			targets = append(targets, rule.Target)
+		}
+		return targets
+	}
+
+	link(user.Id, "first", 100)
+	link(user.Id, "second", 200)
+	if targets := rules(user.Id); !reflect.DeepEqual(targets, []string{"200"}) {
+		t.Errorf("rules after relink = %q, want only the new chat", targets)
+	}
+
+	link(other.Id, "third", 200)
+	if targets := rules(user.Id); len(targets) != 0 {
+		t.Errorf("previous owner still has rules %q", targets)
+	}
+	owner, err := SelectUserForTelegram(200)
+	if err != nil || owner.Id != other.Id {
+		t.Errorf("chat owner = %d, %v, want %d", owner.Id, err, other.Id)
+	}
+	if previous, err := SelectTelegramLink(user.Id); err != nil || previous.ChatID != 0 {
+		t.Errorf("previous owner link = %+v, %v", previous, err)
+	}
+	if _, err := x.Insert(&TelegramLink{UserID: user.Id, ChatID: 200}); err == nil {
+		t.Error("two users linked to one chat")
+	}
+}
+
+// TestSQLiteLengthFilter у идущего стрима длины нет, правило длины его не скрывает
+func TestSQLiteLengthFilter(t *testing.T) {
+	user := testDB(t)
+	testVideos(t, user)
+	for _, filter := range []Filter{{Kind: FilterMinLength, Value: "1000"}, {Kind: FilterMaxLength, Value: "10000"}} {
+		filter.UserID = user.Id
+		if err := filter.Insert(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"Live raid", "Dark Souls boss fight", "100% speedrun"}
+	if titles := searchTitles(t, user, "", false); !reflect.DeepEqual(titles, want) {
+		t.Errorf("filtered = %q, want %q", titles, want)
+	}
+}
+
+// TestSQLiteGameFilter правило игры без учета регистра и для кириллицы
+func TestSQLiteGameFilter(t *testing.T) {
+	user := testDB(t)
+	insertVideos(t, user, []Subvideo{
+		{TypeSub: "youtube", Title: "Обзор", Channel: "Ёжик", ChannelID: "UC1", Game: "Ведьмак 3", Date: testNow},
+		{TypeSub: "youtube", Title: "Review", Channel: "Ёжик", ChannelID: "UC1", Game: "Witcher 3", Date: testNow.Add(-time.Hour)},
+	})
+	filter := Filter{UserID: user.Id, Kind: FilterGame, Value: "ВЕДЬМАК 3"}
+	if err := filter.Insert(); err != nil {
+		t.Fatal(err)
+	}
+	if titles := searchTitles(t, user, "", false); !reflect.DeepEqual(titles, []string{"Review"}) {
+		t.Errorf("filtered = %q, want only Review", titles)
+	}
+}
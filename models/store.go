@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+)
+
+// UserStore хранилище пользователей
+type UserStore interface {
+	SelectUserForUserName(name string) (User, error)
+	SelectUserForID(id int64) (User, error)
+	SelectUserForFeedToken(token string) (User, error)
+	SelectUsers() ([]User, error)
+	DeleteUser(id int64) error
+	DeleteUserWhereInterval(day int) (int, error)
+}
+
+// VideoStore хранилище видео и поиск по ним
+type VideoStore interface {
+	SelectVideo(userID, n int, channelID string, page int, showHidden bool) ([]Subvideo, int, error)
+	SelectGroupVideo(userID int, groupID int64, n, page int, showHidden bool) ([]Subvideo, int, error)
+	SelectStreamVideo(userID int) ([]Subvideo, error)
+	SelectStreamOnlineYouTube(userID int) ([]Subvideo, error)
+	SelectVideoForID(id string) (Subvideo, error)
+	SelectChannels(userID int64) ([]Channel, error)
+	SearchVideo(query SearchQuery, userID, n, page int, showHidden bool) ([]SearchResult, int, error)
+	CountVideosByUser() (map[int64]int, error)
+	DeleteVideoWhereInterval(day int) (int64, error)
+	DeleteVideoForVideoID(videoID string) error
+}
+
+// Текущие хранилища. Обе базы работают через xorm и sqlStore, а то, чем
+// Postgres и SQLite отличаются, спрятано в dialect. Подменить можно только
+// пользователей и видео: правила, группы, поиски, уведомления, курсоры и
+// кэш ходят в базу напрямую. Поэтому проверки кода, который их трогает,
+// идут на файле SQLite: Init("sqlite", путь)
+var (
+	Users  UserStore  = sqlStore{}
+	Videos VideoStore = sqlStore{}
+)
+
+type sqlStore struct{}
+
+// dialect SQL, который у каждой базы свой: миграции полнотекстового
+// поиска, сам поиск и сравнения без учета регистра
+type dialect interface {
+	// migrate создает то, что xorm не умеет сам: индекс поиска и функции
+	migrate() error
+	// ready проверяет, что migrate уже применен
+	ready(ctx context.Context) error
+	// match условие WHERE для полнотекстового поиска по text
+	match(text string) (string, []interface{})
+	// headline подсвеченный фрагмент описания, HeadlineStart и HeadlineStop вокруг найденного
+	headline(text string) (string, []interface{})
+	// rank выражение ORDER BY по релевантности
+	rank(text string) (string, []interface{})
+	// ilike column содержит подстроку без учета регистра, шаблон из likePattern
+	ilike(column string) string
+	// iregexp column подходит под регулярное выражение без учета регистра
+	iregexp(column string) string
+	// iequal column равен значению без учета регистра
+	iequal(column string) string
+	// size размер базы для администратора
+	size() (string, error)
+}
+
+// sqlDialect диалект текущей базы, выбирается в Init
+var sqlDialect dialect = postgres{}
@@ -1,8 +1,9 @@
 package models
 
 import (
-	"errors"
+	"context"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,64 +19,74 @@ type Subvideo struct {
 	URL         string    `xorm:"'url'"`
 	ThumbURL    string    `xorm:"'thumb_url'"`
 	Length      int       `xorm:"'length'"`
+	Language    string    `xorm:"'language'"`
 	Date        time.Time `xorm:"'date'"`
 	UserID      int64     `xorm:"notnull index 'user_id'"`
-	CreatedAt   time.Time `xorm:"created"`
-	UpdatedAt   time.Time `xorm:"updated"`
+	// Backfilled видео из загрузки истории: created_at у него - время
+	// загрузки, а не появления, поэтому в дайджест и счетчики новых оно не идет
+	Backfilled bool      `xorm:"notnull default false 'backfilled'"`
+	CreatedAt  time.Time `xorm:"created"`
+	UpdatedAt  time.Time `xorm:"updated"`
 }
 
-func (subvideo Subvideo) Insert() (err error) {
-	b, err := x.Get(&Subvideo{URL: subvideo.URL, UserID: subvideo.UserID})
+// Insert добавляет видео или обновляет существующее, inserted - видео новое.
+// Отмена ctx прерывает запись до того, как она началась
+func (subvideo *Subvideo) Insert(ctx context.Context) (inserted bool, err error) {
+	b, err := x.Context(ctx).Get(&Subvideo{URL: subvideo.URL, UserID: subvideo.UserID})
 	if err != nil {
-		return err
+		return false, err
 	}
 	if b == false {
-		_, err = x.Insert(&subvideo)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err = x.Update(&subvideo, Subvideo{URL: subvideo.URL, UserID: subvideo.UserID})
+		_, err = x.Context(ctx).Insert(subvideo)
 		if err != nil {
-			return err
+			return false, err
 		}
+		return true, nil
 	}
-	return nil
+	// загрузка истории не помечает видео, которое уже пришло синхронизацией
+	_, err = x.Context(ctx).Omit("backfilled").Update(subvideo, Subvideo{URL: subvideo.URL, UserID: subvideo.UserID})
+	if err != nil {
+		return false, err
+	}
+	return false, nil
 }
 
-func SelectVideo(userID, n int, channelID string, page int) (subvideos []Subvideo, countVideos int, err error) {
+func (s sqlStore) SelectVideo(userID, n int, channelID string, page int, showHidden bool) (subvideos []Subvideo, countVideos int, err error) {
+	where := "user_id = ?"
+	args := []interface{}{userID}
+	if channelID != "" {
+		where += " AND channel_id = ?"
+		args = append(args, channelID)
+	}
+	return selectVideoWhere(int64(userID), where, args, n, page, showHidden)
+}
+
+func selectVideoWhere(userID int64, where string, args []interface{}, n, page int, showHidden bool) (subvideos []Subvideo, countVideos int, err error) {
 	var countS []map[string]string
 
-	if channelID == "" {
-		err = x.Where("user_id = ?", userID).
-			Desc("date").
-			Limit(n, page*n-n).
-			Find(&subvideos)
-		if err != nil {
-			return subvideos, countVideos, err
-		}
-		countS, err = x.QueryString("SELECT count(*) FROM subvideo WHERE user_id = ?", userID)
-		if err != nil {
-			return subvideos, countVideos, err
-		}
-	} else {
-		err = x.Where("user_id = ? AND channel_id = ?", userID, channelID).
-			Desc("date").
-			Limit(n, page*n-n).
-			Find(&subvideos)
-		if err != nil {
-			return subvideos, countVideos, err
-		}
-		countS, err = x.QueryString("SELECT count(*) FROM subvideo WHERE user_id = ? AND channel_id = ?", userID, channelID)
+	if !showHidden {
+		where, args, err = withFilters(userID, where, args)
 		if err != nil {
 			return subvideos, countVideos, err
 		}
 	}
+
+	err = x.Where(where, args...).
+		Desc("date").
+		Limit(n, page*n-n).
+		Find(&subvideos)
+	if err != nil {
+		return subvideos, countVideos, err
+	}
+	countS, err = x.QueryString(append([]interface{}{"SELECT count(*) AS count FROM subvideo WHERE " + where}, args...)...)
+	if err != nil {
+		return subvideos, countVideos, err
+	}
 	countVideos, err = strconv.Atoi(countS[0]["count"])
 	return subvideos, countVideos, err
 }
 
-func SelectStreamVideo(userID int) (subvideos []Subvideo, err error) {
+func (s sqlStore) SelectStreamVideo(userID int) (subvideos []Subvideo, err error) {
 	duration := time.Hour * 3
 	dateInterval := time.Now().Add(-duration)
 	dateInterval.Format(time.RFC3339)
@@ -89,24 +100,56 @@ func SelectStreamVideo(userID int) (subvideos []Subvideo, err error) {
 	return subvideos, nil
 }
 
-func SearchVideo(search string, userID, n, page int) (subvideos []Subvideo, countVideos int, err error) {
+// SearchResult видео из поиска с подсвеченным фрагментом описания
+type SearchResult struct {
+	Subvideo `xorm:"extends"`
+	Headline string `xorm:"'headline'"`
+}
+
+func (s sqlStore) SearchVideo(query SearchQuery, userID, n, page int, showHidden bool) (results []SearchResult, countVideos int, err error) {
 	var countS []map[string]string
-	err = x.Where("tsv @@ plainto_tsquery(?) AND user_id = ?", search, userID).
-		Desc("date").
-		Limit(n, page*n-n).
-		Find(&subvideos)
+
+	conditions, args := query.where()
+	where := strings.Join(append([]string{"user_id = ?"}, conditions...), " AND ")
+	args = append([]interface{}{userID}, args...)
+	if !showHidden {
+		where, args, err = withFilters(int64(userID), where, args)
+		if err != nil {
+			return results, countVideos, err
+		}
+	}
+
+	headline := "''"
+	order := "date DESC"
+	var selectArgs, orderArgs []interface{}
+	if query.Text != "" {
+		headline, selectArgs = sqlDialect.headline(query.Text)
+		if query.ByRank {
+			order, orderArgs = sqlDialect.rank(query.Text)
+			order += ", date DESC"
+		}
+	}
+
+	sql := "SELECT subvideo.*, " + headline + " AS headline FROM subvideo WHERE " + where +
+		" ORDER BY " + order + " LIMIT ? OFFSET ?"
+	var sqlArgs []interface{}
+	sqlArgs = append(sqlArgs, selectArgs...)
+	sqlArgs = append(sqlArgs, args...)
+	sqlArgs = append(sqlArgs, orderArgs...)
+	sqlArgs = append(sqlArgs, n, page*n-n)
+	err = x.SQL(sql, sqlArgs...).Find(&results)
 	if err != nil {
-		return subvideos, countVideos, err
+		return results, countVideos, err
 	}
-	countS, err = x.QueryString("SELECT count(*) FROM subvideo WHERE tsv @@ plainto_tsquery(?) AND user_id = ?", search, userID)
+	countS, err = x.QueryString(append([]interface{}{"SELECT count(*) AS count FROM subvideo WHERE " + where}, args...)...)
 	if err != nil {
-		return subvideos, countVideos, err
+		return results, countVideos, err
 	}
 	countVideos, err = strconv.Atoi(countS[0]["count"])
-	return subvideos, countVideos, err
+	return results, countVideos, err
 }
 
-func SelectVideoForID(id string) (subvideo Subvideo, err error) {
+func (s sqlStore) SelectVideoForID(id string) (subvideo Subvideo, err error) {
 	idInt, err := strconv.Atoi(id)
 	if err != nil {
 		return subvideo, err
@@ -118,13 +161,13 @@ func SelectVideoForID(id string) (subvideo Subvideo, err error) {
 		return subvideo, err
 	}
 	if b == false {
-		return subvideo, errors.New("No video")
+		return subvideo, ErrNotFound
 	}
 
 	return subvideo, nil
 }
 
-func SelectStreamOnlineYouTube(userID int) (subvideos []Subvideo, err error) {
+func (s sqlStore) SelectStreamOnlineYouTube(userID int) (subvideos []Subvideo, err error) {
 	err = x.Where("(type='youtube-stream-live' OR type='youtube-stream') AND user_id=?", userID).
 		Find(&subvideos)
 	if err != nil {
@@ -133,15 +176,13 @@ func SelectStreamOnlineYouTube(userID int) (subvideos []Subvideo, err error) {
 	return subvideos, nil
 }
 
-func DeleteVideoWhereInterval(day int) (err error) {
+func (s sqlStore) DeleteVideoWhereInterval(day int) (count int64, err error) {
 	duration := time.Hour * time.Duration(24*day)
 	dateInterval := time.Now().Add(-duration)
-	dateInterval.Format(time.RFC3339)
-	_, err = x.Where("date<?", dateInterval).Delete(&Subvideo{})
-	return err
+	return x.Where("date<?", dateInterval).Delete(&Subvideo{})
 }
 
-func DeleteVideoForVideoID(videoID string) (err error) {
+func (s sqlStore) DeleteVideoForVideoID(videoID string) (err error) {
 	_, err = x.Where("video_id = ?", videoID).Delete(&Subvideo{})
 	if err != nil {
 		return err
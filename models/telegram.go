@@ -0,0 +1,151 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+// TelegramLink связь пользователя с чатом в Telegram.
+// Пока чат не привязан, ChatID пустой, а Code ждет команды /start от бота.
+// Привязанный чат принадлежит одному пользователю, см. migrateTelegram
+type TelegramLink struct {
+	Id         int64
+	UserID     int64     `xorm:"notnull unique 'user_id'"`
+	ChatID     int64     `xorm:"index 'chat_id'"`
+	Code       string    `xorm:"index 'code'"`
+	CodeExpiry time.Time `xorm:"'code_expiry'"`
+	CreatedAt  time.Time `xorm:"created"`
+}
+
+// SetTelegramCode выдает пользователю одноразовый код привязки
+func SetTelegramCode(userID int64, code string, ttl time.Duration) (err error) {
+	link := TelegramLink{UserID: userID}
+	b, err := x.Get(&link)
+	if err != nil {
+		return err
+	}
+	link.Code = code
+	link.CodeExpiry = time.Now().UTC().Add(ttl)
+	if b == false {
+		_, err = x.Insert(&link)
+		return err
+	}
+	_, err = x.ID(link.Id).Cols("code", "code_expiry").Update(&link)
+	return err
+}
+
+// migrateTelegram один чат привязан не больше чем к одному пользователю.
+// Из старых дублей остается последняя привязка. Индекс частичный, потому
+// что у всех непривязанных ChatID нулевой
+func migrateTelegram() (err error) {
+	_, err = x.Exec("UPDATE telegram_link SET chat_id = 0 WHERE chat_id <> 0 AND id NOT IN " +
+		"(SELECT max(id) FROM telegram_link WHERE chat_id <> 0 GROUP BY chat_id)")
+	if err != nil {
+		return err
+	}
+	_, err = x.Exec("CREATE UNIQUE INDEX IF NOT EXISTS UQE_telegram_link_chat_id ON telegram_link (chat_id) WHERE chat_id <> 0")
+	return err
+}
+
+// LinkTelegram привязывает чат по коду, код после этого больше не годится.
+// Правила, которые слали в прежний чат пользователя, удаляются, а другой
+// пользователь, к которому был привязан этот чат, отвязывается
+func LinkTelegram(code string, chatID int64) (user User, err error) {
+	if code == "" {
+		return user, errors.New("Пустой код")
+	}
+	session := x.NewSession()
+	defer session.Close()
+	err = session.Begin()
+	if err != nil {
+		return user, err
+	}
+	user, err = linkTelegram(session, code, chatID)
+	if err != nil {
+		session.Rollback()
+		return user, err
+	}
+	return user, session.Commit()
+}
+
+func linkTelegram(session *xorm.Session, code string, chatID int64) (user User, err error) {
+	var link TelegramLink
+	b, err := session.Where("code = ? AND code_expiry > ?", code, time.Now().UTC()).Get(&link)
+	if err != nil {
+		return user, err
+	}
+	if b == false {
+		return user, errors.New("Код не найден или устарел")
+	}
+
+	if link.ChatID != 0 && link.ChatID != chatID {
+		_, err = session.Where("user_id = ? AND backend = ? AND target = ?",
+			link.UserID, "telegram", strconv.FormatInt(link.ChatID, 10)).Delete(&NotifyRule{})
+		if err != nil {
+			return user, err
+		}
+	}
+	var others []TelegramLink
+	err = session.Where("chat_id = ? AND user_id <> ?", chatID, link.UserID).Find(&others)
+	if err != nil {
+		return user, err
+	}
+	for _, other := range others {
+		_, err = session.Where("user_id = ? AND backend = ? AND target = ?",
+			other.UserID, "telegram", strconv.FormatInt(chatID, 10)).Delete(&NotifyRule{})
+		if err != nil {
+			return user, err
+		}
+		_, err = session.ID(other.Id).Delete(&TelegramLink{})
+		if err != nil {
+			return user, err
+		}
+	}
+
+	link.ChatID = chatID
+	link.Code = ""
+	_, err = session.ID(link.Id).Cols("chat_id", "code").Update(&link)
+	if err != nil {
+		return user, err
+	}
+	b, err = session.ID(link.UserID).Get(&user)
+	if err != nil {
+		return user, err
+	}
+	if b == false {
+		return user, ErrNotFound
+	}
+	return user, nil
+}
+
+func SelectTelegramLink(userID int64) (link TelegramLink, err error) {
+	_, err = x.Where("user_id = ?", userID).Get(&link)
+	return link, err
+}
+
+func SelectUserForTelegram(chatID int64) (user User, err error) {
+	var link TelegramLink
+	b, err := x.Where("chat_id = ?", chatID).Get(&link)
+	if err != nil {
+		return user, err
+	}
+	if b == false || chatID == 0 {
+		return user, ErrNotFound
+	}
+	b, err = x.ID(link.UserID).Get(&user)
+	if err != nil {
+		return user, err
+	}
+	if b == false {
+		return user, ErrNotFound
+	}
+	return user, nil
+}
+
+func DeleteTelegramLink(userID int64) (err error) {
+	_, err = x.Where("user_id = ?", userID).Delete(&TelegramLink{})
+	return err
+}
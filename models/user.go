@@ -1,8 +1,9 @@
 package models
 
 import (
-	"errors"
 	"time"
+
+	"github.com/go-xorm/xorm"
 )
 
 type User struct {
@@ -17,6 +18,9 @@ type User struct {
 	AvatarURL      string    `xorm:"'avatar_url'"`
 	Crypt          string    `xorm:"'crypt'"`
 	TimeZone       string    `xorm:"'timezone'"`
+	ShowHidden     bool      `xorm:"'show_hidden'"`
+	FeedToken      string    `xorm:"index 'feed_token'"`
+	Disabled       bool      `xorm:"notnull default false 'disabled'"`
 	CreatedAt      time.Time `xorm:"created"`
 	UpdatedAt      time.Time `xorm:"'updated_at'"`
 }
@@ -40,26 +44,123 @@ func (user User) Insert() error {
 	return nil
 }
 
-func SelectUserForUserName(name string) (user User, err error) {
+// SetShowHidden сохраняет флаг отдельно, так как Update пропускает false
+func (user User) SetShowHidden(showHidden bool) (err error) {
+	user.ShowHidden = showHidden
+	_, err = x.ID(user.Id).Cols("show_hidden").Update(&user)
+	return err
+}
+
+func (user User) SetFeedToken(token string) (err error) {
+	user.FeedToken = token
+	_, err = x.ID(user.Id).Cols("feed_token").Update(&user)
+	return err
+}
+
+func (s sqlStore) SelectUserForUserName(name string) (user User, err error) {
 	b, err := x.Where("username = ?", name).Get(&user)
 	if err != nil {
 		return user, err
 	}
 	if b == false {
-		return user, errors.New("No!")
+		return user, ErrNotFound
 	}
 	return user, err
 }
 
-func SelectUsers() (users []User, err error) {
+func (s sqlStore) SelectUserForID(id int64) (user User, err error) {
+	b, err := x.ID(id).Get(&user)
+	if err != nil {
+		return user, err
+	}
+	if b == false {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s sqlStore) SelectUserForFeedToken(token string) (user User, err error) {
+	if token == "" {
+		return user, ErrNotFound
+	}
+	b, err := x.Where("feed_token = ? AND disabled = ?", token, false).Get(&user)
+	if err != nil {
+		return user, err
+	}
+	if b == false {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s sqlStore) SelectUsers() (users []User, err error) {
 	err = x.Find(&users)
 	return users, err
 }
 
-func DeleteUserWhereInterval(day int) (err error) {
+// SetDisabled выключает пользователя: он не может войти и не синхронизируется
+func (user User) SetDisabled(disabled bool) (err error) {
+	user.Disabled = disabled
+	_, err = x.ID(user.Id).Cols("disabled").Update(&user)
+	return err
+}
+
+// userTables таблицы с данными пользователя, которые удаляются вместе с ним
+var userTables = []interface{}{
+	new(Subvideo),
+	new(Filter),
+	new(GroupChannel), new(Group),
+	new(SavedSearch),
+	new(NotifyDelivery), new(NotifyRule),
+	new(TelegramLink),
+	new(PushSubscription),
+	new(Digest),
+	new(SyncCursor),
+	new(Backfill),
+}
+
+// DeleteUser удаляет пользователя со всеми его данными
+func (s sqlStore) DeleteUser(id int64) (err error) {
+	session := x.NewSession()
+	defer session.Close()
+	err = session.Begin()
+	if err != nil {
+		return err
+	}
+	err = deleteUser(session, id)
+	if err != nil {
+		session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+func deleteUser(session *xorm.Session, id int64) (err error) {
+	for _, table := range userTables {
+		_, err = session.Where("user_id = ?", id).Delete(table)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = session.ID(id).Delete(&User{})
+	return err
+}
+
+// DeleteUserWhereInterval удаляет тех, кто не заходил day дней
+func (s sqlStore) DeleteUserWhereInterval(day int) (count int, err error) {
+	var users []User
 	duration := time.Hour * time.Duration(24*day)
 	dateInterval := time.Now().Add(-duration)
-	dateInterval.Format(time.RFC3339)
-	_, err = x.Where("updated_at<?", dateInterval).Delete(&User{})
-	return err
+	err = x.Where("updated_at<?", dateInterval).Find(&users)
+	if err != nil {
+		return count, err
+	}
+	for _, user := range users {
+		err = s.DeleteUser(user.Id)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
 }
@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/macaron.v1"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_http_requests_total",
+		Help: "HTTP запросы по маршрутам и кодам ответа.",
+	}, []string{"route", "method", "code"})
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "subvideo_http_request_duration_seconds",
+		Help:    "Время ответа по маршрутам.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	SyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "subvideo_sync_duration_seconds",
+		Help:    "Длительность синхронизации пользователя с площадкой.",
+		Buckets: []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"provider"})
+	SyncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_sync_errors_total",
+		Help: "Синхронизации, закончившиеся ошибкой.",
+	}, []string{"provider"})
+	SyncVideos = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "subvideo_sync_inserted_videos",
+		Help:    "Новые видео за одну синхронизацию.",
+		Buckets: []float64{0, 1, 2, 5, 10, 25, 50, 100},
+	}, []string{"provider"})
+
+	APICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_upstream_requests_total",
+		Help: "Запросы к API Twitch и YouTube по кодам ответа, code=error - ошибка сети.",
+	}, []string{"provider", "endpoint", "code"})
+	YouTubeQuota = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_youtube_quota_units_total",
+		Help: "Израсходованные единицы квоты YouTube Data API.",
+	}, []string{"endpoint"})
+	UpstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_upstream_retries_total",
+		Help: "Повторы запросов к площадкам после 429, 5xx и ошибок сети.",
+	}, []string{"provider"})
+	UpstreamCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "subvideo_upstream_cache_total",
+		Help: "Кэш ответов площадок: hit - без запроса, revalidated - ответ 304, miss - полный ответ.",
+	}, []string{"provider", "result"})
+	CircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "subvideo_upstream_circuit_open",
+		Help: "1 - площадка считается недоступной и запросы к ней не отправляются.",
+	}, []string{"provider"})
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequests, HTTPDuration, SyncDuration, SyncErrors, SyncVideos, APICalls, YouTubeQuota,
+		UpstreamRetries, UpstreamCache, CircuitOpen)
+}
+
+// RegisterDB добавляет статистику пула соединений
+func RegisterDB(db *sql.DB, name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// ObserveSync записывает результат одной синхронизации. saved - видео
+// сохранены, даже если err говорит, что часть каналов опросить не удалось
+func ObserveSync(provider string, start time.Time, inserted int, saved bool, err error) {
+	SyncDuration.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+	if err != nil {
+		SyncErrors.WithLabelValues(provider).Inc()
+	}
+	if saved {
+		SyncVideos.WithLabelValues(provider).Observe(float64(inserted))
+	}
+}
+
+// Middleware считает запросы, route отдает маршрут запроса, чтобы
+// ID в адресах не раздували число меток
+func Middleware(route func(ctx *macaron.Context) string) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		label := route(ctx)
+		status := ctx.Resp.Status()
+		if status == 0 {
+			status = 200
+		}
+		method := requestMethod(ctx.Req.Method)
+		HTTPRequests.WithLabelValues(label, method, strconv.Itoa(status)).Inc()
+		HTTPDuration.WithLabelValues(label, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// requestMethod метод для метки, выдуманные клиентом методы становятся
+// other, чтобы не плодить ряды
+func requestMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// Handler отдает метрики, если token не пустой - только с Authorization: Bearer token
+func Handler(token func() string) macaron.Handler {
+	handler := promhttp.Handler()
+	return func(ctx *macaron.Context) {
+		if token := token(); token != "" {
+			auth := ctx.Req.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+				ctx.Resp.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				ctx.Error(401, "Unauthorized")
+				return
+			}
+		}
+		handler.ServeHTTP(ctx.Resp, ctx.Req.Request)
+	}
+}
+
+// Transport считает запросы к площадке, для YouTube еще и квоту
+type Transport struct {
+	Provider string
+	Base     http.RoundTripper
+}
+
+func NewTransport(provider string, base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Provider: provider, Base: base}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req.URL.Host, req.URL.Path)
+	resp, err := t.Base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	APICalls.WithLabelValues(t.Provider, endpoint, code).Inc()
+	if t.Provider == "youtube" && strings.HasPrefix(req.URL.Path, "/youtube/") {
+		YouTubeQuota.WithLabelValues(endpoint).Add(float64(youtubeQuotaCost(endpoint)))
+	}
+	return resp, err
+}
+
+var idSegment = regexp.MustCompile(`/\d+(/|$)`)
+
+// Endpoint короткое имя метода API без идентификаторов
+func Endpoint(host, path string) string {
+	if strings.HasPrefix(path, "/youtube/v3/") {
+		return strings.TrimPrefix(path, "/youtube/v3/")
+	}
+	if strings.Contains(path, "oauth2") || strings.HasSuffix(path, "/token") {
+		return "oauth2"
+	}
+	path = strings.TrimPrefix(path, "/kraken")
+	for idSegment.MatchString(path) {
+		path = idSegment.ReplaceAllString(path, "/:id$1")
+	}
+	if path == "" {
+		return host
+	}
+	return path
+}
+
+// youtubeQuotaCost цена вызова в единицах квоты, list стоит 1, search - 100
+func youtubeQuotaCost(endpoint string) int {
+	if endpoint == "search" {
+		return 100
+	}
+	return 1
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/notify"
+	"github.com/DeKoniX/subvideo/telegram"
+	"github.com/DeKoniX/subvideo/video"
+	"gopkg.in/macaron.v1"
+)
+
+type NotifyRuleForm struct {
+	Backend   string `form:"backend" binding:"Required"`
+	Target    string `form:"target" binding:"Required"`
+	Event     string `form:"event"`
+	ChannelID string `form:"channel_id"`
+	GroupID   int64  `form:"group_id"`
+	TypeSub   string `form:"type"`
+	Keyword   string `form:"keyword"`
+}
+
+func initNotify() *notify.Dispatcher {
+	dispatcher := notify.New(config().Notify.Retries, time.Duration(config().Notify.Backoff)*time.Second)
+	dispatcher.Register(webhookSender())
+	if config().SMTP.Host != "" {
+		dispatcher.Register(smtpSender())
+	}
+	if webPushEnabled() {
+		dispatcher.Register(webPushSender())
+	} else {
+		slog.Warn("web push is disabled, run subvideo -vapid to generate keys")
+	}
+	if telegramBot != nil {
+		dispatcher.Register(&telegram.Backend{Client: telegramBot.Client})
+	}
+	return dispatcher
+}
+
+func webhookSender() *notify.Webhook {
+	return &notify.Webhook{
+		Secret:     config().Notify.WebhookSecret,
+		HTTPClient: notify.NewPublicClient(30 * time.Second),
+	}
+}
+
+func smtpSender() *notify.SMTP {
+	port := config().SMTP.Port
+	if port == "" {
+		port = "25"
+	}
+	return &notify.SMTP{
+		Host:     config().SMTP.Host,
+		Port:     port,
+		UserName: config().SMTP.UserName,
+		Password: config().SMTP.Password,
+		From:     config().SMTP.From,
+	}
+}
+
+// notifySync превращает результат синхронизации в события уведомлений
+func notifySync(ctx context.Context, user models.User, result video.SyncResult) {
+	var events []notify.Event
+	for _, video := range result.NewVideos {
+		events = append(events, notify.Event{
+			Kind:  notify.EventNewVideo,
+			Key:   "video:" + video.VideoID,
+			User:  user,
+			Video: video,
+		})
+	}
+	for _, video := range result.WentLive {
+		events = append(events, liveEvent(user, video))
+	}
+	notifier.Dispatch(ctx, events...)
+}
+
+func liveEvent(user models.User, video models.Subvideo) notify.Event {
+	key := "live:" + video.VideoID
+	if video.TypeSub == "twitch-stream" {
+		key = fmt.Sprintf("live:%s:%d", video.ChannelID, video.Date.Unix())
+	}
+	return notify.Event{Kind: notify.EventLive, Key: key, User: user, Video: video}
+}
+
+// runLive проверяет стримы на Twitch у пользователей с правилами уведомлений,
+// о повторах заботится журнал доставки
+func runLive() {
+	for {
+		// интервал перечитывается, чтобы его меняла перезагрузка конфигурации
+		interval := time.Duration(config().Notify.LiveInterval) * time.Minute
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		status.beat("live", "waiting")
+		if !app.sleep(interval) {
+			return
+		}
+		status.beat("live", "checking streams")
+
+		users, err := models.SelectNotifyUsers()
+		if err != nil {
+			slog.Error("notify users failed", "err", err)
+			continue
+		}
+		for _, user := range users {
+			if app.stopped() {
+				return
+			}
+			streams, err := liveStreams.refresh(app.stop, user)
+			if err != nil {
+				slog.Error("live streams failed", "provider", "twitch", "user", user.UserName, "err", err)
+				continue
+			}
+			var events []notify.Event
+			for _, stream := range streams {
+				events = append(events, liveEvent(user, stream))
+			}
+			notifier.Dispatch(app.work, events...)
+		}
+	}
+}
+
+func notifyHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	rules, err := models.SelectNotifyRules(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "notify rules failed", "err", err)
+	}
+	deliveries, err := models.SelectDeliveries(user.Id, 50)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "notify deliveries failed", "err", err)
+	}
+	groups, err := models.SelectGroups(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "groups failed", "err", err)
+	}
+	channels, err := models.Videos.SelectChannels(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "channels failed", "err", err)
+	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: "Уведомления", URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Rules"] = rules
+	ctx.Data["Deliveries"] = deliveries
+	ctx.Data["Groups"] = groups
+	ctx.Data["Channels"] = channels
+	ctx.Data["Backends"] = notifier.Backends()
+	ctx.Data["NotifyError"] = ctx.Query("notify_error")
+	if webPushEnabled() {
+		subs, err := models.SelectPushSubscriptions(user.Id)
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "push subscriptions failed", "err", err)
+		}
+		ctx.Data["WebPush"] = true
+		ctx.Data["PushKey"] = config().WebPush.PublicKey
+		ctx.Data["PushDevices"] = subs
+	}
+	ctx.HTML(200, "notify")
+}
+
+func notifyAddHandler(ctx *macaron.Context, ruleForm NotifyRuleForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	// способ, который не включен на сервере, ронял бы каждую доставку
+	if ruleForm.Backend != "" && !notifyBackendEnabled(ruleForm.Backend) {
+		ctx.Redirect(config().Server.BasePath + "/user/notify?notify_error=" +
+			url.QueryEscape("Способ доставки не настроен на сервере: "+ruleForm.Backend))
+		return
+	}
+	if ruleForm.GroupID != 0 {
+		_, err := models.SelectGroup(ruleForm.GroupID, user.Id)
+		if err != nil {
+			ruleForm.GroupID = 0
+		}
+	}
+	rule := models.NotifyRule{
+		UserID:    user.Id,
+		Backend:   ruleForm.Backend,
+		Target:    ruleForm.Target,
+		Event:     ruleForm.Event,
+		ChannelID: ruleForm.ChannelID,
+		GroupID:   ruleForm.GroupID,
+		TypeSub:   ruleForm.TypeSub,
+		Keyword:   ruleForm.Keyword,
+	}
+	err := rule.Insert()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "notify rule add failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/user/notify?notify_error=" + url.QueryEscape(err.Error()))
+		return
+	}
+	ctx.Redirect(config().Server.BasePath + "/user/notify")
+}
+
+func notifyBackendEnabled(name string) bool {
+	for _, backend := range notifier.Backends() {
+		if backend == name {
+			return true
+		}
+	}
+	return false
+}
+
+func notifyDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	err := models.DeleteNotifyRule(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "notify rule delete failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/user/notify")
+}
+
+func notifyRuleText(rule models.NotifyRule) string {
+	text := "Видео и стримы"
+	switch rule.Event {
+	case notify.EventNewVideo:
+		text = "Новые видео"
+	case notify.EventLive:
+		text = "Начало стрима"
+	case notify.EventSavedSearch:
+		text = "Сохраненные поиски"
+	}
+	if rule.ChannelID != "" {
+		text += ", канал " + rule.ChannelID
+	}
+	if rule.GroupID != 0 {
+		text += ", группа #" + strconv.FormatInt(rule.GroupID, 10)
+	}
+	if rule.TypeSub != "" {
+		text += ", тип " + rule.TypeSub
+	}
+	if rule.Keyword != "" {
+		text += ", слово «" + rule.Keyword + "»"
+	}
+	return text
+}
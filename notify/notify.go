@@ -0,0 +1,408 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+)
+
+// Виды событий
+const (
+	EventNewVideo    = "new-video"
+	EventLive        = "live"
+	EventSavedSearch = "saved-search"
+)
+
+// Event событие синхронизации, Key - уникальный ключ события для защиты от повторов.
+// Search - имя сохраненного поиска для EventSavedSearch
+type Event struct {
+	Kind   string
+	Key    string
+	User   models.User
+	Video  models.Subvideo
+	Search string
+}
+
+// Message то, что уходит получателю
+type Message struct {
+	Event     string    `json:"event"`
+	User      string    `json:"user"`
+	Title     string    `json:"title"`
+	Channel   string    `json:"channel"`
+	ChannelID string    `json:"channel_id"`
+	Type      string    `json:"type"`
+	Game      string    `json:"game,omitempty"`
+	URL       string    `json:"url"`
+	ThumbURL  string    `json:"thumb_url"`
+	Date      time.Time `json:"date"`
+	Search    string    `json:"search,omitempty"`
+}
+
+// Backend способ доставки, target - адрес из правила пользователя
+type Backend interface {
+	Name() string
+	Send(ctx context.Context, target string, message Message) error
+}
+
+// Dispatcher доставляет уведомления. Очередь в памяти только ускоряет
+// доставку: если она полна, доставка остается в базе со статусом pending,
+// и ее подхватит опрос раз в Poll
+type Dispatcher struct {
+	Retries int
+	Backoff time.Duration
+	Timeout time.Duration
+	// Poll как часто забирать из базы недоставленное, 0 - не забирать:
+	// subvideo sync отправляет только свое, остальное - дело сервера
+	Poll time.Duration
+
+	mu       sync.RWMutex
+	backends map[string]Backend
+	queue    chan int64
+
+	queuedMu sync.Mutex
+	// queued доставки в очереди или в работе, чтобы опрос не отправил
+	// их второй раз
+	queued map[int64]bool
+}
+
+// Queued сколько доставок ждет в очереди
+func (d *Dispatcher) Queued() int {
+	return len(d.queue)
+}
+
+func New(retries int, backoff time.Duration) *Dispatcher {
+	if retries <= 0 {
+		retries = 5
+	}
+	if backoff <= 0 {
+		backoff = time.Minute
+	}
+	return &Dispatcher{
+		Retries:  retries,
+		Backoff:  backoff,
+		Timeout:  30 * time.Second,
+		Poll:     30 * time.Second,
+		backends: map[string]Backend{},
+		queue:    make(chan int64, 1024),
+		queued:   map[int64]bool{},
+	}
+}
+
+func (d *Dispatcher) Register(backend Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.backends[backend.Name()] = backend
+}
+
+// Unregister убирает способ доставки, его доставки будут падать с ошибкой
+func (d *Dispatcher) Unregister(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.backends, name)
+}
+
+func (d *Dispatcher) Backends() (names []string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for name := range d.backends {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (d *Dispatcher) backend(name string) (Backend, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	backend, ok := d.backends[name]
+	return backend, ok
+}
+
+// Start запускает доставку и опрос базы, который подхватывает недоставленное
+// до перезапуска и то, что не поместилось в очередь. Отмена ctx
+// останавливает и то и другое, начатые отправки доходят до конца
+func (d *Dispatcher) Start(ctx context.Context, workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go d.worker(ctx)
+	}
+	if d.Poll > 0 {
+		go d.poll(ctx)
+	}
+}
+
+// Dispatch сверяет события с правилами пользователей и ставит доставки в
+// очередь. О каналах, которые пользователь скрыл, уведомлений нет
+func (d *Dispatcher) Dispatch(ctx context.Context, events ...Event) {
+	rules := map[int64][]models.NotifyRule{}
+	muted := map[int64]map[string]bool{}
+	for _, event := range events {
+		userRules, ok := rules[event.User.Id]
+		if !ok {
+			var err error
+			userRules, err = models.SelectNotifyRules(event.User.Id)
+			if err != nil {
+				slog.ErrorContext(ctx, "notify rules failed", "err", err)
+				continue
+			}
+			muted[event.User.Id], err = models.SelectMutedChannels(event.User.Id)
+			if err != nil {
+				slog.ErrorContext(ctx, "notify muted channels failed", "err", err)
+				continue
+			}
+			rules[event.User.Id] = userRules
+		}
+		if muted[event.User.Id][event.Video.ChannelID] {
+			continue
+		}
+
+		for _, rule := range userRules {
+			if !Match(rule, event) {
+				continue
+			}
+			if _, ok := d.backend(rule.Backend); !ok {
+				continue
+			}
+			exists, err := models.DeliveryExists(rule.Id, event.Key)
+			if err != nil {
+				slog.ErrorContext(ctx, "notify delivery check failed", "rule_id", rule.Id, "err", err)
+				continue
+			}
+			if exists {
+				continue
+			}
+
+			payload, err := json.Marshal(NewMessage(event))
+			if err != nil {
+				slog.ErrorContext(ctx, "notify payload failed", "err", err)
+				continue
+			}
+			delivery := models.NotifyDelivery{
+				RuleID:    rule.Id,
+				UserID:    rule.UserID,
+				Backend:   rule.Backend,
+				Target:    rule.Target,
+				EventKey:  event.Key,
+				Title:     event.Video.Title,
+				Payload:   string(payload),
+				Status:    models.DeliveryPending,
+				NextTryAt: time.Now().UTC(),
+			}
+			err = delivery.Insert()
+			if err != nil {
+				slog.ErrorContext(ctx, "notify delivery insert failed", "rule_id", rule.Id, "err", err)
+				continue
+			}
+			slog.DebugContext(ctx, "notify scheduled", "delivery_id", delivery.Id, "backend", delivery.Backend, "event", event.Key)
+			d.schedule(delivery.Id, 0)
+		}
+	}
+}
+
+// Match проверяет событие по правилу, пустое поле правила подходит под все.
+// Совпадение поиска - только для правил именно на него: правило на все
+// события уже сообщило об этом видео как о новом
+func Match(rule models.NotifyRule, event Event) bool {
+	video := event.Video
+	if rule.Event != "" && rule.Event != event.Kind {
+		return false
+	}
+	if rule.Event == "" && event.Kind == EventSavedSearch {
+		return false
+	}
+	if rule.ChannelID != "" && rule.ChannelID != video.ChannelID {
+		return false
+	}
+	if rule.TypeSub != "" && !matchType(rule.TypeSub, video.TypeSub) {
+		return false
+	}
+	if rule.Keyword != "" {
+		keyword := strings.ToLower(rule.Keyword)
+		text := strings.ToLower(video.Title + " " + video.Game + " " + video.Description)
+		if !strings.Contains(text, keyword) {
+			return false
+		}
+	}
+	if rule.GroupID != 0 {
+		ok, err := models.GroupHasChannel(rule.GroupID, video.ChannelID)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchType(ruleType, typeSub string) bool {
+	switch ruleType {
+	case "twitch":
+		return strings.HasPrefix(typeSub, "twitch")
+	case "youtube":
+		return strings.HasPrefix(typeSub, "youtube")
+	}
+	return ruleType == typeSub
+}
+
+func NewMessage(event Event) Message {
+	return Message{
+		Event:     event.Kind,
+		User:      event.User.UserName,
+		Title:     event.Video.Title,
+		Channel:   event.Video.Channel,
+		ChannelID: event.Video.ChannelID,
+		Type:      event.Video.TypeSub,
+		Game:      event.Video.Game,
+		URL:       event.Video.URL,
+		ThumbURL:  event.Video.ThumbURL,
+		Date:      event.Video.Date,
+		Search:    event.Search,
+	}
+}
+
+// schedule ставит доставку в очередь через after. Dispatch вызывается из
+// синхронизации и ждать очередь не должен: если места нет, доставку
+// подхватит опрос
+func (d *Dispatcher) schedule(id int64, after time.Duration) {
+	if after <= 0 {
+		d.enqueue(id)
+		return
+	}
+	time.AfterFunc(after, func() {
+		d.enqueue(id)
+	})
+}
+
+// enqueue false - очередь полна
+func (d *Dispatcher) enqueue(id int64) bool {
+	d.queuedMu.Lock()
+	defer d.queuedMu.Unlock()
+	if d.queued[id] {
+		return true
+	}
+	select {
+	case d.queue <- id:
+		d.queued[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait ждет, пока очередь опустеет и начатые доставки закончатся. Повторы
+// после ошибки не ждет: они остаются в базе для опроса
+func (d *Dispatcher) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		d.queuedMu.Lock()
+		idle := len(d.queued) == 0
+		d.queuedMu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dequeued(id int64) {
+	d.queuedMu.Lock()
+	defer d.queuedMu.Unlock()
+	delete(d.queued, id)
+}
+
+func (d *Dispatcher) poll(ctx context.Context) {
+	ticker := time.NewTicker(d.Poll)
+	defer ticker.Stop()
+	for {
+		deliveries, err := models.SelectDueDeliveries(time.Now().UTC(), cap(d.queue))
+		if err != nil {
+			slog.Error("notify pending deliveries failed", "err", err)
+		}
+		for _, delivery := range deliveries {
+			if !d.enqueue(delivery.Id) {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-d.queue:
+			d.deliver(id)
+			d.dequeued(id)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(id int64) {
+	now := time.Now().UTC()
+	claimed, err := models.ClaimDelivery(id, now, now.Add(2*d.Timeout))
+	if err != nil || !claimed {
+		if err != nil {
+			slog.Error("notify delivery claim failed", "delivery_id", id, "err", err)
+		}
+		return
+	}
+	delivery, err := models.SelectNotifyDelivery(id)
+	if err != nil {
+		slog.Error("notify delivery failed", "delivery_id", id, "err", err)
+		return
+	}
+
+	var message Message
+	err = json.Unmarshal([]byte(delivery.Payload), &message)
+	if err == nil {
+		backend, ok := d.backend(delivery.Backend)
+		if ok {
+			ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+			err = backend.Send(ctx, delivery.Target, message)
+			cancel()
+		} else {
+			err = errNoBackend(delivery.Backend)
+		}
+	}
+
+	delivery.Attempts++
+	if err == nil {
+		delivery.Status = models.DeliveryOK
+		delivery.Error = ""
+	} else {
+		delivery.Error = err.Error()
+		if delivery.Attempts >= d.Retries {
+			delivery.Status = models.DeliveryFailed
+			slog.Error("notify send failed", "delivery_id", delivery.Id, "backend", delivery.Backend, "attempts", delivery.Attempts, "err", err)
+		} else {
+			after := d.Backoff * time.Duration(1<<uint(delivery.Attempts-1))
+			delivery.NextTryAt = time.Now().UTC().Add(after)
+			d.schedule(delivery.Id, after)
+		}
+	}
+	err = delivery.Update()
+	if err != nil {
+		slog.Error("notify delivery update failed", "delivery_id", delivery.Id, "err", err)
+	}
+}
+
+type errNoBackend string
+
+func (e errNoBackend) Error() string {
+	return "notify: backend " + string(e) + " is not configured"
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScheduleFullQueue синхронизация не ждет, пока освободится очередь
+func TestScheduleFullQueue(t *testing.T) {
+	d := New(1, time.Second)
+	d.queue = make(chan int64, 2)
+
+	done := make(chan struct{})
+	go func() {
+		for id := int64(1); id <= 5; id++ {
+			d.schedule(id, 0)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("schedule blocked on a full queue")
+	}
+	if d.Queued() != 2 {
+		t.Errorf("queued %d, want 2", d.Queued())
+	}
+
+	if !d.enqueue(1) || d.Queued() != 2 {
+		t.Error("delivery already in the queue was added again")
+	}
+	<-d.queue
+	d.dequeued(1)
+	if !d.enqueue(3) || d.Queued() != 2 {
+		t.Error("delivery left for the poll was not queued")
+	}
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP отправляет письмо на адрес из правила
+type SMTP struct {
+	Host     string
+	Port     string
+	UserName string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Name() string {
+	return "email"
+}
+
+func (s *SMTP) Send(ctx context.Context, target string, message Message) error {
+	subject, text := mailText(message)
+	return s.SendMail(ctx, target, subject, text, "")
+}
+
+// SendMail отправляет письмо, если html не пустой - вместе с текстом как multipart/alternative
+func (s *SMTP) SendMail(ctx context.Context, to, subject, text, html string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if html == "" {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(text)
+	} else {
+		boundary := fmt.Sprintf("subvideo-%d", time.Now().UnixNano())
+		fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, text)
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, html)
+		fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	}
+
+	var auth smtp.Auth
+	if s.UserName != "" {
+		auth = smtp.PlainAuth("", s.UserName, s.Password, s.Host)
+	}
+	return s.send(ctx, auth, to, msg.Bytes())
+}
+
+// send как smtp.SendMail, но соединение закрывается при отмене ctx: иначе
+// письмо может уйти уже после того, как доставка записана неудачной, и
+// повтор пришлет его второй раз
+func (s *SMTP) send(ctx context.Context, auth smtp.Auth, to string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.Host, s.Port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: s.Host})
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			err = c.Auth(auth)
+			if err != nil {
+				return contextError(ctx, err)
+			}
+		}
+	}
+	err = c.Mail(s.From)
+	if err == nil {
+		err = c.Rcpt(to)
+	}
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	_, err = w.Write(msg)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return c.Quit()
+}
+
+// contextError ошибка закрытого соединения, если его закрыла отмена ctx
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func mailText(message Message) (subject, text string) {
+	switch message.Event {
+	case EventLive:
+		subject = fmt.Sprintf("%s в эфире: %s", message.Channel, message.Title)
+	case EventSavedSearch:
+		subject = fmt.Sprintf("Поиск «%s», %s: %s", message.Search, message.Channel, message.Title)
+	default:
+		subject = fmt.Sprintf("Новое видео %s: %s", message.Channel, message.Title)
+	}
+	text = subject + "\r\n\r\n" + message.URL + "\r\n"
+	if message.Game != "" {
+		text += "\r\nИгра: " + message.Game + "\r\n"
+	}
+	return subject, text
+}
@@ -0,0 +1,93 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpServer принимает одно письмо. hang - не отвечать на конец письма,
+// как зависший сервер
+func smtpServer(t *testing.T, hang bool) (*SMTP, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	mail := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 test")
+		var data strings.Builder
+		for inData := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(mail)
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				mail <- data.String()
+				if hang {
+					// ждем, пока клиент сам закроет соединение
+					io.Copy(io.Discard, r)
+					return
+				}
+				reply("250 queued")
+			case inData:
+				data.WriteString(line)
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 test")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 go")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return &SMTP{Host: host, Port: port, From: "subvideo@example.com"}, mail
+}
+
+func TestSendMail(t *testing.T) {
+	s, mail := smtpServer(t, false)
+	err := s.SendMail(context.Background(), "user@example.com", "Тема", "text", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-mail; !strings.Contains(got, "To: user@example.com\r\n") || !strings.HasSuffix(got, "text\r\n") {
+		t.Errorf("mail = %q", got)
+	}
+}
+
+// TestSendMailCanceled отмена закрывает соединение, а не бросает отправку в фоне
+func TestSendMailCanceled(t *testing.T) {
+	s, _ := smtpServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.SendMail(ctx, "user@example.com", "Тема", "text", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("SendMail returned after %v", time.Since(start))
+	}
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress адрес вебхука или подписки Web Push ведет во внутреннюю
+// сеть или к метаданным облака, туда сервер от имени пользователя не ходит
+var ErrPrivateAddress = errors.New("private address")
+
+// reservedNets не публичные сети, которых нет среди проверок net.IP
+var reservedNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),
+	mustCIDR("100.64.0.0/10"),
+	mustCIDR("192.0.0.0/24"),
+	mustCIDR("198.18.0.0/15"),
+	mustCIDR("240.0.0.0/4"),
+	mustCIDR("64:ff9b::/96"),
+}
+
+func mustCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// publicIP адрес из интернета: не локальный, не частный, не link-local,
+// где живут метаданные облаков (169.254.169.254)
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl проверяет адрес уже после разрешения имени, поэтому DNS,
+// который отвечает внутренним адресом, не обходит проверку
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicIP(net.ParseIP(host)) {
+		return fmt.Errorf("%w %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+// NewPublicClient клиент, который соединяется только с публичными адресами,
+// для webhook и Web Push, чьи адреса задают пользователи. Прокси не
+// используется: иначе адрес назначения проверял бы не он
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport, CheckRedirect: noRedirect}
+}
+
+// noRedirect редирект отдается как ответ: идти по нему - значит дать
+// получателю выбрать адрес в обход правила
+func noRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// Webhook отправляет Message в JSON на адрес из правила.
+// Если задан Secret, тело подписывается в заголовке X-Subvideo-Signature.
+// HTTPClient без своего Transport ходит и во внутреннюю сеть, обычно это
+// NewPublicClient
+type Webhook struct {
+	Secret     string
+	HTTPClient *http.Client
+}
+
+func (webhook *Webhook) Name() string {
+	return "webhook"
+}
+
+func (webhook *Webhook) Send(ctx context.Context, target string, message Message) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "subvideo")
+	req.Header.Set("X-Subvideo-Event", message.Event)
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Subvideo-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := webhook.HTTPClient
+	if client == nil {
+		client = NewPublicClient(30 * time.Second)
+	}
+	noRedirectClient := *client
+	noRedirectClient.CheckRedirect = noRedirect
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: %s responded %s", target, resp.Status)
+	}
+	return nil
+}
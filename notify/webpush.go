@@ -0,0 +1,293 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+)
+
+// pushRecordSize размер записи aes128gcm, сообщение помещается в одну запись
+const pushRecordSize = 4096
+
+// ErrPushGone подписка больше не действует, сервис ответил 404 или 410
+var ErrPushGone = errors.New("webpush: subscription is gone")
+
+// PushPayload то, что получает service worker в событии push
+type PushPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Icon  string `json:"icon,omitempty"`
+	Image string `json:"image,omitempty"`
+	URL   string `json:"url"`
+	Tag   string `json:"tag"`
+}
+
+// WebPush доставляет уведомления в браузер по RFC 8030/8291 с VAPID (RFC 8292),
+// target - ID подписки устройства
+type WebPush struct {
+	PublicKey  string
+	PrivateKey string
+	Subject    string
+	TTL        int
+	// HTTPClient адрес подписки присылает браузер, поэтому обычно это
+	// NewPublicClient, как у Webhook
+	HTTPClient *http.Client
+}
+
+func (push *WebPush) Name() string {
+	return "webpush"
+}
+
+func (push *WebPush) Send(ctx context.Context, target string, message Message) error {
+	id, err := strconv.ParseInt(target, 10, 64)
+	if err != nil {
+		return fmt.Errorf("webpush: bad subscription id %q", target)
+	}
+	sub, err := models.SelectPushSubscription(id)
+	if err != nil {
+		return ErrPushGone
+	}
+	if (message.Event == EventLive && sub.MuteLive) ||
+		((message.Event == EventNewVideo || message.Event == EventSavedSearch) && sub.MuteNewVideo) {
+		return nil
+	}
+
+	title := "Новое видео: " + message.Channel
+	switch message.Event {
+	case EventLive:
+		title = "В эфире: " + message.Channel
+	case EventSavedSearch:
+		title = "Поиск «" + message.Search + "»: " + message.Channel
+	}
+	payload, err := json.Marshal(PushPayload{
+		Title: title,
+		Body:  message.Title,
+		Image: message.ThumbURL,
+		Icon:  "/android-chrome-192x192.png",
+		URL:   message.URL,
+		Tag:   message.Event + ":" + message.ChannelID,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = push.send(ctx, sub, payload)
+	if err == ErrPushGone {
+		models.DeletePushSubscription(sub.Id)
+		models.DeleteNotifyRulesFor(sub.UserID, push.Name(), target)
+	}
+	return err
+}
+
+func (push *WebPush) send(ctx context.Context, sub models.PushSubscription, payload []byte) error {
+	body, err := EncryptPush(sub.P256dh, sub.Auth, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := push.vapid(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	ttl := push.TTL
+	if ttl <= 0 {
+		ttl = 24 * 60 * 60
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Authorization", authorization)
+
+	client := push.HTTPClient
+	if client == nil {
+		client = NewPublicClient(30 * time.Second)
+	}
+	noRedirectClient := *client
+	noRedirectClient.CheckRedirect = noRedirect
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		return ErrPushGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("webpush: push service responded %s", resp.Status)
+	}
+	return nil
+}
+
+// vapid собирает заголовок Authorization с JWT, подписанным ES256
+func (push *WebPush) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	key, err := vapidPrivateKey(push.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	header := b64(mustJSON(map[string]string{"typ": "JWT", "alg": "ES256"}))
+	claims := b64(mustJSON(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": push.Subject,
+	}))
+	unsigned := header + "." + claims
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return "vapid t=" + unsigned + "." + b64(signature) + ", k=" + push.PublicKey, nil
+}
+
+// GenerateVAPIDKeys создает пару ключей P-256 в base64url: открытый ключ
+// несжатой точкой, закрытый - 32 байта скаляра
+func GenerateVAPIDKeys() (publicKey, privateKey string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	d := make([]byte, 32)
+	key.D.FillBytes(d)
+	return b64(elliptic.Marshal(elliptic.P256(), key.X, key.Y)), b64(d), nil
+}
+
+func vapidPrivateKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	d, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("webpush: bad VAPID private key")
+	}
+	key := new(ecdsa.PrivateKey)
+	key.Curve = elliptic.P256()
+	key.D = new(big.Int).SetBytes(d)
+	key.X, key.Y = key.Curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+// EncryptPush шифрует сообщение для подписки по RFC 8291 (aes128gcm)
+func EncryptPush(p256dh, auth string, plaintext []byte) ([]byte, error) {
+	asKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return encryptPush(p256dh, auth, plaintext, asKey, salt)
+}
+
+// encryptPush EncryptPush с заданными ключом сервера и солью, для проверки
+// по примеру из RFC 8291
+func encryptPush(p256dh, auth string, plaintext []byte, asKey *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext)+17 > pushRecordSize {
+		return nil, errors.New("webpush: payload is too large")
+	}
+	uaPublic, err := decodeB64(p256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeB64(auth)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("webpush: bad p256dh key")
+	}
+
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 - разделитель последней записи
+	padded := append(append(make([]byte, 0, len(plaintext)+1), plaintext...), 2)
+	record := gcm.Seal(nil, nonce, padded, nil)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return append(header, record...), nil
+}
+
+// hkdf HKDF-SHA256 для одного блока, длины тут не больше 32 байт
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+func decodeB64(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		return b, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
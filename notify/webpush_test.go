@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Пример из RFC 8291, раздел 5
+const (
+	rfcPlaintext = "When I grow up, I want to be a watermelon"
+	rfcASPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcASPublic  = "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8"
+	rfcUAPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcUAPublic  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcSalt      = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuth      = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcMessage   = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func TestEncryptPushRFC8291(t *testing.T) {
+	asKey, err := vapidPrivateKey(rfcASPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public := b64(elliptic.Marshal(elliptic.P256(), asKey.X, asKey.Y)); public != rfcASPublic {
+		t.Fatalf("as_public = %s, want %s", public, rfcASPublic)
+	}
+	salt, err := decodeB64(rfcSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte(rfcPlaintext)
+	message, err := encryptPush(rfcUAPublic, rfcAuth, plaintext, asKey, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b64(message); got != rfcMessage {
+		t.Errorf("encryptPush =\n%s\nwant\n%s", got, rfcMessage)
+	}
+	if string(plaintext) != rfcPlaintext {
+		t.Errorf("plaintext modified: %q", plaintext)
+	}
+}
+
+// TestEncryptPushDecrypt случайные ключ и соль: браузер с ключом ua_private
+// должен расшифровать сообщение
+func TestEncryptPushDecrypt(t *testing.T) {
+	message, err := EncryptPush(rfcUAPublic, rfcAuth, []byte(rfcPlaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := EncryptPush(rfcUAPublic, rfcAuth, []byte(rfcPlaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(message, first) {
+		t.Error("two messages are identical, salt or key is not random")
+	}
+
+	salt := message[:16]
+	if rs := binary.BigEndian.Uint32(message[16:20]); rs != pushRecordSize {
+		t.Errorf("record size = %d", rs)
+	}
+	keyLen := int(message[20])
+	asPublic := message[21 : 21+keyLen]
+	record := message[21+keyLen:]
+
+	uaKey, err := vapidPrivateKey(rfcUAPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic, _ := decodeB64(rfcUAPublic)
+	authSecret, _ := decodeB64(rfcAuth)
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		t.Fatal("bad as_public in header")
+	}
+	sharedX, _ := curve.ScalarMult(asX, asY, uaKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+
+	ikm := hkdf(authSecret, ecdhSecret, append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...), 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := rfcPlaintext + "\x02"; string(plaintext) != want {
+		t.Errorf("decrypted %q, want %q", plaintext, want)
+	}
+}
+
+func TestEncryptPushErrors(t *testing.T) {
+	if _, err := EncryptPush(rfcUAPublic, rfcAuth, make([]byte, pushRecordSize)); err == nil {
+		t.Error("too large payload: no error")
+	}
+	if _, err := EncryptPush("BAAA", rfcAuth, []byte("x")); err == nil {
+		t.Error("bad p256dh: no error")
+	}
+	if _, err := EncryptPush(rfcUAPublic, "not base64!", []byte("x")); err == nil {
+		t.Error("bad auth: no error")
+	}
+}
+
+// TestPushClientPrivate адрес подписки присылает браузер, во внутреннюю
+// сеть по нему не ходим
+func TestPushClientPrivate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback push service")
+	}))
+	defer server.Close()
+
+	_, err := NewPublicClient(time.Second).Post(server.URL, "application/octet-stream", nil)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("err = %v, want ErrPrivateAddress", err)
+	}
+}
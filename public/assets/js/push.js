@@ -0,0 +1 @@
+(function(){var a,b,c,e;c=function(a){var b,c,d;return d="=".repeat((4-a.length%4)%4),b=(a+d).replace(/-/g,"+").replace(/_/g,"/"),c=window.atob(b),Uint8Array.from(c,function(a){return a.charCodeAt(0)})},a=function(a,b){var c;return c=b.toJSON(),fetch(a,{method:"POST",credentials:"same-origin",headers:{"Content-Type":"application/json"},body:JSON.stringify(c)})},b=function(a){return $("#push-subscribe").toggleClass("d-none",a),$("#push-unsubscribe").toggleClass("d-none",!a)},$("*").is("#push")&&(e=$("#push").data("base")||"","serviceWorker"in navigator&&"PushManager"in window?navigator.serviceWorker.register(e+"/sw.js").then(function(d){return d.pushManager.getSubscription().then(function(a){return b(null!==a)}),$("#push-subscribe").click(function(){return d.pushManager.subscribe({userVisibleOnly:!0,applicationServerKey:c($("#push").data("key"))}).then(function(b){return a(e+"/push/subscribe",b)}).then(function(){return window.location.reload()})}),$("#push-unsubscribe").click(function(){return d.pushManager.getSubscription().then(function(b){if(b)return a(e+"/push/unsubscribe",b).then(function(){return b.unsubscribe()})}).then(function(){return window.location.reload()})})}):($("#push-subscribe").addClass("d-none"),$("#push-unsupported").removeClass("d-none")))}).call(this);
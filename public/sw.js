@@ -0,0 +1,22 @@
+// Service worker SubVideo: показывает Web Push уведомления и открывает видео по клику
+self.addEventListener('push', function (event) {
+    if (!event.data) {
+        return;
+    }
+    var data = event.data.json();
+    event.waitUntil(self.registration.showNotification(data.title, {
+        body: data.body,
+        icon: data.icon,
+        image: data.image,
+        tag: data.tag,
+        data: {url: data.url}
+    }));
+});
+
+self.addEventListener('notificationclick', function (event) {
+    event.notification.close();
+    var url = event.notification.data && event.notification.data.url;
+    if (url) {
+        event.waitUntil(clients.openWindow(url));
+    }
+});
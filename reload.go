@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DeKoniX/subvideo/logging"
+)
+
+// restartKeys ключи, которые читаются только при запуске. При перезагрузке
+// их старые значения сохраняются, а об изменении пишется предупреждение
+var restartKeys = []string{
+	"server.listen", "server.socket", "server.base_path", "server.public", "server.templates",
+	"database.driver", "database.path", "database.host", "database.port", "database.dbname", "database.username", "database.password",
+	"notify.workers", "notify.retries", "notify.backoff",
+	"upstream.cache", "upstream.cache_entries", "upstream.cache_dir",
+	"telegram.token", "telegram.api_url", "telegram.webhook", "telegram.secret",
+	"webpush.public_key", "webpush.private_key", "webpush.subject",
+}
+
+// runReload перечитывает конфигурацию по SIGHUP, а при server.watch_config
+// еще и когда меняется файл
+func runReload(configPath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	modTime := configModTime(configPath)
+	for {
+		select {
+		case <-app.stop.Done():
+			return
+		case <-hup:
+			slog.Info("config reload requested", "trigger", "sighup")
+		case <-ticker.C:
+			if !config().Server.WatchConfig || configModTime(configPath).Equal(modTime) {
+				continue
+			}
+			slog.Info("config reload requested", "trigger", "file")
+		}
+		modTime = configModTime(configPath)
+		err := reloadConfig(configPath)
+		if err != nil {
+			slog.Error("config reload failed, keeping current config", "err", err)
+		}
+	}
+}
+
+func configModTime(configPath string) time.Time {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig проверяет новую конфигурацию, подменяет ее целиком и
+// пересоздает то, что зависит от изменившихся ключей
+func reloadConfig(configPath string) error {
+	next, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	prev := config()
+
+	for _, key := range restartKeys {
+		prevField, nextField := configField(prev, key), configField(next, key)
+		if !reflect.DeepEqual(prevField.Interface(), nextField.Interface()) {
+			slog.Warn("config key needs restart, keeping old value", "key", key)
+			nextField.Set(prevField)
+		}
+	}
+
+	changes := configDiff(prev, next)
+	if len(changes) == 0 {
+		slog.Info("config reloaded, nothing changed")
+		return nil
+	}
+
+	currentConfig.Store(next)
+	for _, change := range changes {
+		slog.Info("config changed", "key", change.Key, "old", change.Old, "new", change.New)
+	}
+
+	if prev.Twitch != next.Twitch || prev.YouTube != next.YouTube || prev.Sync != next.Sync || prev.Upstream != next.Upstream {
+		currentVideo.Store(newVideoClient(next))
+		slog.Info("provider clients rebuilt")
+	}
+	if prev.Log != next.Log {
+		err = logging.Setup(os.Stderr, next.Log.Format, next.Log.Level)
+		if err != nil {
+			slog.Error("logging setup failed", "err", err)
+		}
+	}
+	if prev.SMTP != next.SMTP {
+		if next.SMTP.Host == "" {
+			notifier.Unregister("email")
+		} else {
+			notifier.Register(smtpSender())
+		}
+	}
+	if prev.Notify.WebhookSecret != next.Notify.WebhookSecret {
+		notifier.Register(webhookSender())
+	}
+	slog.Info("config reloaded", "changes", len(changes))
+	return nil
+}
+
+// configField поле конфигурации по пути из ключей YAML: "twitch.clientid"
+func configField(conf *configYML, key string) reflect.Value {
+	v := reflect.ValueOf(conf).Elem()
+	for _, name := range strings.Split(key, ".") {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if yamlKey(t.Field(i)) == name {
+				v = v.Field(i)
+				break
+			}
+		}
+	}
+	return v
+}
+
+type configChange struct {
+	Key string
+	Old string
+	New string
+}
+
+// configDiff изменившиеся ключи, значения секретов не показываются
+func configDiff(prev, next *configYML) (changes []configChange) {
+	prevValues := flattenConfig(reflect.ValueOf(prev).Elem(), "")
+	nextValues := flattenConfig(reflect.ValueOf(next).Elem(), "")
+	for i, prevValue := range prevValues {
+		nextValue := nextValues[i]
+		if prevValue.New == nextValue.New {
+			continue
+		}
+		change := configChange{Key: prevValue.Key, Old: prevValue.New, New: nextValue.New}
+		if isSecretKey(change.Key) {
+			change.Old, change.New = "********", "********"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// flattenConfig значения всех ключей по порядку полей, в New
+func flattenConfig(v reflect.Value, prefix string) (values []configChange) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := prefix + yamlKey(t.Field(i))
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			values = append(values, flattenConfig(v.Field(i), key+".")...)
+			continue
+		}
+		values = append(values, configChange{Key: key, New: fmt.Sprint(v.Field(i).Interface())})
+	}
+	return values
+}
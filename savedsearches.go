@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/notify"
+	"gopkg.in/macaron.v1"
+)
+
+type SavedSearchForm struct {
+	Name   string `form:"name"`
+	Query  string `form:"query" binding:"Required"`
+	Sort   string `form:"sort"`
+	Notify bool   `form:"notify"`
+}
+
+type savedSearchInfo struct {
+	Search models.SavedSearch
+	New    int
+}
+
+func savedSearchesHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	searches, err := models.SelectSavedSearches(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved searches failed", "err", err)
+	}
+	var searchesInfo []savedSearchInfo
+	for _, search := range searches {
+		count, err := search.CountNew(user, userLocation(user))
+		if err != nil {
+			slog.ErrorContext(ctx.Req.Context(), "saved search count failed", "err", err)
+		}
+		searchesInfo = append(searchesInfo, savedSearchInfo{Search: search, New: count})
+	}
+
+	ctx.Data["HeadInfo"] = headInfo{Title: "Сохраненные поиски", URL: config().HeadURL + ctx.Req.URL.String()[1:]}
+	ctx.Data["User"] = user
+	ctx.Data["SubVideo"] = models.Subvideo{}
+	ctx.Data["Searches"] = searchesInfo
+	ctx.Data["FeedToken"] = feedToken(user)
+	ctx.Data["SavedError"] = ctx.Query("saved_error")
+	ctx.HTML(200, "saved")
+}
+
+func savedSearchAddHandler(ctx *macaron.Context, searchForm SavedSearchForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	search := models.SavedSearch{
+		UserID: user.Id,
+		Name:   searchForm.Name,
+		Query:  searchForm.Query,
+		Sort:   searchSort(searchForm.Sort),
+		Notify: searchForm.Notify,
+	}
+	_, err := models.ParseSearchQuery(search.Query, userLocation(user))
+	if err == nil {
+		err = search.Insert()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved search add failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/saved?saved_error=" + url.QueryEscape(err.Error()))
+		return
+	}
+	ctx.Redirect(config().Server.BasePath + fmt.Sprintf("/saved/%d", search.Id))
+}
+
+func savedSearchHandler(ctx *macaron.Context) {
+	var page int
+
+	pageS := ctx.Req.FormValue("page")
+	page, err := strconv.Atoi(pageS)
+	if err != nil || page == 0 {
+		page = 1
+	}
+
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	search, err := models.SelectSavedSearch(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved search failed", "err", err)
+		ctx.Redirect(config().Server.BasePath + "/saved")
+		return
+	}
+	err = search.Viewed()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved search viewed failed", "err", err)
+	}
+
+	sort := ctx.Req.FormValue("sort")
+	if sort == "" {
+		sort = search.Sort
+	}
+	ctx.Data["Saved"] = search
+	ctx.Data["FeedToken"] = feedToken(user)
+	renderSearch(ctx, user, search.Query, sort, page, fmt.Sprintf("/saved/%d?", search.Id), search.Name)
+}
+
+func savedSearchNotifyHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	search, err := models.SelectSavedSearch(ctx.ParamsInt64(":id"), user.Id)
+	if err == nil {
+		err = search.SetNotify(!search.Notify)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved search notify failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/saved")
+}
+
+func savedSearchDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	err := models.DeleteSavedSearch(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "saved search delete failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/saved")
+}
+
+func savedSearchFeedHandler(ctx *macaron.Context) {
+	user := requestUser(ctx)
+	if user.UserName == "" {
+		ctx.Error(401, "Unauthorized")
+		return
+	}
+
+	search, err := models.SelectSavedSearch(ctx.ParamsInt64(":id"), user.Id)
+	if err != nil {
+		ctx.Error(404, "Not Found")
+		return
+	}
+	query, err := models.ParseSearchQuery(search.Query, userLocation(user))
+	if err != nil {
+		ctx.Error(400, err.Error())
+		return
+	}
+	results, _, err := clientVideo().SearchVideo(user, config().Server.PageSize, 1, query)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "feed failed", "err", err)
+		ctx.Error(500, "Internal Server Error")
+		return
+	}
+	var subVideos []models.Subvideo
+	for _, result := range results {
+		subVideos = append(subVideos, result.Subvideo)
+	}
+	renderFeed(ctx, search.Name, fmt.Sprintf("/saved/%d", search.Id), subVideos)
+}
+
+// matchSavedSearches отмечает новые совпадения в поисках с уведомлениями и
+// отправляет их по правилам на сохраненные поиски
+func matchSavedSearches(ctx context.Context, user models.User, newVideos []models.Subvideo) {
+	matched, err := models.MatchSavedSearches(user, newVideos, userLocation(user))
+	if err != nil {
+		slog.ErrorContext(ctx, "saved search match failed", "err", err)
+		return
+	}
+	var events []notify.Event
+	for _, match := range matched {
+		slog.InfoContext(ctx, "saved search matched", "search", match.Search.Name, "videos", len(match.Videos))
+		for _, video := range match.Videos {
+			events = append(events, notify.Event{
+				Kind:   notify.EventSavedSearch,
+				Key:    fmt.Sprintf("saved:%d:%s", match.Search.Id, video.VideoID),
+				User:   user,
+				Video:  video,
+				Search: match.Search.Name,
+			})
+		}
+	}
+	notifier.Dispatch(ctx, events...)
+}
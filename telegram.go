@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/telegram"
+	"gopkg.in/macaron.v1"
+)
+
+// telegramCodeTTL сколько живет код привязки
+const telegramCodeTTL = 15 * time.Minute
+
+const telegramHelp = `Команды:
+/live - кто сейчас в эфире
+/latest - последние видео
+/search <запрос> - поиск, как на сайте
+/mute <канал> - скрыть канал из ленты и уведомлений
+/unlink - отвязать чат`
+
+var telegramBot *telegram.Bot
+
+// initTelegram создает бота, если в конфиге есть токен
+func initTelegram() *telegram.Bot {
+	if config().Telegram.Token == "" {
+		return nil
+	}
+	client := telegram.New(config().Telegram.Token, config().Telegram.APIURL)
+	client.HTTPClient = &http.Client{Timeout: 70 * time.Second}
+
+	bot := telegram.NewBot(client)
+	bot.Handle("start", tgStartCommand)
+	bot.Handle("link", tgStartCommand)
+	bot.Handle("help", tgHelpCommand)
+	bot.Handle("live", tgLiveCommand)
+	bot.Handle("latest", tgLatestCommand)
+	bot.Handle("search", tgSearchCommand)
+	bot.Handle("mute", tgMuteCommand)
+	bot.Handle("unlink", tgUnlinkCommand)
+	bot.HandleDefault(tgHelpCommand)
+	return bot
+}
+
+// runTelegram принимает обновления: через вебхук, если он включен, иначе long polling
+func runTelegram() {
+	ctx := app.stop
+	if config().Telegram.Webhook {
+		status.beat("telegram", "webhook")
+		err := telegramBot.SetWebhook(ctx, config().HeadURL+"telegram/"+config().Telegram.Secret)
+		if err != nil {
+			slog.Error("telegram webhook failed", "err", err)
+		}
+		return
+	}
+	err := telegramBot.DeleteWebhook(ctx)
+	if err != nil {
+		slog.Error("telegram webhook failed", "err", err)
+	}
+	status.beat("telegram", "polling")
+	telegramBot.Poll(ctx)
+}
+
+func telegramWebhookHandler(ctx *macaron.Context) {
+	if telegramBot == nil || !config().Telegram.Webhook || ctx.Params(":secret") != config().Telegram.Secret {
+		ctx.Error(404, "Not Found")
+		return
+	}
+	var update telegram.Update
+	err := json.NewDecoder(ctx.Req.Request.Body).Decode(&update)
+	if err != nil {
+		ctx.Error(400, "Bad Request")
+		return
+	}
+	telegramBot.HandleUpdate(ctx.Req.Request.Context(), update)
+	ctx.Resp.WriteHeader(200)
+}
+
+func telegramCodeHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err == nil {
+		err = models.SetTelegramCode(user.Id, hex.EncodeToString(b), telegramCodeTTL)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "telegram code failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/user")
+}
+
+func telegramUnlinkHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	err := telegramUnlink(user)
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "telegram unlink failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/user")
+}
+
+func telegramUnlink(user models.User) (err error) {
+	link, err := models.SelectTelegramLink(user.Id)
+	if err != nil {
+		return err
+	}
+	if link.ChatID != 0 {
+		err = models.DeleteNotifyRulesFor(user.Id, "telegram", strconv.FormatInt(link.ChatID, 10))
+		if err != nil {
+			return err
+		}
+	}
+	return models.DeleteTelegramLink(user.Id)
+}
+
+// telegramStartURL ссылка, по которой бот сразу получит код
+func telegramStartURL(code string) string {
+	if config().Telegram.BotName == "" {
+		return ""
+	}
+	return "https://t.me/" + config().Telegram.BotName + "?start=" + code
+}
+
+func tgStartCommand(ctx context.Context, message telegram.Message, args string) string {
+	if args == "" {
+		return "Привет! Получите код на странице настроек subvideo и отправьте /start &lt;код&gt;\n\n" + telegramHelp
+	}
+	user, err := models.LinkTelegram(args, message.Chat.ID)
+	if err != nil {
+		return html.EscapeString(err.Error())
+	}
+
+	target := strconv.FormatInt(message.Chat.ID, 10)
+	_, exists, err := models.SelectNotifyRuleFor(user.Id, "telegram", target)
+	if err == nil && !exists {
+		rule := models.NotifyRule{UserID: user.Id, Backend: "telegram", Target: target}
+		err = rule.Insert()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram link failed", "err", err)
+	}
+	return "Чат привязан к " + html.EscapeString(user.UserName) + ", сюда будут приходить новые видео и стримы.\n\n" + telegramHelp
+}
+
+func tgHelpCommand(ctx context.Context, message telegram.Message, args string) string {
+	return telegramHelp
+}
+
+// telegramUser пользователь, к которому привязан чат, пустая строка при успехе
+func telegramUser(message telegram.Message) (models.User, string) {
+	user, err := models.SelectUserForTelegram(message.Chat.ID)
+	if err != nil {
+		return user, "Чат не привязан, получите код на странице настроек subvideo"
+	}
+	if user.Disabled {
+		return user, "Аккаунт отключен администратором"
+	}
+	return user, ""
+}
+
+func tgLiveCommand(ctx context.Context, message telegram.Message, args string) string {
+	user, reply := telegramUser(message)
+	if reply != "" {
+		return reply
+	}
+	streams, updated, err := onlineStreams(ctx, user)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram live failed", "err", err)
+		if updated.IsZero() {
+			return "Не получилось загрузить стримы"
+		}
+	}
+	note := ""
+	if err != nil {
+		note = fmt.Sprintf("\n<i>Twitch не отвечает, это стримы %d мин. назад</i>", int(time.Since(updated).Minutes()))
+	}
+	if len(streams) == 0 {
+		return "Сейчас никто не в эфире" + note
+	}
+	return "<b>В эфире</b>\n" + telegramVideoList(streams) + note
+}
+
+func tgLatestCommand(ctx context.Context, message telegram.Message, args string) string {
+	user, reply := telegramUser(message)
+	if reply != "" {
+		return reply
+	}
+	videos, _, err := clientVideo().SortVideo(user, 10, "", 1)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram latest failed", "err", err)
+		return "Не получилось загрузить видео"
+	}
+	if len(videos) == 0 {
+		return "Видео пока нет"
+	}
+	return "<b>Последние видео</b>\n" + telegramVideoList(videos)
+}
+
+func tgSearchCommand(ctx context.Context, message telegram.Message, args string) string {
+	user, reply := telegramUser(message)
+	if reply != "" {
+		return reply
+	}
+	query, err := models.ParseSearchQuery(args, userLocation(user))
+	if err != nil {
+		return html.EscapeString(err.Error())
+	}
+	if query.Empty() {
+		return "Напишите запрос: /search &lt;запрос&gt;"
+	}
+	results, count, err := clientVideo().SearchVideo(user, 10, 1, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram search failed", "err", err)
+		return "Не получилось выполнить поиск"
+	}
+	if count == 0 {
+		return "Ничего не найдено"
+	}
+	var videos []models.Subvideo
+	for _, result := range results {
+		videos = append(videos, result.Subvideo)
+	}
+	return fmt.Sprintf("<b>Найдено: %d</b>\n", count) + telegramVideoList(videos)
+}
+
+func tgMuteCommand(ctx context.Context, message telegram.Message, args string) string {
+	user, reply := telegramUser(message)
+	if reply != "" {
+		return reply
+	}
+	if args == "" {
+		return "Напишите канал: /mute &lt;канал&gt;"
+	}
+	channels, err := models.Videos.SelectChannels(user.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram mute failed", "err", err)
+		return "Не получилось загрузить каналы"
+	}
+	for _, channel := range channels {
+		if !strings.EqualFold(channel.Channel, args) && channel.ChannelID != args {
+			continue
+		}
+		filter := models.Filter{
+			UserID:  user.Id,
+			Kind:    models.FilterChannel,
+			Value:   channel.ChannelID,
+			Comment: channel.Channel,
+		}
+		err = filter.Insert()
+		if err != nil {
+			slog.ErrorContext(ctx, "telegram mute failed", "err", err)
+			return "Не получилось скрыть канал"
+		}
+		return "Канал " + html.EscapeString(channel.Channel) + " скрыт из ленты и уведомлений, вернуть можно в настройках на сайте"
+	}
+	return "Канал " + html.EscapeString(args) + " не найден среди подписок"
+}
+
+func tgUnlinkCommand(ctx context.Context, message telegram.Message, args string) string {
+	user, reply := telegramUser(message)
+	if reply != "" {
+		return reply
+	}
+	err := telegramUnlink(user)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram unlink failed", "err", err)
+		return "Не получилось отвязать чат"
+	}
+	return "Чат отвязан"
+}
+
+func telegramVideoList(videos []models.Subvideo) string {
+	var lines []string
+	for _, video := range videos {
+		lines = append(lines, fmt.Sprintf("• <a href=\"%s\">%s</a> - %s",
+			html.EscapeString(video.URL), html.EscapeString(video.Title), html.EscapeString(video.Channel)))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,54 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+
+	"github.com/DeKoniX/subvideo/notify"
+)
+
+// Backend доставляет уведомления в чат, target - ID чата
+type Backend struct {
+	Client *Client
+}
+
+func (backend *Backend) Name() string {
+	return "telegram"
+}
+
+func (backend *Backend) Send(ctx context.Context, target string, message notify.Message) error {
+	chatID, err := strconv.ParseInt(target, 10, 64)
+	if err != nil {
+		return fmt.Errorf("telegram: bad chat id %q", target)
+	}
+	text := MessageText(message)
+	if message.ThumbURL != "" {
+		err = backend.Client.SendPhoto(ctx, chatID, message.ThumbURL, text)
+		if err == nil {
+			return nil
+		}
+		// Telegram не всегда может скачать превью, тогда шлем просто текст
+		if _, ok := err.(*APIError); !ok {
+			return err
+		}
+	}
+	return backend.Client.SendMessage(ctx, chatID, text)
+}
+
+func MessageText(message notify.Message) string {
+	head := "Новое видео"
+	switch message.Event {
+	case notify.EventLive:
+		head = "В эфире"
+	case notify.EventSavedSearch:
+		head = "Поиск «" + html.EscapeString(message.Search) + "»"
+	}
+	text := fmt.Sprintf("<b>%s: %s</b>\n<a href=\"%s\">%s</a>",
+		head, html.EscapeString(message.Channel), html.EscapeString(message.URL), html.EscapeString(message.Title))
+	if message.Game != "" {
+		text += "\n" + html.EscapeString(message.Game)
+	}
+	return text
+}
@@ -0,0 +1,103 @@
+package telegram
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/DeKoniX/subvideo/logging"
+)
+
+// HandlerFunc отвечает на команду, args - текст после команды
+type HandlerFunc func(ctx context.Context, message Message, args string) (reply string)
+
+type Bot struct {
+	*Client
+	handlers map[string]HandlerFunc
+	fallback HandlerFunc
+}
+
+func NewBot(client *Client) *Bot {
+	return &Bot{Client: client, handlers: map[string]HandlerFunc{}}
+}
+
+// Handle регистрирует команду без косой черты: Handle("live", ...)
+func (bot *Bot) Handle(command string, handler HandlerFunc) {
+	bot.handlers[command] = handler
+}
+
+// HandleDefault вызывается на сообщения без известной команды
+func (bot *Bot) HandleDefault(handler HandlerFunc) {
+	bot.fallback = handler
+}
+
+// HandleUpdate разбирает команду, вызывает обработчик и отправляет ответ
+func (bot *Bot) HandleUpdate(ctx context.Context, update Update) {
+	if update.Message == nil || update.Message.Text == "" {
+		return
+	}
+	message := *update.Message
+	if logging.RequestID(ctx) == "" {
+		ctx = logging.WithRequestID(ctx, logging.NewID())
+	}
+	command, args := ParseCommand(message.Text)
+
+	handler, ok := bot.handlers[command]
+	if !ok {
+		handler = bot.fallback
+	}
+	if handler == nil {
+		return
+	}
+	reply := handler(ctx, message, args)
+	if reply == "" {
+		return
+	}
+	err := bot.SendMessage(ctx, message.Chat.ID, reply)
+	if err != nil {
+		slog.ErrorContext(ctx, "telegram reply failed", "chat_id", message.Chat.ID, "err", err)
+	}
+}
+
+// Poll получает обновления через getUpdates, пока не отменят ctx
+func (bot *Bot) Poll(ctx context.Context) {
+	var offset int64
+	for {
+		updates, err := bot.GetUpdates(ctx, offset, 50)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "telegram poll failed", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			bot.HandleUpdate(ctx, update)
+		}
+	}
+}
+
+// ParseCommand делит "/search@subvideo_bot foo bar" на "search" и "foo bar",
+// у простого текста команда пустая
+func ParseCommand(text string) (command, args string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return "", text
+	}
+	fields := strings.SplitN(text, " ", 2)
+	command = strings.TrimPrefix(fields[0], "/")
+	if i := strings.Index(command, "@"); i >= 0 {
+		command = command[:i]
+	}
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return strings.ToLower(command), args
+}
@@ -0,0 +1,147 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultAPIURL адрес Bot API, для тестов можно подставить локальный
+const DefaultAPIURL = "https://api.telegram.org"
+
+type Client struct {
+	Token      string
+	APIURL     string
+	HTTPClient *http.Client
+}
+
+type User struct {
+	ID       int64  `json:"id"`
+	UserName string `json:"username"`
+}
+
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type Message struct {
+	MessageID int64  `json:"message_id"`
+	From      *User  `json:"from"`
+	Chat      Chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// APIError ошибка, которую вернул сам Bot API
+type APIError struct {
+	Method      string
+	Code        int
+	Description string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram: %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+func New(token, apiURL string) *Client {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &Client{
+		Token:      token,
+		APIURL:     strings.TrimSuffix(apiURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (client *Client) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if client.Token == "" {
+		return errors.New("telegram: empty bot token")
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", client.APIURL+"/bot"+client.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var apiResp apiResponse
+	err = json.NewDecoder(resp.Body).Decode(&apiResp)
+	if err != nil {
+		return fmt.Errorf("telegram: %s: %s", method, resp.Status)
+	}
+	if !apiResp.OK {
+		return &APIError{Method: method, Code: apiResp.ErrorCode, Description: apiResp.Description}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(apiResp.Result, result)
+}
+
+// GetUpdates long polling, timeout в секундах
+func (client *Client) GetUpdates(ctx context.Context, offset int64, timeout int) (updates []Update, err error) {
+	err = client.call(ctx, "getUpdates", map[string]interface{}{
+		"offset":          offset,
+		"timeout":         timeout,
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	return updates, err
+}
+
+func (client *Client) SetWebhook(ctx context.Context, url string) error {
+	return client.call(ctx, "setWebhook", map[string]interface{}{
+		"url":             url,
+		"allowed_updates": []string{"message"},
+	}, nil)
+}
+
+func (client *Client) DeleteWebhook(ctx context.Context) error {
+	return client.call(ctx, "deleteWebhook", map[string]interface{}{}, nil)
+}
+
+// SendMessage отправляет текст с разметкой HTML
+func (client *Client) SendMessage(ctx context.Context, chatID int64, text string) error {
+	return client.call(ctx, "sendMessage", map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}, nil)
+}
+
+// SendPhoto отправляет картинку по URL с подписью в HTML
+func (client *Client) SendPhoto(ctx context.Context, chatID int64, photoURL, caption string) error {
+	return client.call(ctx, "sendPhoto", map[string]interface{}{
+		"chat_id":    chatID,
+		"photo":      photoURL,
+		"caption":    caption,
+		"parse_mode": "HTML",
+	}, nil)
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/DeKoniX/subvideo/monitor"
+)
+
+// breaker размыкатель: после failures неудач подряд площадка считается
+// недоступной на cooldown, запросы к ней сразу получают ErrCircuitOpen.
+// Потом пропускается один пробный запрос, удачный снова открывает доступ
+type breaker struct {
+	provider string
+	failures int
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	count   int
+	openAt  time.Time
+	probing bool
+}
+
+func newBreaker(provider string, failures int, cooldown time.Duration) *breaker {
+	monitor.CircuitOpen.WithLabelValues(provider).Set(0)
+	return &breaker{provider: provider, failures: failures, cooldown: cooldown}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count < b.failures {
+		return true
+	}
+	if b.probing || time.Since(b.openAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record итог запроса, пропущенного allow
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if b.count >= b.failures {
+			slog.Info("upstream circuit closed", "provider", b.provider)
+			monitor.CircuitOpen.WithLabelValues(b.provider).Set(0)
+		}
+		b.count = 0
+		return
+	}
+	b.count++
+	if b.count >= b.failures {
+		if b.count == b.failures {
+			slog.Warn("upstream circuit opened", "provider", b.provider, "cooldown", b.cooldown)
+			monitor.CircuitOpen.WithLabelValues(b.provider).Set(1)
+		}
+		b.openAt = time.Now()
+	}
+}
+
+// cancel запрос отменили раньше ответа, о площадке он ничего не говорит
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
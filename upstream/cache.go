@@ -0,0 +1,314 @@
+package upstream
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DeKoniX/subvideo/monitor"
+)
+
+// ErrCacheMiss в хранилище нет записи
+var ErrCacheMiss = errors.New("cache miss")
+
+// cacheMaxBody ответы больше не кэшируются
+const cacheMaxBody = 1 << 20
+
+// Store долговременное хранилище ответов за LRU в памяти: переживает
+// перезапуск, чтобы первая синхронизация после него тоже шла с ETag
+type Store interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	// Prune удаляет записи, которые не обновлялись с before
+	Prune(before time.Time) (int64, error)
+}
+
+// Cache ответы GET с ETag или Last-Modified. Повторный запрос уходит с
+// If-None-Match и If-Modified-Since, на 304 отдается сохраненный ответ.
+// Пока свеж по Cache-Control: max-age, площадка не спрашивается совсем
+type Cache struct {
+	entries int
+	store   Store
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits, revalidated, misses atomic.Int64
+}
+
+// CacheStats счетчики с запуска: hits - ответ без запроса, revalidated -
+// площадка ответила 304, misses - пришел полный ответ
+type CacheStats struct {
+	Hits        int64
+	Revalidated int64
+	Misses      int64
+}
+
+// Ratio доля запросов, где тело ответа не скачивалось
+func (stats CacheStats) Ratio() float64 {
+	total := stats.Hits + stats.Revalidated + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits+stats.Revalidated) / float64(total)
+}
+
+// NewCache entries - размер LRU в памяти, store может быть nil
+func NewCache(entries int, store Store) *Cache {
+	if entries <= 0 {
+		entries = 2000
+	}
+	return &Cache{entries: entries, store: store, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Revalidated: c.revalidated.Load(), Misses: c.misses.Load()}
+}
+
+// Prune чистит долговременное хранилище, LRU вытесняет записи сам
+func (c *Cache) Prune(before time.Time) (int64, error) {
+	if c == nil || c.store == nil {
+		return 0, nil
+	}
+	return c.store.Prune(before)
+}
+
+type cacheEntry struct {
+	key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+	MaxAge time.Duration
+}
+
+func (entry *cacheEntry) fresh() bool {
+	return entry.MaxAge > 0 && time.Since(entry.Stored) < entry.MaxAge
+}
+
+// response ответ из записи, как будто он пришел от площадки
+func (entry *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(entry.Status) + " " + http.StatusText(entry.Status),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+}
+
+func (c *Cache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+
+	value, err := c.store.Get(key)
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			slog.Warn("upstream cache read failed", "err", err)
+		}
+		return nil
+	}
+	entry := &cacheEntry{}
+	if json.Unmarshal(value, entry) != nil {
+		return nil
+	}
+	entry.key = key
+	c.remember(entry)
+	return entry
+}
+
+func (c *Cache) set(entry *cacheEntry) {
+	c.remember(entry)
+	if c.store == nil {
+		return
+	}
+	value, err := json.Marshal(entry)
+	if err == nil {
+		err = c.store.Set(entry.key, value)
+	}
+	if err != nil {
+		slog.Warn("upstream cache write failed", "err", err)
+	}
+}
+
+func (c *Cache) remember(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[entry.key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[entry.key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.entries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheTransport стоит над повторами: 304 и ответ из памяти не тратят
+// лимит запросов, а monitor видит только то, что ушло к площадке
+type cacheTransport struct {
+	provider string
+	cache    *Cache
+	base     http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// условные запросы, собранные вызывающим, проходят как есть
+	if req.Method != "GET" || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return t.base.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	entry := t.cache.get(key)
+	if entry != nil && entry.fresh() {
+		t.count("hit")
+		return entry.response(req), nil
+	}
+
+	try := req
+	if entry != nil {
+		try = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			try.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			try.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := t.base.RoundTrip(try)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		renewed := *entry
+		renewed.Header = entry.Header.Clone()
+		for _, name := range []string{"ETag", "Last-Modified", "Cache-Control", "Date", "Expires"} {
+			if value := resp.Header.Get(name); value != "" {
+				renewed.Header.Set(name, value)
+			}
+		}
+		renewed.Stored = time.Now()
+		renewed.MaxAge = maxAge(renewed.Header)
+		t.cache.set(&renewed)
+		t.count("revalidated")
+		return renewed.response(req), nil
+	}
+
+	t.count("miss")
+	if resp.StatusCode != http.StatusOK || !cacheable(resp.Header) {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, cacheMaxBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > cacheMaxBody {
+		// слишком большой, отдаем без сохранения
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	t.cache.set(&cacheEntry{key: key, Status: resp.StatusCode, Header: header, Body: body,
+		Stored: time.Now(), MaxAge: maxAge(header)})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (t *cacheTransport) count(result string) {
+	switch result {
+	case "hit":
+		t.cache.hits.Add(1)
+	case "revalidated":
+		t.cache.revalidated.Add(1)
+	default:
+		t.cache.misses.Add(1)
+	}
+	monitor.UpstreamCache.WithLabelValues(t.provider, result).Inc()
+}
+
+type identityKey struct{}
+
+// WithIdentity от чьего имени идут запросы. Ключ кэша строится по нему, а
+// не по токену из Authorization, который YouTube меняет каждый час
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// cacheKey адрес и то, от чьего имени запрос: ответы разных пользователей
+// не должны смешиваться. Ключ хэшируется, чтобы токены не попадали в хранилище
+func cacheKey(req *http.Request) string {
+	sum := sha256.New()
+	io.WriteString(sum, req.URL.String())
+	if identity, ok := req.Context().Value(identityKey{}).(string); ok {
+		io.WriteString(sum, "\nidentity "+identity)
+	} else {
+		io.WriteString(sum, "\n"+req.Header.Get("Authorization"))
+	}
+	for _, name := range []string{"Client-ID", "Accept"} {
+		io.WriteString(sum, "\n"+req.Header.Get(name))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// cacheable есть чем проверить актуальность и площадка не запретила хранить
+func cacheable(header http.Header) bool {
+	if strings.Contains(header.Get("Cache-Control"), "no-store") {
+		return false
+	}
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != "" || maxAge(header) > 0
+}
+
+// maxAge сколько ответ свеж без перепроверки, no-cache - нисколько
+func maxAge(header http.Header) time.Duration {
+	var age time.Duration
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "no-cache" {
+			return 0
+		}
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			seconds, err := strconv.Atoi(value)
+			if err == nil && seconds > 0 {
+				age = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return age
+}
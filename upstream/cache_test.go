@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		switch calls.Add(1) {
+		case 1:
+			if req.Header.Get("If-None-Match") != "" {
+				t.Error("conditional first request")
+			}
+			return response(req, 200, http.Header{"Etag": {`"v1"`}, "Set-Cookie": {"a=b"}}, "videos"), nil
+		default:
+			if got := req.Header.Get("If-None-Match"); got != `"v1"` {
+				t.Errorf("If-None-Match = %q", got)
+			}
+			return response(req, 304, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60"}}, ""), nil
+		}
+	})
+	cache := NewCache(10, nil)
+	client := &http.Client{Transport: &cacheTransport{provider: "test", cache: cache, base: base}}
+
+	for i, want := range []CacheStats{{Misses: 1}, {Revalidated: 1, Misses: 1}, {Hits: 1, Revalidated: 1, Misses: 1}} {
+		resp, err := client.Get("https://example.com/videos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("request %d: status %d", i, resp.StatusCode)
+		}
+		if body := readBody(t, resp); body != "videos" {
+			t.Errorf("request %d: body %q", i, body)
+		}
+		if i > 0 && resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("request %d: cached Set-Cookie", i)
+		}
+		if stats := cache.Stats(); stats != want {
+			t.Errorf("request %d: stats %+v, want %+v", i, stats, want)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d calls, want 2: fresh entry was revalidated", calls.Load())
+	}
+}
+
+func TestCacheSkip(t *testing.T) {
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		header := http.Header{"Etag": {`"v1"`}}
+		if req.URL.Path == "/private" {
+			header.Set("Cache-Control", "no-store")
+		}
+		if req.URL.Path == "/error" {
+			return response(req, 500, header, "error"), nil
+		}
+		return response(req, 200, header, "body"), nil
+	})
+	client := &http.Client{Transport: &cacheTransport{provider: "test", cache: NewCache(10, nil), base: base}}
+
+	for _, path := range []string{"/private", "/error"} {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get("https://example.com" + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBody(t, resp)
+		}
+	}
+	// вызывающий сам сделал условный запрос, его 304 отдается как есть
+	req, _ := http.NewRequest("GET", "https://example.com/private", nil)
+	req.Header.Set("If-None-Match", `"v0"`)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if calls.Load() != 5 {
+		t.Errorf("%d calls, want 5", calls.Load())
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	first, _ := http.NewRequest("GET", "https://example.com/videos", nil)
+	first.Header.Set("Authorization", "Bearer one")
+	second := first.Clone(first.Context())
+	second.Header.Set("Authorization", "Bearer two")
+	if cacheKey(first) == cacheKey(second) {
+		t.Error("different tokens share a key")
+	}
+	first = first.WithContext(WithIdentity(first.Context(), "user 1"))
+	second = second.WithContext(WithIdentity(second.Context(), "user 1"))
+	if cacheKey(first) != cacheKey(second) {
+		t.Error("token refresh changed the key")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":                       0,
+		"max-age=60":             time.Minute,
+		"public, max-age=10":     10 * time.Second,
+		"max-age=60, no-cache":   0,
+		"max-age=-5":             0,
+		"private, max-age=bogus": 0,
+	}
+	for value, want := range tests {
+		if got := maxAge(http.Header{"Cache-Control": {value}}); got != want {
+			t.Errorf("maxAge(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DiskStore хранит ответы файлами в каталоге, по подкаталогу на первые
+// два символа ключа
+type DiskStore struct {
+	Dir string
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStore{Dir: dir}, nil
+}
+
+func (store *DiskStore) path(key string) string {
+	return filepath.Join(store.Dir, key[:2], key)
+}
+
+func (store *DiskStore) Get(key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	return value, err
+}
+
+// Set пишет во временный файл и переименовывает, чтобы не оставить
+// половину записи
+func (store *DiskStore) Set(key string, value []byte) error {
+	path := store.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (store *DiskStore) Prune(before time.Time) (count int64, err error) {
+	err = filepath.Walk(store.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !info.ModTime().Before(before) {
+			return err
+		}
+		err = os.Remove(path)
+		if err == nil {
+			count++
+		}
+		return err
+	})
+	return count, err
+}
@@ -0,0 +1,260 @@
+// Package upstream HTTP клиент для API площадок: таймауты, повторы с
+// экспоненциальной задержкой, ограничение частоты запросов и размыкатель,
+// чтобы сбой одной площадки не тормозил синхронизацию всех пользователей
+package upstream
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DeKoniX/subvideo/monitor"
+)
+
+// ErrCircuitOpen площадка недавно не отвечала, запрос не отправлялся
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// Options настройки клиента одной площадки, нулевые поля берутся по умолчанию
+type Options struct {
+	// Timeout ожидание ответа на одну попытку
+	Timeout time.Duration
+	// Retries сколько раз повторять запрос после 429, 5xx и ошибок сети
+	Retries int
+	// Backoff задержка перед первым повтором, дальше удваивается
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Rate запросов в секунду, Burst - сколько можно отправить разом
+	Rate  float64
+	Burst int
+	// Failures неудач подряд, после которых площадка считается
+	// недоступной на Cooldown
+	Failures int
+	Cooldown time.Duration
+	// Cache кэш ответов, nil - без кэша. Один кэш можно делить между площадками
+	Cache *Cache
+}
+
+func (opts *Options) setDefaults() {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 15 * time.Second
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = 10
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = max(1, int(opts.Rate))
+	}
+	if opts.Failures <= 0 {
+		opts.Failures = 5
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 30 * time.Second
+	}
+}
+
+// Transport повторяет неудачные запросы, соблюдает лимит частоты и не
+// пускает запросы к площадке, которая подряд не отвечает
+type Transport struct {
+	Provider string
+	Base     http.RoundTripper
+
+	opts    Options
+	limiter *limiter
+	breaker *breaker
+}
+
+// NewTransport base - нижний транспорт, обычно monitor.Transport, чтобы
+// метрики видели каждую попытку
+func NewTransport(provider string, base http.RoundTripper, opts Options) *Transport {
+	opts.setDefaults()
+	if base == nil {
+		base = DefaultBase(opts.Timeout)
+	}
+	return &Transport{
+		Provider: provider,
+		Base:     base,
+		opts:     opts,
+		limiter:  newLimiter(opts.Rate, opts.Burst),
+		breaker:  newBreaker(provider, opts.Failures, opts.Cooldown),
+	}
+}
+
+// NewClient клиент с Transport и кэшем ответов поверх него. Общий таймаут
+// покрывает все попытки и паузы между ними, у контекста запроса он может
+// быть короче
+func NewClient(provider string, base http.RoundTripper, opts Options) *http.Client {
+	transport := NewTransport(provider, base, opts)
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(transport.opts.Retries+1)*transport.opts.Timeout + transport.opts.MaxBackoff,
+	}
+	if opts.Cache != nil {
+		client.Transport = &cacheTransport{provider: provider, cache: opts.Cache, base: transport}
+	}
+	return client
+}
+
+// DefaultBase транспорт с таймаутами соединения и ожидания ответа
+func DefaultBase(timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	base.ResponseHeaderTimeout = timeout
+	return base
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !t.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+	for attempt := 0; ; attempt++ {
+		err := t.limiter.wait(ctx)
+		if err != nil {
+			t.breaker.cancel()
+			return nil, err
+		}
+		try := req
+		if attempt > 0 {
+			try, err = rewind(req)
+			if err != nil {
+				t.breaker.cancel()
+				return nil, err
+			}
+		}
+		resp, err := t.Base.RoundTrip(try)
+		if resp != nil {
+			if reset, ok := rateLimitReset(resp.Header); ok {
+				t.limiter.pauseUntil(reset)
+			}
+		}
+
+		failed := err != nil || retryStatus(resp.StatusCode)
+		if !failed {
+			t.breaker.record(true)
+			return resp, err
+		}
+		if ctx.Err() != nil {
+			// запрос отменил вызывающий, площадка тут ни при чем
+			t.breaker.cancel()
+			return resp, err
+		}
+		delay, ok := t.retryDelay(req, resp, attempt)
+		if !ok {
+			t.breaker.record(false)
+			return resp, err
+		}
+
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		slog.DebugContext(ctx, "upstream retry", "provider", t.Provider, "path", req.URL.Path,
+			"attempt", attempt+1, "status", status, "delay", delay, "err", err)
+		monitor.UpstreamRetries.WithLabelValues(t.Provider).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			t.breaker.cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay пауза перед следующей попыткой. Повторяются только запросы
+// без побочных эффектов, и не дольше MaxBackoff: если площадка просит
+// ждать дольше, ответ отдается как есть
+func (t *Transport) retryDelay(req *http.Request, resp *http.Response, attempt int) (time.Duration, bool) {
+	if attempt >= t.opts.Retries || !idempotent(req) {
+		return 0, false
+	}
+	backoff := min(t.opts.MaxBackoff, t.opts.Backoff<<uint(attempt))
+	// полный разброс, чтобы синхронизации разных пользователей не
+	// повторяли запросы одновременно
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header); ok {
+			if wait > t.opts.MaxBackoff {
+				return 0, false
+			}
+			delay = max(delay, wait)
+		}
+	}
+	return delay, true
+}
+
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// rewind копия запроса для повтора с заново открытым телом
+func rewind(req *http.Request) (*http.Request, error) {
+	try := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		try.Body = body
+	}
+	return try, nil
+}
+
+// retryAfter через сколько площадка просит повторить: Retry-After в
+// секундах или датой, а у Twitch еще Ratelimit-Reset в секундах unix
+func retryAfter(header http.Header) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(max(0, seconds)) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(0, time.Until(date)), true
+		}
+	}
+	if reset, ok := rateLimitReset(header); ok {
+		return max(0, time.Until(reset)), true
+	}
+	return 0, false
+}
+
+// rateLimitReset когда Twitch восстановит лимит, если он исчерпан
+func rateLimitReset(header http.Header) (time.Time, bool) {
+	if header.Get("Ratelimit-Remaining") != "0" {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
@@ -0,0 +1,201 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// roundTripFunc нижний транспорт для тестов без сети
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func response(req *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("test", 3, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("closed after %d failures", i)
+		}
+		b.record(false)
+	}
+	if !b.allow() {
+		t.Fatal("closed after 2 failures")
+	}
+	b.record(true)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("success did not reset the count, closed after %d failures", i)
+		}
+		b.record(false)
+	}
+	if b.allow() {
+		t.Fatal("open after 3 failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no probe after cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second probe while the first one is running")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("failed probe did not restart cooldown")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no probe after second cooldown")
+	}
+	b.cancel()
+	if !b.allow() {
+		t.Fatal("canceled probe blocked the next one")
+	}
+	b.record(true)
+	if !b.allow() || !b.allow() {
+		t.Fatal("successful probe did not close the breaker")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(100, 2)
+	if l.reserve() != 0 || l.reserve() != 0 {
+		t.Fatal("burst not available")
+	}
+	delay := l.reserve()
+	if delay <= 0 || delay > 10*time.Millisecond {
+		t.Fatalf("delay after burst = %v, want up to 10ms", delay)
+	}
+
+	start := time.Now()
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("wait took %v", time.Since(start))
+	}
+
+	l.pauseUntil(time.Now().Add(time.Hour))
+	l.pauseUntil(time.Now())
+	if delay := l.reserve(); delay < 59*time.Minute {
+		t.Errorf("pause = %v, want about an hour", delay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait during pause = %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	transport := NewTransport("test", roundTripFunc(nil), Options{Retries: 3, Backoff: time.Second, MaxBackoff: 4 * time.Second})
+	get, _ := http.NewRequest("GET", "https://example.com/", nil)
+	post, _ := http.NewRequest("POST", "https://example.com/", strings.NewReader("x"))
+
+	for attempt := 0; attempt < 3; attempt++ {
+		delay, ok := transport.retryDelay(get, nil, attempt)
+		limit := min(4*time.Second, time.Second<<uint(attempt))
+		if !ok || delay < 0 || delay > limit {
+			t.Errorf("attempt %d: delay %v, %v, want up to %v", attempt, delay, ok, limit)
+		}
+	}
+	if _, ok := transport.retryDelay(get, nil, 3); ok {
+		t.Error("retry after the last attempt")
+	}
+	if _, ok := transport.retryDelay(post, nil, 0); ok {
+		t.Error("retry of POST")
+	}
+
+	header := http.Header{"Retry-After": {"3"}}
+	delay, ok := transport.retryDelay(get, response(get, 429, header, ""), 0)
+	if !ok || delay < 3*time.Second {
+		t.Errorf("Retry-After 3: delay %v, %v", delay, ok)
+	}
+	header = http.Header{"Retry-After": {"60"}}
+	if _, ok := transport.retryDelay(get, response(get, 429, header, ""), 0); ok {
+		t.Error("retry with Retry-After longer than MaxBackoff")
+	}
+	header = http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"1"}}
+	delay, ok = transport.retryDelay(get, response(get, 429, header, ""), 0)
+	if !ok || delay > time.Second {
+		t.Errorf("Ratelimit-Reset in the past: delay %v, %v", delay, ok)
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if calls.Add(1) < 3 {
+			return response(req, 503, nil, "busy"), nil
+		}
+		return response(req, 200, nil, "ok"), nil
+	})
+	client := &http.Client{Transport: NewTransport("test", base, Options{Backoff: time.Millisecond, Rate: 1000})}
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "ok" || calls.Load() != 3 {
+		t.Errorf("status %d, body %q after %d calls", resp.StatusCode, body, calls.Load())
+	}
+}
+
+func TestTransportBreaker(t *testing.T) {
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return nil, errors.New("connection refused")
+	})
+	transport := NewTransport("test", base, Options{Retries: 1, Backoff: time.Millisecond, Rate: 1000, Failures: 2, Cooldown: time.Hour})
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get("https://example.com/"); err == nil {
+			t.Fatal("no error")
+		}
+	}
+	if calls.Load() != 4 {
+		t.Errorf("%d calls, want 4", calls.Load())
+	}
+	if _, err := client.Get("https://example.com/"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("open breaker: %v", err)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("request sent through open breaker")
+	}
+}
+
+// TestTransportCanceled отмена вызывающим не считается сбоем площадки
+func TestTransportCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return nil, req.Context().Err()
+	})
+	transport := NewTransport("test", base, Options{Rate: 1000, Failures: 1, Cooldown: time.Hour})
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	if !transport.breaker.allow() {
+		t.Error("canceled request opened the breaker")
+	}
+}
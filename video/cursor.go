@@ -0,0 +1,86 @@
+package video
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/DeKoniX/subvideo/models"
+)
+
+// ChannelSync сколько видео канала принесла синхронизация
+type ChannelSync struct {
+	ChannelID string
+	Channel   string
+	Fetched   int
+	New       int
+	// Err канал не удалось опросить, его курсор остался прежним
+	Err error
+}
+
+// channelStats считает видео по каналам и помнит каналы, где запись не
+// удалась: их курсор не сдвигается, чтобы забрать видео в следующий раз
+type channelStats struct {
+	channels []ChannelSync
+	index    map[string]int
+	failed   map[string]bool
+}
+
+func newChannelStats() *channelStats {
+	return &channelStats{index: map[string]int{}, failed: map[string]bool{}}
+}
+
+func (stats *channelStats) add(video models.Subvideo, inserted bool, err error) {
+	i, ok := stats.index[video.ChannelID]
+	if !ok {
+		i = len(stats.channels)
+		stats.index[video.ChannelID] = i
+		stats.channels = append(stats.channels, ChannelSync{ChannelID: video.ChannelID, Channel: video.Channel})
+	}
+	if stats.channels[i].Channel == "" {
+		stats.channels[i].Channel = video.Channel
+	}
+	stats.channels[i].Fetched++
+	if err != nil {
+		stats.failed[video.ChannelID] = true
+	}
+	if inserted {
+		stats.channels[i].New++
+	}
+}
+
+// fail отмечает канал, который не удалось опросить
+func (stats *channelStats) fail(channelID string, err error) {
+	stats.failed[channelID] = true
+	stats.index[channelID] = len(stats.channels)
+	stats.channels = append(stats.channels, ChannelSync{ChannelID: channelID, Err: err})
+}
+
+// report пишет в журнал итог по каждому каналу
+func (stats *channelStats) report(ctx context.Context) []ChannelSync {
+	for _, channel := range stats.channels {
+		if channel.Err != nil {
+			slog.WarnContext(ctx, "channel sync failed", "channel_id", channel.ChannelID, "err", channel.Err)
+			continue
+		}
+		slog.DebugContext(ctx, "channel synced", "channel_id", channel.ChannelID, "channel", channel.Channel,
+			"fetched", channel.Fetched, "new", channel.New)
+	}
+	return stats.channels
+}
+
+// saveCursors сохраняет курсоры каналов, которые сдвинулись
+func (stats *channelStats) saveCursors(user models.User, provider string, cursors, newest map[string]models.SyncCursor) error {
+	for channelID, cursor := range newest {
+		if stats.failed[channelID] || cursors[channelID].VideoID == cursor.VideoID {
+			continue
+		}
+		cursor.UserID = user.Id
+		cursor.Provider = provider
+		cursor.ChannelID = channelID
+		err := cursor.Save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
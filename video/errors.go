@@ -0,0 +1,101 @@
+package video
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DeKoniX/subvideo/models"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrUpstreamUnavailable Twitch или YouTube не отвечает или отвечает 5xx
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrAuthExpired токен пользователя больше не принимают, нужно войти заново
+	ErrAuthExpired = errors.New("auth expired")
+	// ErrQuotaExceeded YouTube отказал, потому что у проекта кончилась квота
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// UpstreamError ошибка запроса к площадке, Status 0 - ответа не было.
+// Сравнивается через errors.Is с ErrUpstreamUnavailable, ErrAuthExpired,
+// ErrQuotaExceeded и models.ErrNotFound.
+type UpstreamError struct {
+	Provider string
+	Status   int
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("%s: %v", e.Provider, e.Err)
+	}
+	return fmt.Sprintf("%s: %d %s: %v", e.Provider, e.Status, http.StatusText(e.Status), e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UpstreamError) Is(target error) bool {
+	switch target {
+	case ErrAuthExpired:
+		return e.Status == http.StatusUnauthorized
+	case ErrUpstreamUnavailable:
+		return e.Status == 0 || e.Status == http.StatusTooManyRequests || e.Status >= 500
+	case ErrQuotaExceeded:
+		// quotaExceeded, dailyLimitExceeded и rateLimitExceeded приходят как 403
+		return e.Status == http.StatusForbidden && strings.Contains(strings.ToLower(e.Err.Error()), "exceeded")
+	case models.ErrNotFound:
+		return e.Status == http.StatusNotFound
+	}
+	return false
+}
+
+// ChannelErrors каналы, которые не удалось опросить, из Total подписок.
+// Видео остальных каналов при этом сохраняются
+type ChannelErrors struct {
+	Total  int
+	Errors map[string]error
+}
+
+func (e *ChannelErrors) Error() string {
+	channelIDs := make([]string, 0, len(e.Errors))
+	for channelID := range e.Errors {
+		channelIDs = append(channelIDs, channelID)
+	}
+	sort.Strings(channelIDs)
+	return fmt.Sprintf("%d of %d channels failed, first %s: %v", len(e.Errors), e.Total, channelIDs[0], e.Errors[channelIDs[0]])
+}
+
+func (e *ChannelErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// ytError приводит ошибки клиента Google к UpstreamError
+func ytError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return err
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return &UpstreamError{Provider: "youtube", Status: apiErr.Code, Err: err}
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return &UpstreamError{Provider: "youtube", Status: http.StatusUnauthorized, Err: err}
+	}
+	return &UpstreamError{Provider: "youtube", Err: err}
+}
@@ -0,0 +1,29 @@
+package video
+
+import (
+	"sync"
+)
+
+// parallel вызывает fn для 0..n-1 не больше чем в workers потоков и ждет
+// всех. fn пишет результат в свою ячейку, поэтому порядок сохраняется
+func parallel(workers, n int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,18 @@
+package video
+
+import "context"
+
+type progressKey struct{}
+
+// WithProgress fn вызывается, когда синхронизация продвинулась: канал
+// опрошен, получена страница или пачка описаний, записано видео. По этому
+// видно, что долгая синхронизация идет, а не зависла
+func WithProgress(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progress(ctx context.Context) {
+	if fn, ok := ctx.Value(progressKey{}).(func()); ok {
+		fn()
+	}
+}
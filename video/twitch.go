@@ -1,12 +1,14 @@
 package video
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"errors"
@@ -14,24 +16,44 @@ import (
 	"github.com/DeKoniX/subvideo/models"
 )
 
+// TWDefaultAPIURL адрес API Twitch, OAuth находится там же
+const TWDefaultAPIURL = "https://api.twitch.tv/kraken/"
+
 type TW struct {
 	ClientID     string
 	ClientSecret string
 	RedirectURI  string
+	APIURL       string
 	HTTPClient   *http.Client
 }
 
-func TWInit(clientID, clientSecret, redirectURI string) *TW {
+// TWInit создает клиент, apiURL пустой - настоящий Twitch
+func TWInit(clientID, clientSecret, redirectURI, apiURL string) *TW {
+	if apiURL == "" {
+		apiURL = TWDefaultAPIURL
+	}
 	return &TW{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		HTTPClient:   &http.Client{},
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
 		RedirectURI:  redirectURI,
+		APIURL:       strings.TrimSuffix(apiURL, "/") + "/",
+	}
+}
+
+// AuthURL адрес, на который отправляется пользователь для входа через Twitch
+func (tw *TW) AuthURL() string {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {tw.ClientID},
+		"scope":         {"user_read"},
+		"redirect_uri":  {tw.RedirectURI},
 	}
+	return tw.APIURL + "oauth2/authorize?" + q.Encode()
 }
 
-func (tw *TW) connect(url, oauth string) (body []byte, err error) {
-	req, err := http.NewRequest("GET", "https://api.twitch.tv/kraken/"+url, nil)
+func (tw *TW) connect(ctx context.Context, url, oauth string) (body []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", tw.APIURL+url, nil)
 	if err != nil {
 		return body, err
 	}
@@ -42,18 +64,34 @@ func (tw *TW) connect(url, oauth string) (body []byte, err error) {
 	}
 	resp, err := tw.HTTPClient.Do(req)
 	if err != nil {
-		return body, err
+		return body, &UpstreamError{Provider: "twitch", Err: err}
 	}
+	defer resp.Body.Close()
 	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return body, err
+		return body, &UpstreamError{Provider: "twitch", Err: err}
+	}
+	if resp.StatusCode >= 400 {
+		return body, &UpstreamError{Provider: "twitch", Status: resp.StatusCode, Err: errors.New(twErrorMessage(body))}
 	}
 
 	return body, nil
 }
 
-func (tw *TW) OAuthTest(accessToken string) (twChannelID, userName, avatarURL string, err error) {
-	body, err := tw.connect("user", accessToken)
+// twErrorMessage достает message из ответа Twitch с ошибкой
+func twErrorMessage(body []byte) string {
+	var jsontw struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &jsontw) != nil || jsontw.Message == "" {
+		return strings.TrimSpace(string(body))
+	}
+	return jsontw.Error + ": " + jsontw.Message
+}
+
+func (tw *TW) OAuthTest(ctx context.Context, accessToken string) (twChannelID, userName, avatarURL string, err error) {
+	body, err := tw.connect(ctx, "user", accessToken)
 	if err != nil {
 		return twChannelID, userName, avatarURL, err
 	}
@@ -83,19 +121,24 @@ func (tw *TW) OAuthTest(accessToken string) (twChannelID, userName, avatarURL st
 	return twChannelID, userName, avatarURL, nil
 }
 
-func (tw *TW) Auth(code string) (accessToken string, err error) {
-	resp, err := tw.HTTPClient.PostForm("https://api.twitch.tv/kraken/oauth2/token",
-		url.Values{
-			"client_id":     {tw.ClientID},
-			"client_secret": {tw.ClientSecret},
-			"grant_type":    {"authorization_code"},
-			"redirect_uri":  {tw.RedirectURI},
-			"code":          {code},
-		},
-	)
+func (tw *TW) Auth(ctx context.Context, code string) (accessToken string, err error) {
+	form := url.Values{
+		"client_id":     {tw.ClientID},
+		"client_secret": {tw.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {tw.RedirectURI},
+		"code":          {code},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", tw.APIURL+"oauth2/token", strings.NewReader(form.Encode()))
 	if err != nil {
 		return accessToken, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tw.HTTPClient.Do(req)
+	if err != nil {
+		return accessToken, &UpstreamError{Provider: "twitch", Err: err}
+	}
+	defer resp.Body.Close()
 	type jsonTW struct {
 		AccessToken string `json:"access_token"`
 	}
@@ -103,7 +146,10 @@ func (tw *TW) Auth(code string) (accessToken string, err error) {
 	var jsontw jsonTW
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return accessToken, err
+		return accessToken, &UpstreamError{Provider: "twitch", Err: err}
+	}
+	if resp.StatusCode >= 400 {
+		return accessToken, &UpstreamError{Provider: "twitch", Status: resp.StatusCode, Err: errors.New(twErrorMessage(body))}
 	}
 	err = json.Unmarshal(body, &jsontw)
 	if err != nil {
@@ -113,8 +159,8 @@ func (tw *TW) Auth(code string) (accessToken string, err error) {
 	return jsontw.AccessToken, nil
 }
 
-func (tw *TW) GetOnline(oauth string) (videos []models.Subvideo, err error) {
-	body, err := tw.connect("streams/followed?limit=100&stream_type=live", oauth)
+func (tw *TW) GetOnline(ctx context.Context, oauth string) (videos []models.Subvideo, err error) {
+	body, err := tw.connect(ctx, "streams/followed?limit=100&stream_type=live", oauth)
 	if err != nil {
 		return videos, err
 	}
@@ -132,6 +178,7 @@ func (tw *TW) GetOnline(oauth string) (videos []models.Subvideo, err error) {
 				DisplayName string `json:"display_name"`
 				ID          int    `json:"_id"`
 				URL         string `json:"url"`
+				Language    string `json:"language"`
 			}
 		}
 	}
@@ -155,71 +202,153 @@ func (tw *TW) GetOnline(oauth string) (videos []models.Subvideo, err error) {
 			Game:      stream.Game,
 			ThumbURL:  stream.Preview.Large,
 			URL:       stream.Channel.URL,
+			Language:  videoLanguage(stream.Channel.Language, stream.Channel.Status),
 			Length:    getLength(twTime),
+			Date:      twTime.UTC(),
 		})
 	}
 	return videos, nil
 }
 
-func (tw *TW) GetVideos(oauth string) (videos []models.Subvideo, err error) {
-	body, err := tw.connect("videos/followed?limit=100&broadcast_type=all", oauth)
+// twPageSize и twMaxPages: videos/followed отдает не больше 100 видео за
+// запрос, дальше twMaxPages страниц синхронизация не листает
+const (
+	twPageSize = 100
+	twMaxPages = 10
+)
+
+// twFollowedVideo видео из videos/followed
+type twFollowedVideo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	ID          string `json:"_id"`
+	RecordedAt  string `json:"recorded_at"`
+	Game        string `json:"game"`
+	Length      int    `json:"length"`
+	Language    string `json:"language"`
+	Preview     struct {
+		Large string `json:"large"`
+	}
+	Channel struct {
+		ID          int    `json:"_id"`
+		DisplayName string `json:"display_name"`
+		Name        string `json:"name"`
+	}
+}
+
+// followedPage страница videos/followed от новых видео к старым
+func (tw *TW) followedPage(ctx context.Context, oauth string, offset int) (videos []twFollowedVideo, err error) {
+	body, err := tw.connect(ctx, "videos/followed?limit="+strconv.Itoa(twPageSize)+
+		"&offset="+strconv.Itoa(offset)+"&broadcast_type=all", oauth)
 	if err != nil {
 		return videos, err
 	}
+	var jsontw struct {
+		Videos []twFollowedVideo
+	}
+	err = json.Unmarshal(body, &jsontw)
+	return jsontw.Videos, err
+}
 
-	type jsonTW struct {
-		Videos []struct {
-			Title       string `json:"title"`
-			Description string `json:"description"`
-			URL         string `json:"url"`
-			ID          string `json:"_id"`
-			RecordedAt  string `json:"recorded_at"`
-			Game        string `json:"game"`
-			Length      int    `json:"length"`
-			Preview     struct {
-				Large string `json:"large"`
+// subvideo видео для сохранения, короткие записи subvideo не хранит
+func (video twFollowedVideo) subvideo(twTime time.Time) (subvideo models.Subvideo, ok bool) {
+	if video.Length <= 300 {
+		return subvideo, false
+	}
+	return models.Subvideo{
+		TypeSub:     "twitch",
+		Title:       video.Title,
+		Channel:     video.Channel.Name,
+		ChannelID:   strconv.Itoa(video.Channel.ID),
+		Game:        video.Game,
+		Description: video.Description,
+		URL:         video.URL,
+		VideoID:     video.ID,
+		ThumbURL:    video.Preview.Large,
+		Length:      video.Length,
+		Language:    videoLanguage(video.Language, video.Title, video.Description),
+		Date:        twTime.UTC(),
+	}, true
+}
+
+// GetVideos видео подписок, вышедшие после курсоров каналов, не больше
+// limit на канал. Страницы листаются, пока есть каналы с курсором, до
+// которого еще не дошли. Канал без курсора берется с первых страниц, как
+// раньше. newest - курсоры для следующей синхронизации, в том числе с учетом
+// коротких видео, которые не сохраняются
+func (tw *TW) GetVideos(ctx context.Context, oauth string, cursors map[string]models.SyncCursor, limit int) (videos []models.Subvideo, newest map[string]models.SyncCursor, err error) {
+	newest = map[string]models.SyncCursor{}
+	count := map[string]int{}
+	reached := map[string]bool{}
+	for page := 0; page < twMaxPages; page++ {
+		followed, err := tw.followedPage(ctx, oauth, page*twPageSize)
+		if err != nil {
+			return videos, newest, err
+		}
+		progress(ctx)
+
+		more := false
+		for _, video := range followed {
+			twTime, err := time.Parse(time.RFC3339, video.RecordedAt)
+			if err != nil {
+				return videos, newest, err
 			}
-			Channel struct {
-				ID          int    `json:"_id"`
-				DisplayName string `json:"display_name"`
-				Name        string `json:"name"`
+			channelID := strconv.Itoa(video.Channel.ID)
+			if reached[channelID] || count[channelID] >= limit {
+				continue
+			}
+			cursor, ok := cursors[channelID]
+			if ok && (video.ID == cursor.VideoID || twTime.Before(cursor.PublishedAt)) {
+				reached[channelID] = true
+				continue
 			}
+			if twTime.After(newest[channelID].PublishedAt) {
+				newest[channelID] = models.SyncCursor{VideoID: video.ID, PublishedAt: twTime.UTC()}
+			}
+			count[channelID]++
+			more = more || (ok && count[channelID] < limit)
+
+			if subvideo, ok := video.subvideo(twTime); ok {
+				videos = append(videos, subvideo)
+			}
+		}
+		if !more || len(followed) < twPageSize {
+			break
 		}
 	}
 
-	var jsontw jsonTW
-	err = json.Unmarshal(body, &jsontw)
+	return videos, newest, nil
+}
+
+// BackfillPage страница истории для загрузки старых видео. oldest - дата
+// самого старого видео страницы, next - сдвиг следующей страницы, 0 - это
+// была последняя
+func (tw *TW) BackfillPage(ctx context.Context, oauth string, offset int) (videos []models.Subvideo, oldest time.Time, next int, err error) {
+	followed, err := tw.followedPage(ctx, oauth, offset)
 	if err != nil {
-		return videos, err
+		return videos, oldest, 0, err
 	}
-
-	for _, video := range jsontw.Videos {
+	for _, video := range followed {
 		twTime, err := time.Parse(time.RFC3339, video.RecordedAt)
 		if err != nil {
-			return videos, err
+			return videos, oldest, 0, err
+		}
+		if oldest.IsZero() || twTime.Before(oldest) {
+			oldest = twTime
 		}
-		if video.Length > 300 {
-			videos = append(videos, models.Subvideo{
-				TypeSub:     "twitch",
-				Title:       video.Title,
-				Channel:     video.Channel.Name,
-				ChannelID:   strconv.Itoa(video.Channel.ID),
-				Game:        video.Game,
-				Description: video.Description,
-				URL:         video.URL,
-				VideoID:     video.ID,
-				ThumbURL:    video.Preview.Large,
-				Length:      video.Length,
-				Date:        twTime.UTC(),
-			})
+		if subvideo, ok := video.subvideo(twTime); ok {
+			videos = append(videos, subvideo)
 		}
 	}
-
-	return videos, nil
+	if len(followed) == twPageSize {
+		next = offset + twPageSize
+	}
+	return videos, oldest, next, nil
 }
 
-func (tw *TW) GetChannel(oauth, channelID string) (video models.Subvideo, err error) {
-	body, err := tw.connect("channels/"+channelID, oauth)
+func (tw *TW) GetChannel(ctx context.Context, oauth, channelID string) (video models.Subvideo, err error) {
+	body, err := tw.connect(ctx, "channels/"+channelID, oauth)
 	if err != nil {
 		return video, err
 	}
@@ -1,8 +1,14 @@
 package video
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/DeKoniX/subvideo/logging"
 	"github.com/DeKoniX/subvideo/models"
 )
 
@@ -18,17 +24,30 @@ type ChannelOnline struct {
 type ClientVideo struct {
 	YTClient *YT
 	TWClient *TW
+	// ChannelLimit сколько новых видео одного канала можно забрать за
+	// синхронизацию, если с прошлой вышло больше
+	ChannelLimit int
+	// Workers сколько каналов YouTube опрашивается одновременно
+	Workers int
 }
 
-func Init(twClientID, twClientSecret, twRedirectURI, ytClientID, ytClientSecret, ytRedirectURI string) (client *ClientVideo) {
+// Значения ChannelLimit и Workers, если они не заданы
+const (
+	DefaultChannelLimit = 50
+	DefaultWorkers      = 4
+)
+
+func Init(tw *TW, yt *YT) (client *ClientVideo) {
 	return &ClientVideo{
-		TWClient: TWInit(twClientID, twClientSecret, twRedirectURI),
-		YTClient: YTInit(ytClientID, ytClientSecret, ytRedirectURI),
+		TWClient:     tw,
+		YTClient:     yt,
+		ChannelLimit: DefaultChannelLimit,
+		Workers:      DefaultWorkers,
 	}
 }
 
 func (client *ClientVideo) SortVideo(user models.User, n int, channelID string, page int) (subVideos []models.Subvideo, countVideos int, err error) {
-	subVideos, countVideos, err = models.SelectVideo(int(user.Id), n, channelID, page)
+	subVideos, countVideos, err = models.Videos.SelectVideo(int(user.Id), n, channelID, page, user.ShowHidden)
 	if err != nil {
 		return subVideos, countVideos, err
 	}
@@ -44,35 +63,21 @@ func (client *ClientVideo) SortVideo(user models.User, n int, channelID string,
 	return subVideos, countVideos, nil
 }
 
-func (client *ClientVideo) SearchVideo(user models.User, n, page int, search string) (subVideos []models.Subvideo, countVideos int, err error) {
-	subVideos, countVideos, err = models.SearchVideo(search, int(user.Id), n, page)
-	if err != nil {
-		return subVideos, countVideos, err
-	}
-	for _, video := range subVideos {
-		var timezone *time.Location
-		if user.TimeZone == "" {
-			timezone, _ = time.LoadLocation("UTC")
-		} else {
-			timezone, _ = time.LoadLocation(user.TimeZone)
-		}
-		video.Date = video.Date.In(timezone)
-	}
-	return subVideos, countVideos, nil
+func (client *ClientVideo) GroupVideo(user models.User, n int, groupID int64, page int) (subVideos []models.Subvideo, countVideos int, err error) {
+	return models.Videos.SelectGroupVideo(int(user.Id), groupID, n, page, user.ShowHidden)
 }
 
-func (client *ClientVideo) GetOnlineStreams(user models.User) (streamOnline []models.Subvideo, err error) {
-	twitchStream, err := client.TWClient.GetOnline(user.TWOAuth)
-	if err != nil {
-		return streamOnline, err
-	}
-	youtubeStream, err := models.SelectStreamVideo(int(user.Id))
+func (client *ClientVideo) SearchVideo(user models.User, n, page int, query models.SearchQuery) (results []models.SearchResult, countVideos int, err error) {
+	return models.Videos.SearchVideo(query, int(user.Id), n, page, user.ShowHidden)
+}
+
+// YTLiveStreams идущие стримы YouTube, их находит синхронизация, поэтому
+// они берутся из базы
+func (client *ClientVideo) YTLiveStreams(user models.User) (streamOnline []models.Subvideo, err error) {
+	youtubeStream, err := models.Videos.SelectStreamVideo(int(user.Id))
 	if err != nil {
 		return streamOnline, err
 	}
-	for _, stream := range twitchStream {
-		streamOnline = append(streamOnline, stream)
-	}
 	for _, stream := range youtubeStream {
 		if stream.Length != 0 {
 			streamOnline = append(streamOnline, stream)
@@ -82,39 +87,119 @@ func (client *ClientVideo) GetOnlineStreams(user models.User) (streamOnline []mo
 	return streamOnline, nil
 }
 
-func (client *ClientVideo) TWGetVideo(user models.User) (err error) {
+// SyncResult что нового принесла синхронизация пользователя
+type SyncResult struct {
+	NewVideos []models.Subvideo
+	WentLive  []models.Subvideo
+	Channels  []ChannelSync
+}
+
+func (client *ClientVideo) TWGetVideo(ctx context.Context, user models.User) (result SyncResult, err error) {
+	ctx = logging.WithProvider(ctx, "twitch")
 	if user.TWOAuth != "" || user.TWChannelID != "" {
-		videos, err := client.TWClient.GetVideos(user.TWOAuth)
+		cursors, err := models.SelectSyncCursors(user.Id, "twitch")
+		if err != nil {
+			return result, err
+		}
+		videos, newest, err := client.TWClient.GetVideos(ctx, user.TWOAuth, cursors, client.ChannelLimit)
 		if err != nil {
-			return err
+			return result, err
 		}
+		stats := newChannelStats()
 		for _, video := range videos {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
 			video.UserID = user.Id
-			video.Insert()
+			inserted, err := video.Insert(ctx)
+			stats.add(video, inserted, err)
+			progress(ctx)
+			if err != nil {
+				slog.WarnContext(ctx, "video insert failed", "video_id", video.VideoID, "err", err)
+				continue
+			}
+			if inserted {
+				result.NewVideos = append(result.NewVideos, video)
+			}
+		}
+		result.Channels = stats.report(ctx)
+		err = stats.saveCursors(user, "twitch", cursors, newest)
+		if err != nil {
+			return result, err
 		}
+		slog.DebugContext(ctx, "sync finished", "fetched", len(videos), "inserted", len(result.NewVideos))
 	} else {
 		user.TWChannelID = ""
 		user.TWOAuth = ""
 		user.Insert()
 	}
-	return nil
+	return result, nil
 }
 
-func (client *ClientVideo) YTGetVideo(user models.User) (err error) {
+func (client *ClientVideo) YTGetVideo(ctx context.Context, user models.User) (result SyncResult, err error) {
+	ctx = logging.WithProvider(ctx, "youtube")
 	if user.YTOAuth != "" || user.YTChannelID != "" {
-		videos, err := client.YTClient.GetVideos(user)
+		cursors, err := models.SelectSyncCursors(user.Id, "youtube")
+		if err != nil {
+			return result, err
+		}
+		videos, newest, err := client.YTClient.GetVideos(ctx, user, cursors, client.ChannelLimit, client.Workers)
+		var failed *ChannelErrors
+		if err != nil && !errors.As(err, &failed) {
+			return result, ytError(err)
+		}
+
+		upcoming := map[string]bool{}
+		streams, err := models.Videos.SelectStreamOnlineYouTube(int(user.Id))
 		if err != nil {
-			return err
+			return result, err
+		}
+		for _, stream := range streams {
+			if stream.TypeSub == "youtube-stream" {
+				upcoming[stream.VideoID] = true
+			}
 		}
 
+		stats := newChannelStats()
+		if failed != nil {
+			for channelID, err := range failed.Errors {
+				stats.fail(channelID, err)
+			}
+		}
 		for _, video := range videos {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
 			video.UserID = user.Id
-			video.Insert()
+			inserted, err := video.Insert(ctx)
+			stats.add(video, inserted, err)
+			progress(ctx)
+			if err != nil {
+				slog.WarnContext(ctx, "video insert failed", "video_id", video.VideoID, "err", err)
+				continue
+			}
+			if inserted {
+				result.NewVideos = append(result.NewVideos, video)
+			}
+			if video.TypeSub == "youtube-stream-live" && (inserted || upcoming[video.VideoID]) {
+				result.WentLive = append(result.WentLive, video)
+			}
 		}
-		err = client.YTClient.TestStreamYouTube(user)
+		result.Channels = stats.report(ctx)
+		err = stats.saveCursors(user, "youtube", cursors, newest)
 		if err != nil {
-			return err
+			return result, err
+		}
+		wentLive, err := client.YTClient.TestStreamYouTube(ctx, user)
+		result.WentLive = append(result.WentLive, wentLive...)
+		if err != nil {
+			return result, ytError(err)
+		}
+		// синхронизация не удалась, только если не ответил ни один канал
+		if failed != nil && len(failed.Errors) == failed.Total {
+			return result, failed
 		}
+		slog.DebugContext(ctx, "sync finished", "fetched", len(videos), "inserted", len(result.NewVideos), "went_live", len(result.WentLive))
 	} else {
 		user.YTChannelID = ""
 		user.YTOAuth = ""
@@ -122,9 +207,49 @@ func (client *ClientVideo) YTGetVideo(user models.User) (err error) {
 		user.Insert()
 	}
 
-	return nil
+	return result, nil
+}
+
+// TWLiveStreams идущие сейчас стримы на Twitch
+func (client *ClientVideo) TWLiveStreams(ctx context.Context, user models.User) (streams []models.Subvideo, err error) {
+	if user.TWOAuth == "" {
+		return streams, nil
+	}
+	return client.TWClient.GetOnline(ctx, user.TWOAuth)
 }
 
 func getLength(timeStream time.Time) int {
 	return int(time.Now().Unix() - timeStream.Unix())
 }
+
+// videoLanguage приводит язык от API к коду ISO 639-1, а если его нет,
+// угадывает по алфавиту названия и описания
+func videoLanguage(language string, texts ...string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		language = language[:i]
+	}
+	if language != "" && language != "other" && language != "zxx" {
+		return language
+	}
+	return detectLanguage(strings.Join(texts, " "))
+}
+
+func detectLanguage(text string) string {
+	var cyrillic, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	switch {
+	case cyrillic > 0 && cyrillic >= latin/2:
+		return "ru"
+	case latin > 0:
+		return "en"
+	}
+	return ""
+}
@@ -2,63 +2,144 @@ package video
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"strconv"
-
+	"strings"
 	"time"
 
-	"errors"
-
 	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/upstream"
 	duration "github.com/channelmeter/iso8601duration"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/plus/v1"
 	"google.golang.org/api/youtube/v3"
 )
 
+// Адреса Google по умолчанию: API, от которого отсчитываются youtube/v3/
+// и plus/v1/, и OAuth, от которого отсчитываются auth и token
+const (
+	YTDefaultAPIURL   = "https://www.googleapis.com/"
+	YTDefaultOAuthURL = "https://accounts.google.com/o/oauth2/"
+)
+
 type YT struct {
 	context   context.Context
 	oauthConf *oauth2.Config
+	apiURL    string
 	URL       string
 }
 
-func YTInit(clientID, clientSecret, redirectURL string) *YT {
+// YTInit создает клиент, пустые apiURL и oauthURL - настоящий Google
+func YTInit(clientID, clientSecret, redirectURL, apiURL, oauthURL string) *YT {
+	if apiURL == "" {
+		apiURL = YTDefaultAPIURL
+	}
+	if oauthURL == "" {
+		oauthURL = YTDefaultOAuthURL
+	}
+	oauthURL = strings.TrimSuffix(oauthURL, "/") + "/"
 	conf := &oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Scopes:       []string{youtube.YoutubeReadonlyScope, plus.UserinfoProfileScope},
 		RedirectURL:  redirectURL,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://accounts.google.com/o/oauth2/token",
+			AuthURL:  oauthURL + "auth",
+			TokenURL: oauthURL + "token",
 		},
 	}
 	return &YT{
 		context:   context.Background(),
 		oauthConf: conf,
+		apiURL:    strings.TrimSuffix(apiURL, "/") + "/",
 		URL:       conf.AuthCodeURL("state", oauth2.AccessTypeOffline, oauth2.ApprovalForce),
 	}
 }
 
-func (yt *YT) Auth(code string) *oauth2.Token {
-	tok, _ := yt.oauthConf.Exchange(yt.context, code)
-	return tok
+// APIURL адрес API Google, от которого отсчитываются youtube/v3/ и plus/v1/
+func (yt *YT) APIURL() string {
+	return yt.apiURL
+}
+
+// youtubeService клиент YouTube Data API по адресу из настроек
+func (yt *YT) youtubeService(client *http.Client) (*youtube.Service, error) {
+	service, err := youtube.New(client)
+	if err != nil {
+		return nil, err
+	}
+	service.BasePath = yt.apiURL + "youtube/v3/"
+	return service, nil
 }
 
-func (yt *YT) OAuthTest(token *oauth2.Token) (ytChannelID, userName, avatarURL string, err error) {
+// userService клиент YouTube от имени пользователя. Обновленный токен
+// сохраняется, а истекший стирается, чтобы пользователь вошел заново
+func (yt *YT) userService(ctx context.Context, user models.User) (*youtube.Service, error) {
+	token := oauth2.Token{AccessToken: user.YTOAuth, RefreshToken: user.YTRefreshToken, Expiry: user.YTExpiry, TokenType: "Bearer"}
+
+	tokenSource := yt.oauthConf.TokenSource(yt.context, &token)
+	updateToken, err := tokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken != updateToken.AccessToken {
+		user.YTOAuth = updateToken.AccessToken
+		user.YTRefreshToken = updateToken.RefreshToken
+		user.YTExpiry = updateToken.Expiry
+		user.Insert()
+	}
+
+	if time.Now().After(user.YTExpiry) {
+		slog.WarnContext(ctx, "youtube token expired, clearing")
+		user.YTOAuth = ""
+		user.YTRefreshToken = ""
+		user.Insert()
+	}
+
+	return yt.youtubeService(oauth2.NewClient(yt.context, tokenSource))
+}
+
+// userContext помечает запросы пользователем для кэша ответов
+func userContext(ctx context.Context, user models.User) context.Context {
+	return upstream.WithIdentity(ctx, "youtube:"+strconv.FormatInt(user.Id, 10))
+}
+
+// SetHTTPClient задает HTTP клиент для запросов к Google, в том числе обновления токенов
+func (yt *YT) SetHTTPClient(client *http.Client) {
+	yt.context = context.WithValue(context.Background(), oauth2.HTTPClient, client)
+}
+
+// Auth обменивает код на токен. HTTP клиент берется из SetHTTPClient, а
+// отмена и таймаут - из ctx запроса
+func (yt *YT) Auth(ctx context.Context, code string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, yt.context.Value(oauth2.HTTPClient))
+	tok, err := yt.oauthConf.Exchange(ctx, code)
+	if err != nil {
+		return nil, ytError(err)
+	}
+	return tok, nil
+}
+
+func (yt *YT) OAuthTest(ctx context.Context, token *oauth2.Token) (ytChannelID, userName, avatarURL string, err error) {
 	client := yt.oauthConf.Client(yt.context, token)
 	plusService, err := plus.New(client)
-	youtubeService, err := youtube.New(client)
+	if err != nil {
+		return ytChannelID, userName, avatarURL, err
+	}
+	plusService.BasePath = yt.apiURL + "plus/v1/"
+	youtubeService, err := yt.youtubeService(client)
 	if err != nil {
 		return ytChannelID, userName, avatarURL, err
 	}
 
-	person, err := plusService.People.Get("me").Do()
+	person, err := plusService.People.Get("me").Context(ctx).Do()
 	if err != nil {
 		return ytChannelID, userName, avatarURL, err
 	}
 
-	channel, err := youtubeService.Channels.List("id").Mine(true).Do()
+	channel, err := youtubeService.Channels.List("id").Mine(true).Context(ctx).Do()
 	if err != nil {
 		return ytChannelID, userName, avatarURL, err
 	}
@@ -74,165 +155,266 @@ func (yt *YT) OAuthTest(token *oauth2.Token) (ytChannelID, userName, avatarURL s
 	return channel.Items[0].Id, userName, person.Image.Url, nil
 }
 
-func (yt *YT) GetVideos(user models.User) (videos []models.Subvideo, err error) {
-	token := oauth2.Token{AccessToken: user.YTOAuth, RefreshToken: user.YTRefreshToken, Expiry: user.YTExpiry, TokenType: "Bearer"}
-
-	tokenSource := yt.oauthConf.TokenSource(yt.context, &token)
-	updateToken, err := tokenSource.Token()
+// ytFirstSync сколько последних видео берется у канала без курсора
+const ytFirstSync = 5
+
+// GetVideos видео подписок, вышедшие после курсоров каналов, не больше limit
+// на канал. Каналы опрашиваются в workers потоков, описания видео
+// запрашиваются общими пачками по 50. Ошибка канала не прерывает остальные:
+// такие каналы возвращаются в *ChannelErrors вместе с видео остальных, их
+// курсоры не сдвигаются. Квота и отозванный токен останавливают все сразу.
+// newest - курсоры для следующей синхронизации
+func (yt *YT) GetVideos(ctx context.Context, user models.User, cursors map[string]models.SyncCursor, limit, workers int) (videos []models.Subvideo, newest map[string]models.SyncCursor, err error) {
+	newest = map[string]models.SyncCursor{}
+	ctx = userContext(ctx, user)
+	service, err := yt.userService(ctx, user)
 	if err != nil {
-		return videos, err
+		return videos, newest, err
 	}
-
-	if token.AccessToken != updateToken.AccessToken {
-		user.YTOAuth = updateToken.AccessToken
-		user.YTRefreshToken = updateToken.RefreshToken
-		user.YTExpiry = updateToken.Expiry
-		user.Insert()
+	channels, _, err := yt.subscriptionIDs(ctx, service)
+	if err != nil {
+		return videos, newest, err
 	}
 
-	if time.Now().After(user.YTExpiry) {
-		log.Println("Очищаю токен", user.UserName)
-		user.YTOAuth = ""
-		user.YTRefreshToken = ""
-		user.Insert()
-	}
+	// при квоте или отозванном токене остальные каналы не опрашиваются
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	client := oauth2.NewClient(yt.context, tokenSource)
+	type channelFetch struct {
+		ids    []string
+		cursor models.SyncCursor
+		err    error
+	}
+	fetched := make([]channelFetch, len(channels))
+	parallel(workers, len(channels), func(i int) {
+		if err := fetchCtx.Err(); err != nil {
+			fetched[i].err = err
+			return
+		}
+		channelID := channels[i]
+		ids, cursor, err := yt.searchChannel(fetchCtx, service, channelID, cursors[channelID], limit)
+		fetched[i] = channelFetch{ids: ids, cursor: cursor, err: ytError(err)}
+		if stopsSync(fetched[i].err) {
+			cancel()
+		}
+		progress(ctx)
+	})
+	if err := ctx.Err(); err != nil {
+		return videos, newest, err
+	}
 
-	service, err := youtube.New(client)
-	if err != nil {
-		return videos, err
+	failed := &ChannelErrors{Total: len(channels), Errors: map[string]error{}}
+	owner := map[string]string{}
+	var ids []string
+	for _, fetch := range fetched {
+		if stopsSync(fetch.err) {
+			return videos, newest, fetch.err
+		}
 	}
-	repeat := true
-	pageToken := ""
-	typeSub := ""
-	var ytTime time.Time
-	for repeat == true {
-		repeat = false
-		call := service.Subscriptions.List("snippet").Mine(true).MaxResults(50).PageToken(pageToken)
-		response, err := call.Do()
-		if err != nil {
-			return videos, err
+	for i, fetch := range fetched {
+		channelID := channels[i]
+		if fetch.err != nil {
+			failed.Errors[channelID] = fetch.err
+			continue
 		}
-		if response.NextPageToken != "" {
-			pageToken = response.NextPageToken
-			repeat = true
+		if fetch.cursor.VideoID != "" {
+			newest[channelID] = fetch.cursor
 		}
-		if err != nil {
-			return videos, err
+		for _, id := range fetch.ids {
+			owner[id] = channelID
 		}
+		ids = append(ids, fetch.ids...)
+	}
 
-		for _, item := range response.Items {
-			var ids string
-			channelID := item.Snippet.ResourceId.ChannelId
-
-			callSearchVideos := service.Search.List("snippet").
-				Q("").
-				ChannelId(channelID).
-				MaxResults(5).
-				Order("date").
-				Type("video")
-
-			responseSearchVideos, err := callSearchVideos.Do()
-			if err != nil {
-				return videos, err
+	// videos.list принимает не больше 50 ID за раз
+	type batchFetch struct {
+		videos []*youtube.Video
+		err    error
+	}
+	batches := make([]batchFetch, (len(ids)+49)/50)
+	parallel(workers, len(batches), func(i int) {
+		if err := fetchCtx.Err(); err != nil {
+			batches[i].err = err
+			return
+		}
+		batch := ids[i*50 : min(i*50+50, len(ids))]
+		response, err := service.Videos.List("snippet,contentDetails,liveStreamingDetails").Id(strings.Join(batch, ",")).Context(fetchCtx).Do()
+		if err != nil {
+			batches[i].err = ytError(err)
+			if stopsSync(batches[i].err) {
+				cancel()
 			}
+			return
+		}
+		batches[i].videos = response.Items
+		progress(ctx)
+	})
+	if err := ctx.Err(); err != nil {
+		return videos, newest, err
+	}
 
-			for _, videoSearch := range responseSearchVideos.Items {
-				ids += videoSearch.Id.VideoId + ","
+	fail := func(channelID string, err error) {
+		failed.Errors[channelID] = err
+		delete(newest, channelID)
+	}
+	for i, batch := range batches {
+		if stopsSync(batch.err) {
+			return videos, newest, batch.err
+		}
+		if batch.err != nil {
+			for _, id := range ids[i*50 : min(i*50+50, len(ids))] {
+				fail(owner[id], batch.err)
 			}
-			callVideos := service.Videos.List("snippet,contentDetails,liveStreamingDetails").Id(ids)
-			responseVideos, err := callVideos.Do()
+			continue
+		}
+		for _, video := range batch.videos {
+			subvideo, err := ytSubvideo(video)
 			if err != nil {
-				return videos, err
+				fail(owner[video.Id], err)
+				continue
 			}
+			videos = append(videos, subvideo)
+		}
+	}
 
-			for _, video := range responseVideos.Items {
-				durationParser, err := duration.FromString(video.ContentDetails.Duration)
-				if err != nil {
-					return videos, err
-				}
-				durationVideo := durationParser.ToDuration()
+	if len(failed.Errors) > 0 {
+		return videos, newest, failed
+	}
+	return videos, newest, nil
+}
 
-				switch video.Snippet.LiveBroadcastContent {
-				case "upcoming":
-					ytTime, err = time.Parse(time.RFC3339, video.LiveStreamingDetails.ScheduledStartTime)
-					if err != nil {
-						return videos, err
-					}
-					typeSub = "youtube-stream"
-				case "live":
-					ytTime, err = time.Parse(time.RFC3339, video.LiveStreamingDetails.ActualStartTime)
-					if err != nil {
-						return videos, err
-					}
-					durationVideo, err = time.ParseDuration(strconv.Itoa(getLength(ytTime)) + "s")
-					if err != nil {
-						return videos, err
-					}
-					typeSub = "youtube-stream-live"
-				default:
-					ytTime, err = time.Parse(time.RFC3339, video.Snippet.PublishedAt)
-					if err != nil {
-						return videos, err
-					}
-					typeSub = "youtube"
-				}
+// stopsSync ошибки, после которых опрашивать остальные каналы бесполезно
+func stopsSync(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrAuthExpired)
+}
 
-				videos = append(videos, models.Subvideo{
-					TypeSub:     typeSub,
-					Title:       video.Snippet.Title,
-					Channel:     video.Snippet.ChannelTitle,
-					ChannelID:   video.Snippet.ChannelId,
-					Description: video.Snippet.Description,
-					VideoID:     video.Id,
-					URL:         "https://www.youtube.com/watch?v=" + video.Id,
-					ThumbURL:    video.Snippet.Thumbnails.High.Url,
-					Length:      int(durationVideo.Seconds()),
-					Date:        ytTime.UTC(),
-				})
-			}
+// subscriptionIDs ID каналов из подписок, pages - сколько страниц запрошено
+func (yt *YT) subscriptionIDs(ctx context.Context, service *youtube.Service) (channelIDs []string, pages int, err error) {
+	pageToken := ""
+	for {
+		response, err := service.Subscriptions.List("snippet").Mine(true).MaxResults(50).PageToken(pageToken).Context(ctx).Do()
+		pages++
+		if err != nil {
+			return channelIDs, pages, err
+		}
+		for _, item := range response.Items {
+			channelIDs = append(channelIDs, item.Snippet.ResourceId.ChannelId)
+		}
+		if response.NextPageToken == "" {
+			return channelIDs, pages, nil
 		}
+		pageToken = response.NextPageToken
 	}
-
-	return videos, nil
 }
 
-func (yt *YT) TestStreamYouTube(user models.User) (err error) {
-	typeSub := ""
+// searchChannel ID новых видео канала от новых к старым: вышедшие после
+// курсора, но не больше limit. Без курсора - последние ytFirstSync. newest -
+// самое новое из найденного, пустой, если нового нет
+func (yt *YT) searchChannel(ctx context.Context, service *youtube.Service, channelID string, cursor models.SyncCursor, limit int) (ids []string, newest models.SyncCursor, err error) {
+	call := service.Search.List("snippet").
+		Q("").
+		ChannelId(channelID).
+		Order("date").
+		Type("video")
+	if cursor.VideoID == "" {
+		limit = ytFirstSync
+	} else {
+		// publishedAfter включает саму границу, видео курсора отсекается ниже
+		call = call.PublishedAfter(cursor.PublishedAt.UTC().Format(time.RFC3339))
+	}
 
-	videos, err := models.SelectStreamOnlineYouTube(int(user.Id))
-	if err != nil {
-		return err
+	pageToken := ""
+	for len(ids) < limit {
+		response, err := call.MaxResults(int64(min(50, limit-len(ids)))).PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return ids, newest, err
+		}
+		for _, item := range response.Items {
+			published, err := time.Parse(time.RFC3339, item.Snippet.PublishedAt)
+			if err != nil {
+				return ids, newest, err
+			}
+			if item.Id.VideoId == cursor.VideoID || published.Before(cursor.PublishedAt) {
+				return ids, newest, nil
+			}
+			if published.After(newest.PublishedAt) {
+				newest = models.SyncCursor{VideoID: item.Id.VideoId, PublishedAt: published.UTC()}
+			}
+			ids = append(ids, item.Id.VideoId)
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		pageToken = response.NextPageToken
 	}
+	return ids, newest, nil
+}
 
-	token := oauth2.Token{AccessToken: user.YTOAuth, RefreshToken: user.YTRefreshToken, Expiry: user.YTExpiry, TokenType: "Bearer"}
+// ytSubvideo видео из ответа videos.list
+func ytSubvideo(video *youtube.Video) (subvideo models.Subvideo, err error) {
+	var ytTime time.Time
+	typeSub := ""
 
-	tokenSource := yt.oauthConf.TokenSource(yt.context, &token)
-	updateToken, err := tokenSource.Token()
+	durationParser, err := duration.FromString(video.ContentDetails.Duration)
 	if err != nil {
-		return err
+		return subvideo, err
 	}
+	durationVideo := durationParser.ToDuration()
 
-	if token.AccessToken != updateToken.AccessToken {
-		user.YTOAuth = updateToken.AccessToken
-		user.YTRefreshToken = updateToken.RefreshToken
-		user.YTExpiry = updateToken.Expiry
-		user.Insert()
+	switch video.Snippet.LiveBroadcastContent {
+	case "upcoming":
+		ytTime, err = time.Parse(time.RFC3339, video.LiveStreamingDetails.ScheduledStartTime)
+		if err != nil {
+			return subvideo, err
+		}
+		typeSub = "youtube-stream"
+	case "live":
+		ytTime, err = time.Parse(time.RFC3339, video.LiveStreamingDetails.ActualStartTime)
+		if err != nil {
+			return subvideo, err
+		}
+		durationVideo, err = time.ParseDuration(strconv.Itoa(getLength(ytTime)) + "s")
+		if err != nil {
+			return subvideo, err
+		}
+		typeSub = "youtube-stream-live"
+	default:
+		ytTime, err = time.Parse(time.RFC3339, video.Snippet.PublishedAt)
+		if err != nil {
+			return subvideo, err
+		}
+		typeSub = "youtube"
 	}
 
-	if time.Now().After(user.YTExpiry) {
-		log.Println("Очищаю токен", user.UserName)
-		user.YTOAuth = ""
-		user.YTRefreshToken = ""
-		user.Insert()
-	}
+	return models.Subvideo{
+		TypeSub:     typeSub,
+		Title:       video.Snippet.Title,
+		Channel:     video.Snippet.ChannelTitle,
+		ChannelID:   video.Snippet.ChannelId,
+		Description: video.Snippet.Description,
+		VideoID:     video.Id,
+		URL:         "https://www.youtube.com/watch?v=" + video.Id,
+		ThumbURL:    video.Snippet.Thumbnails.High.Url,
+		Length:      int(durationVideo.Seconds()),
+		Language:    ytLanguage(video.Snippet),
+		Date:        ytTime.UTC(),
+	}, nil
+}
 
-	client := oauth2.NewClient(yt.context, tokenSource)
+// TestStreamYouTube обновляет состояние запланированных и идущих стримов,
+// wentLive - запланированные стримы, которые начались
+func (yt *YT) TestStreamYouTube(ctx context.Context, user models.User) (wentLive []models.Subvideo, err error) {
+	typeSub := ""
 
-	service, err := youtube.New(client)
+	videos, err := models.Videos.SelectStreamOnlineYouTube(int(user.Id))
+	if err != nil {
+		return wentLive, err
+	}
+
+	ctx = userContext(ctx, user)
+	service, err := yt.userService(ctx, user)
 	if err != nil {
-		return err
+		return wentLive, err
 	}
 
 	var ids string
@@ -240,10 +422,10 @@ func (yt *YT) TestStreamYouTube(user models.User) (err error) {
 		ids += video.VideoID + ","
 	}
 
-	callVideos := service.Videos.List("snippet").Id(ids)
+	callVideos := service.Videos.List("snippet").Id(ids).Context(ctx)
 	responseVideos, err := callVideos.Do()
 	if err != nil {
-		return err
+		return wentLive, err
 	}
 
 	for _, video := range videos {
@@ -260,16 +442,113 @@ func (yt *YT) TestStreamYouTube(user models.User) (err error) {
 				default:
 					typeSub = "youtube"
 				}
+				started := video.TypeSub == "youtube-stream" && typeSub == "youtube-stream-live"
 				video.TypeSub = typeSub
-				video.Insert()
+				_, err = video.Insert(ctx)
+				if err != nil {
+					return wentLive, err
+				}
+				if started {
+					wentLive = append(wentLive, video)
+				}
 			}
 		}
 		if deleteVideo == true {
-			err = models.DeleteVideoForVideoID(video.VideoID)
+			err = models.Videos.DeleteVideoForVideoID(video.VideoID)
+			if err != nil {
+				return wentLive, err
+			}
+		}
+	}
+	return wentLive, nil
+}
+
+// Subscriptions ID каналов, на которые подписан пользователь. units -
+// потраченная квота YouTube
+func (yt *YT) Subscriptions(ctx context.Context, user models.User) (channelIDs []string, units int, err error) {
+	ctx = userContext(ctx, user)
+	service, err := yt.userService(ctx, user)
+	if err != nil {
+		return channelIDs, units, ytError(err)
+	}
+	channelIDs, units, err = yt.subscriptionIDs(ctx, service)
+	return channelIDs, units, ytError(err)
+}
+
+// BackfillChannel старые видео канала, вышедшие после since, не больше
+// limit. Берутся из плейлиста загрузок: страница стоит 1 единицу квоты
+// против 100 у search. units - потраченная квота YouTube
+func (yt *YT) BackfillChannel(ctx context.Context, user models.User, channelID string, since time.Time, limit int) (videos []models.Subvideo, units int, err error) {
+	ctx = userContext(ctx, user)
+	service, err := yt.userService(ctx, user)
+	if err != nil {
+		return videos, units, ytError(err)
+	}
+
+	// плейлист загрузок канала UCxxx называется UUxxx
+	uploads := "UU" + strings.TrimPrefix(channelID, "UC")
+	if !strings.HasPrefix(channelID, "UC") {
+		response, err := service.Channels.List("contentDetails").Id(channelID).Context(ctx).Do()
+		units++
+		if err != nil {
+			return videos, units, ytError(err)
+		}
+		if len(response.Items) == 0 {
+			return videos, units, nil
+		}
+		uploads = response.Items[0].ContentDetails.RelatedPlaylists.Uploads
+	}
+
+	var ids []string
+	pageToken := ""
+	for len(ids) < limit {
+		response, err := service.PlaylistItems.List("contentDetails").
+			PlaylistId(uploads).
+			MaxResults(int64(min(50, limit-len(ids)))).
+			PageToken(pageToken).
+			Context(ctx).
+			Do()
+		units++
+		if err != nil {
+			return videos, units, ytError(err)
+		}
+		old := false
+		for _, item := range response.Items {
+			published, err := time.Parse(time.RFC3339, item.ContentDetails.VideoPublishedAt)
+			if err == nil && published.Before(since) {
+				old = true
+				break
+			}
+			ids = append(ids, item.ContentDetails.VideoId)
+		}
+		if old || response.NextPageToken == "" {
+			break
+		}
+		pageToken = response.NextPageToken
+	}
+
+	for start := 0; start < len(ids); start += 50 {
+		batch := ids[start:min(start+50, len(ids))]
+		response, err := service.Videos.List("snippet,contentDetails,liveStreamingDetails").Id(strings.Join(batch, ",")).Context(ctx).Do()
+		units++
+		if err != nil {
+			return videos, units, ytError(err)
+		}
+		for _, video := range response.Items {
+			subvideo, err := ytSubvideo(video)
 			if err != nil {
-				return err
+				return videos, units, err
 			}
+			videos = append(videos, subvideo)
 		}
 	}
-	return nil
+	return videos, units, nil
+}
+
+func ytLanguage(snippet *youtube.VideoSnippet) string {
+	language := snippet.DefaultAudioLanguage
+	if language == "" {
+		language = snippet.DefaultLanguage
+	}
+	return videoLanguage(language, snippet.Title, snippet.Description)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/DeKoniX/subvideo/models"
+	"github.com/DeKoniX/subvideo/notify"
+	"gopkg.in/macaron.v1"
+)
+
+type pushSubscriptionJSON struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Device string `json:"device"`
+}
+
+type PushMuteForm struct {
+	MuteLive     bool `form:"mute_live"`
+	MuteNewVideo bool `form:"mute_new_video"`
+}
+
+func webPushEnabled() bool {
+	return config().WebPush.PublicKey != "" && config().WebPush.PrivateKey != ""
+}
+
+func webPushSender() *notify.WebPush {
+	subject := config().WebPush.Subject
+	if subject == "" {
+		subject = config().HeadURL
+	}
+	return &notify.WebPush{
+		PublicKey:  config().WebPush.PublicKey,
+		PrivateKey: config().WebPush.PrivateKey,
+		Subject:    subject,
+		HTTPClient: notify.NewPublicClient(30 * time.Second),
+	}
+}
+
+// printVAPIDKeys печатает новую пару ключей для блока webpush в конфиге
+func printVAPIDKeys() error {
+	publicKey, privateKey, err := notify.GenerateVAPIDKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("webpush:\n  public_key: %s\n  private_key: %s\n  subject: mailto:admin@example.com\n", publicKey, privateKey)
+	return nil
+}
+
+// pushSubscribeHandler принимает PushSubscription.toJSON() из браузера
+func pushSubscribeHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+	if !webPushEnabled() {
+		ctx.JSON(404, map[string]string{"error": "web push is disabled"})
+		return
+	}
+
+	var subJSON pushSubscriptionJSON
+	err := json.NewDecoder(ctx.Req.Request.Body).Decode(&subJSON)
+	if err != nil {
+		ctx.JSON(400, map[string]string{"error": "bad subscription"})
+		return
+	}
+	device := subJSON.Device
+	if device == "" {
+		device = ctx.Req.UserAgent()
+	}
+	if len(device) > 200 {
+		device = device[:200]
+	}
+	sub := models.PushSubscription{
+		UserID:   user.Id,
+		Endpoint: subJSON.Endpoint,
+		P256dh:   subJSON.Keys.P256dh,
+		Auth:     subJSON.Keys.Auth,
+		Device:   device,
+	}
+	err = sub.Insert()
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "push subscribe failed", "err", err)
+		ctx.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	target := strconv.FormatInt(sub.Id, 10)
+	_, exists, err := models.SelectNotifyRuleFor(user.Id, "webpush", target)
+	if err == nil && !exists {
+		rule := models.NotifyRule{UserID: user.Id, Backend: "webpush", Target: target}
+		err = rule.Insert()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "push subscribe failed", "err", err)
+	}
+	ctx.JSON(200, map[string]int64{"id": sub.Id})
+}
+
+func pushUnsubscribeHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.JSON(401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var subJSON pushSubscriptionJSON
+	err := json.NewDecoder(ctx.Req.Request.Body).Decode(&subJSON)
+	if err != nil {
+		ctx.JSON(400, map[string]string{"error": "bad subscription"})
+		return
+	}
+	sub, err := models.SelectPushSubscriptionForEndpoint(subJSON.Endpoint, user.Id)
+	if err == nil {
+		err = deletePushSubscription(sub)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "push unsubscribe failed", "err", err)
+	}
+	ctx.JSON(200, map[string]bool{"ok": true})
+}
+
+func pushMuteHandler(ctx *macaron.Context, muteForm PushMuteForm) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	sub, err := models.SelectPushSubscription(ctx.ParamsInt64(":id"))
+	if err == nil && sub.UserID == user.Id {
+		err = sub.SetMute(muteForm.MuteLive, muteForm.MuteNewVideo)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "push mute failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/user/notify")
+}
+
+func pushDeleteHandler(ctx *macaron.Context) {
+	user := currentUser(ctx.GetCookie("username"), ctx.GetCookie("crypt"))
+	if user.UserName == "" {
+		ctx.Redirect(config().Server.BasePath + "/login")
+		return
+	}
+
+	sub, err := models.SelectPushSubscription(ctx.ParamsInt64(":id"))
+	if err == nil && sub.UserID == user.Id {
+		err = deletePushSubscription(sub)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Req.Context(), "push delete failed", "err", err)
+	}
+	ctx.Redirect(config().Server.BasePath + "/user/notify")
+}
+
+func deletePushSubscription(sub models.PushSubscription) (err error) {
+	err = models.DeleteNotifyRulesFor(sub.UserID, "webpush", strconv.FormatInt(sub.Id, 10))
+	if err != nil {
+		return err
+	}
+	return models.DeletePushSubscription(sub.Id)
+}